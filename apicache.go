@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultAPICacheMaxAge is the default age past which the cached downloads JSON is no longer used
+const defaultAPICacheMaxAge = 24 * time.Hour
+
+// apiCachePath returns the path of the cached downloads JSON
+func apiCachePath(dir string) string {
+	return filepath.Join(dir, "downloads.json")
+}
+
+// apiCacheMeta holds the validators of the cached downloads JSON, sent back in conditional requests
+type apiCacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// apiCacheMetaPath returns the path of the validators of the cached downloads JSON
+func apiCacheMetaPath(dir string) string {
+	return filepath.Join(dir, "downloads.meta.json")
+}
+
+// writeAPICache atomically stores a copy of the downloads JSON in a state directory, with its validators
+func writeAPICache(dir string, body []byte, meta apiCacheMeta) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	j, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	for f, b := range map[string][]byte{apiCachePath(dir): body, apiCacheMetaPath(dir): j} {
+		tmp := f + ".tmp"
+		if err := os.WriteFile(tmp, b, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readAPICacheMeta returns the validators of the cached downloads JSON of a state directory
+func readAPICacheMeta(dir string) (apiCacheMeta, error) {
+	m := apiCacheMeta{}
+	b, err := os.ReadFile(apiCacheMetaPath(dir))
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(b, &m)
+}
+
+// apiCacheExpired reports whether a downloads JSON fetched or validated at a time is older than
+// API_CACHE_MAX_AGE, logging a warning when so
+func (c *Config) apiCacheExpired(fetched time.Time) bool {
+	age := time.Since(fetched)
+	if age < c.APICacheMaxAge {
+		return false
+	}
+	logWarn("The cached downloads JSON from", age.Round(time.Second), "ago expired, see API_CACHE_MAX_AGE")
+	return true
+}
+
+// readAPICache returns the cached downloads JSON of a state directory and when it was fetched
+func readAPICache(dir string) ([]byte, time.Time, error) {
+	fi, err := os.Stat(apiCachePath(dir))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	body, err := os.ReadFile(apiCachePath(dir))
+	return body, fi.ModTime(), err
+}
+
+// apiProxy serves the downloads JSON from the cache, fetching it again once older than ttl
+type apiProxy struct {
+	cfg *Config
+	ttl time.Duration
+	mu  sync.Mutex
+}
+
+// get returns the downloads JSON, from the cache while it is fresh or when the upstream request fails
+func (p *apiProxy) get() ([]byte, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cached, fetched, cerr := readAPICache(p.cfg.StateDir)
+	if cerr == nil && time.Since(fetched) < p.ttl {
+		return cached, false, nil
+	}
+	body, err := fetchPlexAPI(p.cfg)
+	if err != nil {
+		if cerr != nil || p.cfg.apiCacheExpired(fetched) {
+			return nil, false, err
+		}
+		logWarn("Unable to refresh the downloads JSON, serving the cached copy from", time.Since(fetched).Round(time.Second), "ago: ", err)
+		return cached, true, nil
+	}
+	return body, false, nil
+}
+
+// ServeHTTP serves the downloads JSON
+func (p *apiProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logInfo(r.RemoteAddr, r.Method, r.URL.Path)
+	if path.Base(r.URL.Path) != "5.json" {
+		http.NotFound(w, r)
+		return
+	}
+	body, stale, err := p.get()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	w.Write(body)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// buildTypeAuto detects the build type from the hardware of the NAS
+const buildTypeAuto = "auto"
+
+// synoinfoFile describes the model and the platform of the NAS
+const synoinfoFile = "/etc.defaults/synoinfo.conf"
+
+// cpuinfoFile lists the features of the CPU
+const cpuinfoFile = "/proc/cpuinfo"
+
+// machineBuildTypes maps the machine hardware names reported by uname to build types
+var machineBuildTypes = map[string]string{
+	"x86_64":  "linux-x86_64",
+	"i686":    "linux-x86",
+	"i386":    "linux-x86",
+	"aarch64": "linux-aarch64",
+	"armv7l":  "linux-armv7hf_neon",
+	"ppc64le": "linux-ppc64le",
+}
+
+// buildTypeAliases maps the architecture names of other tools to build types
+var buildTypeAliases = map[string]string{
+	"amd64":   "linux-x86_64",
+	"x86_64":  "linux-x86_64",
+	"x64":     "linux-x86_64",
+	"arm64":   "linux-aarch64",
+	"aarch64": "linux-aarch64",
+	"armv8":   "linux-aarch64",
+	"armv7":   "linux-armv7hf_neon",
+	"armv7l":  "linux-armv7hf_neon",
+	"armhf":   "linux-armv7hf_neon",
+	"i386":    "linux-x86",
+	"i686":    "linux-x86",
+	"x86":     "linux-x86",
+	"386":     "linux-x86",
+	"ppc64le": "linux-ppc64le",
+}
+
+// buildTypeAliasList returns the aliases of the build types as alias=build type, sorted
+func buildTypeAliasList() []string {
+	l := []string{}
+	for a, b := range buildTypeAliases {
+		l = append(l, a+"="+b)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// maxBuildTypeDistance is the largest number of edits between a build type and the one it is a typo of
+const maxBuildTypeDistance = 3
+
+// matchBuildType returns the one of a list of build types a build type matches, ignoring case
+func matchBuildType(b string, types []string) (string, bool) {
+	for _, t := range types {
+		if strings.EqualFold(t, b) {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// closestBuildType returns the one of a list of build types a build type looks like a typo of, if any.
+// The names are also compared without their linux- prefix, and a truncated name is a typo of the full one.
+// An alias with the linux- prefix, such as linux-amd64, is a typo of the build type of the alias.
+func closestBuildType(b string, types []string) string {
+	b = strings.ToLower(b)
+	short := strings.TrimPrefix(b, "linux-")
+	if t, ok := matchBuildType(buildTypeAliases[short], types); ok {
+		return t
+	}
+	closest, distance := "", maxBuildTypeDistance+1
+	for _, t := range types {
+		d := editDistance(b, t)
+		if ts := strings.TrimPrefix(t, "linux-"); short != "" && strings.HasPrefix(ts, short) {
+			d = 1
+		} else if sd := editDistance(short, ts); sd < d {
+			d = sd
+		}
+		// a short name is too far from any build type once most of it is edited
+		if d < distance && d < len(short) {
+			closest, distance = t, d
+		}
+	}
+	return closest
+}
+
+// editDistance returns the Levenshtein distance of two strings, the number of single character
+// insertions, deletions and substitutions turning one into the other
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// minInt returns the smallest of integers
+func minInt(n int, others ...int) int {
+	for _, o := range others {
+		if o < n {
+			n = o
+		}
+	}
+	return n
+}
+
+// machineArch returns the machine hardware name of the NAS
+func machineArch() (string, error) {
+	out, err := commandOutput(context.Background(), "uname", "-m")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// machineBuildType returns the build type matching the machine hardware of the NAS, an ARMv7 one
+// needing NEON
+func machineBuildType() (string, string, error) {
+	m, err := machineArch()
+	if err != nil {
+		return "", "", err
+	}
+	b, ok := machineBuildTypes[m]
+	if !ok {
+		return m, "", fmt.Errorf("no build type known for machine %s", m)
+	}
+	if m == "armv7l" && !cpuHasNeon() {
+		return m, "", fmt.Errorf("no build type known for machine %s without NEON", m)
+	}
+	return m, b, nil
+}
+
+// cpuHasNeon reports whether the CPU lists the NEON feature
+func cpuHasNeon() bool {
+	b, err := os.ReadFile(cpuinfoFile)
+	if err != nil {
+		logDebug("Unable to read the CPU features: ", err)
+		return false
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if k, v, ok := strings.Cut(l, ":"); ok && strings.TrimSpace(k) == "Features" {
+			for _, f := range strings.Fields(v) {
+				if f == "neon" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// detectBuildType returns the build type of the hardware of the NAS, logging the machine and the
+// platform it was detected from
+func detectBuildType() (string, error) {
+	m, b, err := machineBuildType()
+	if err != nil {
+		return "", fmt.Errorf("detecting the build type: %w, set BUILD_TYPE to one of %s, see list-builds", err, strings.Join(knownBuildTypes, ", "))
+	}
+	platform := "unknown platform"
+	if p, err := confField(synoinfoFile, "platform_name"); err == nil {
+		platform = "platform " + p
+	} else {
+		logDebug("Unable to read the platform of the NAS: ", err)
+	}
+	if u, err := confField(synoinfoFile, "unique"); err == nil {
+		platform += " (" + u + ")"
+	}
+	logInfo(fmt.Sprintf("Build type detected: %s, machine %s, %s", b, m, platform))
+	return b, nil
+}
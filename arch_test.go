@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestClosestBuildType(t *testing.T) {
+	for _, tc := range []struct {
+		buildType string
+		want      string
+	}{
+		// the typos of the issues
+		{"linux-arm64", "linux-aarch64"},
+		{"linux-amd64", "linux-x86_64"},
+		{"linux-x64", "linux-x86_64"},
+		{"linux-armhf", "linux-armv7hf_neon"},
+		{"linux-x86-64", "linux-x86_64"},
+		{"linux_x86_64", "linux-x86_64"},
+		{"Linux-X86_64 ", "linux-x86_64"},
+		{"linux-armv7", "linux-armv7hf_neon"},
+		{"linux-armv7hf", "linux-armv7hf_neon"},
+		{"linux-armv7neon", "linux-armv7hf_neon"},
+		{"linux-aarch", "linux-aarch64"},
+		{"linux-i386", "linux-x86"},
+		{"linux-ppc64", "linux-ppc64le"},
+		{"x86-64", "linux-x86_64"},
+		// too far from any build type
+		{"foo", ""},
+		{"linux", ""},
+		{"linux-", ""},
+		{"windows-x86_64", ""},
+	} {
+		if got := closestBuildType(tc.buildType, knownBuildTypes); got != tc.want {
+			t.Errorf("closestBuildType(%q) = %q, want %q", tc.buildType, got, tc.want)
+		}
+	}
+}
+
+func TestClosestBuildTypePublished(t *testing.T) {
+	// only the build types published are suggested
+	published := []string{"linux-x86_64", "linux-aarch64"}
+	if got := closestBuildType("linux-x64", published); got != "linux-x86_64" {
+		t.Errorf("closestBuildType(linux-x64) = %q, want linux-x86_64", got)
+	}
+	if got := closestBuildType("linux-armhf", published); got != "" {
+		t.Errorf("closestBuildType(linux-armhf) = %q, want none as no ARMv7 build is published", got)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"x86_64", "", 6},
+		{"x86_64", "x86_64", 0},
+		{"x86-64", "x86_64", 1},
+		{"arm64", "aarch64", 3},
+		{"kitten", "sitting", 3},
+	} {
+		if got := editDistance(tc.a, tc.b); got != tc.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := editDistance(tc.b, tc.a); got != tc.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tc.b, tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestResolveBuildType(t *testing.T) {
+	for _, tc := range []struct {
+		buildType string
+		want      string
+	}{
+		{"linux-x86_64", "linux-x86_64"},
+		{"LINUX-AARCH64", "linux-aarch64"},
+		{"Linux-ArmV7hf_Neon", "linux-armv7hf_neon"},
+		{"amd64", "linux-x86_64"},
+		{"ARM64", "linux-aarch64"},
+		{"armhf", "linux-armv7hf_neon"},
+		{"i686", "linux-x86"},
+	} {
+		cfg := &Config{BuildType: tc.buildType}
+		if err := cfg.resolveBuildType(); err != nil {
+			t.Errorf("%s: %v", tc.buildType, err)
+			continue
+		}
+		if cfg.BuildType != tc.want {
+			t.Errorf("%s resolved to %s, want %s", tc.buildType, cfg.BuildType, tc.want)
+		}
+	}
+}
+
+func TestResolveBuildTypeUnknown(t *testing.T) {
+	cfg := &Config{BuildType: "linux-arm64"}
+	err := cfg.resolveBuildType()
+	var be *buildTypeError
+	if !errors.As(err, &be) {
+		t.Fatalf("got %v, want a buildTypeError", err)
+	}
+	if !strings.Contains(err.Error(), `"linux-arm64" (did you mean linux-aarch64?)`) {
+		t.Errorf("error without the suggestion: %v", err)
+	}
+	if errorExitCode(err) != exitUnknownBuildType {
+		t.Errorf("exit code %d, want %d", errorExitCode(err), exitUnknownBuildType)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// archivedPackage is a previously downloaded package kept in the download directory
+type archivedPackage struct {
+	file    string
+	version string
+}
+
+// listArchivedPackages returns the packages found in a directory, newest version first
+func listArchivedPackages(dir string) ([]archivedPackage, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "PlexMediaServer-*.spk"))
+	if err != nil {
+		return nil, err
+	}
+
+	var pkgs []archivedPackage
+	for _, f := range files {
+		m, ok, err := readManifest(f)
+		if err != nil {
+			return nil, err
+		}
+		v := m.Version
+		if !ok {
+			if v, ok = packageFileVersion(f); !ok {
+				continue
+			}
+		}
+		pkgs = append(pkgs, archivedPackage{file: f, version: v})
+	}
+
+	var sortErr error
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		cmp, err := compareVersions(pkgs[i].version, pkgs[j].version)
+		if err != nil {
+			sortErr = err
+		}
+		return cmp > 0
+	})
+	return pkgs, sortErr
+}
+
+// prunePackages removes the verified packages of a directory besides the keep newest versions,
+// the packages without a manifest were not downloaded by the updater and are left alone
+func prunePackages(dir string, keep int) error {
+	pkgs, err := listArchivedPackages(dir)
+	if err != nil {
+		return err
+	}
+	// the builds of a version, such as those of the other architectures kept by a mirror, count as one
+	kept := map[string]bool{}
+	for _, p := range pkgs {
+		if _, ok, err := readManifest(p.file); err != nil || !ok {
+			continue
+		}
+		v, ok := packageFileVersion(p.file)
+		if !ok {
+			v = p.version
+		}
+		if v = coreVersion(v); kept[v] || len(kept) < keep {
+			kept[v] = true
+			continue
+		}
+		for _, f := range []string{p.file, manifestPath(p.file)} {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		logInfo("Pruned package of version", coreVersion(p.version)+":", p.file)
+	}
+	return nil
+}
+
+// findRollbackPackage returns the archived package to roll back to: the given version,
+// or the newest one older than the installed version
+func findRollbackPackage(dir string, installedVersion string, to string) (archivedPackage, error) {
+	pkgs, err := listArchivedPackages(dir)
+	if err != nil {
+		return archivedPackage{}, err
+	}
+
+	for _, p := range pkgs {
+		if to != "" {
+			if coreVersion(p.version) == coreVersion(to) {
+				return p, nil
+			}
+			continue
+		}
+		cmp, err := compareVersions(p.version, installedVersion)
+		if err != nil {
+			return archivedPackage{}, err
+		}
+		if cmp < 0 {
+			return p, nil
+		}
+	}
+
+	if to != "" {
+		return archivedPackage{}, fmt.Errorf("no archived package of version %s in %s", to, dir)
+	}
+	return archivedPackage{}, fmt.Errorf("no archived package older than %s in %s", installedVersion, dir)
+}
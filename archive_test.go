@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archivePackage writes a package file to a directory, with its manifest when managed by the updater
+func archivePackage(t *testing.T, dir string, name string, managed bool) string {
+	t.Helper()
+	f := filepath.Join(dir, name)
+	if err := os.WriteFile(f, []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !managed {
+		return f
+	}
+	v, ok := packageFileVersion(f)
+	if !ok {
+		t.Fatalf("no version in %s", name)
+	}
+	if err := writeManifest(f, v, release{Checksum: "0123"}, checksums{sha1: "0123"}); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestPrunePackages(t *testing.T) {
+	for _, tc := range []struct {
+		keep   int
+		pruned []string
+	}{
+		{1, []string{"1.40.0.7998", "1.39.2.7700"}},
+		{2, []string{"1.39.2.7700"}},
+		{3, nil},
+	} {
+		dir := t.TempDir()
+		files := map[string]string{}
+		for _, p := range []struct {
+			name    string
+			version string
+			managed bool
+		}{
+			{"PlexMediaServer-1.41.0.8992-8463ad060-x86_64_DSM7.spk", "1.41.0.8992", true},
+			{"PlexMediaServer-1.41.0.8992-8463ad060-aarch64_DSM7.spk", "1.41.0.8992", true},
+			{"PlexMediaServer-1.40.0.7998-c29d4c0c8-x86_64_DSM7.spk", "1.40.0.7998", true},
+			{"PlexMediaServer-1.40.0.7998-c29d4c0c8-armv7hf_neon_DSM7.spk", "1.40.0.7998", true},
+			{"PlexMediaServer-1.40.0.7998-c29d4c0c8-x86_64_DSM7-copy.spk", "1.40.0.7998", true},
+			{"PlexMediaServer-1.39.2.7700-0a1b2c3d4-x86_64_DSM7.spk", "1.39.2.7700", true},
+			// a package without a manifest was not downloaded by the updater
+			{"PlexMediaServer-1.38.0.7000-a1b2c3d4e-x86_64_DSM7.spk", "", false},
+		} {
+			files[archivePackage(t, dir, p.name, p.managed)] = p.version
+		}
+
+		if err := prunePackages(dir, tc.keep); err != nil {
+			t.Fatal(err)
+		}
+		pruned := map[string]bool{}
+		for _, v := range tc.pruned {
+			pruned[v] = true
+		}
+		for f, v := range files {
+			_, err := os.Stat(f)
+			_, merr := os.Stat(manifestPath(f))
+			switch {
+			case pruned[v] && (!os.IsNotExist(err) || !os.IsNotExist(merr)):
+				t.Errorf("keep %d: %s not pruned", tc.keep, filepath.Base(f))
+			case !pruned[v] && err != nil:
+				t.Errorf("keep %d: %s pruned: %v", tc.keep, filepath.Base(f), err)
+			}
+		}
+	}
+}
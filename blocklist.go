@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+)
+
+// blocklistTimeout bounds the request of the blocklist, which must not hold up a run
+const blocklistTimeout = 5 * time.Second
+
+// maxBlocklistSize is the largest blocklist read
+const maxBlocklistSize = 1 << 20
+
+// blocklistCachePath returns the path of the cached blocklist, used when BLOCKLIST_URL can not be fetched
+func blocklistCachePath(dir string) string {
+	return filepath.Join(dir, "blocklist.json")
+}
+
+// fetchBlocklist returns the body of the blocklist of BLOCKLIST_URL, caching it
+func fetchBlocklist(cfg *Config) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(cfg.context(), blocklistTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.BlocklistURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", cfg.userAgent())
+	res, err := cfg.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, newStatusError(cfg.BlocklistURL, res)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxBlocklistSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBlocklistSize {
+		return nil, fmt.Errorf("the blocklist exceeds the limit of %s", formatBytes(maxBlocklistSize))
+	}
+	// a blocklist that does not decode is not cached, keeping the previous one
+	if err := json.Unmarshal(body, &[]string{}); err != nil {
+		return nil, fmt.Errorf("decoding the blocklist: %w, expected a JSON array of version constraints", err)
+	}
+	if err := os.MkdirAll(cfg.StateDir, 0700); err == nil {
+		tmp := blocklistCachePath(cfg.StateDir) + ".tmp"
+		if err := os.WriteFile(tmp, body, 0600); err == nil {
+			err = os.Rename(tmp, blocklistCachePath(cfg.StateDir))
+		}
+		if err != nil {
+			logDebug("Unable to cache the blocklist: ", err)
+		}
+	}
+	return body, nil
+}
+
+// blocklistEntry is a version constraint of the blocklist
+type blocklistEntry struct {
+	entry       string
+	constraints version.Constraints
+}
+
+// parseBlocklist decodes a blocklist, a JSON array of version constraints such as ">=1.41.0, <1.41.2",
+// skipping the invalid ones
+func parseBlocklist(body []byte) ([]blocklistEntry, error) {
+	var entries []string
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("decoding the blocklist: %w, expected a JSON array of version constraints", err)
+	}
+	blocklist := []blocklistEntry{}
+	for _, e := range entries {
+		c, err := version.NewConstraint(e)
+		if err != nil {
+			logWarn(fmt.Sprintf("Ignoring the invalid blocklist entry %q: %v", e, err))
+			continue
+		}
+		blocklist = append(blocklist, blocklistEntry{strings.TrimSpace(e), c})
+	}
+	return blocklist, nil
+}
+
+// loadBlocklist returns the blocklist of BLOCKLIST_URL, the cached one when it can not be fetched, or
+// none when there is no cached one either
+func loadBlocklist(cfg *Config) []blocklistEntry {
+	body, err := fetchBlocklist(cfg)
+	if err != nil {
+		cached, cerr := os.ReadFile(blocklistCachePath(cfg.StateDir))
+		if cerr != nil {
+			logWarn("Unable to fetch the blocklist, no version is blocked: ", err)
+			return nil
+		}
+		logWarn("Unable to fetch the blocklist, using the cached copy: ", err)
+		body = cached
+	}
+	blocklist, err := parseBlocklist(body)
+	if err != nil {
+		logWarn("Unable to read the cached blocklist, no version is blocked: ", err)
+		return nil
+	}
+	return blocklist
+}
+
+// blockedBy returns the first entry of the blocklist of BLOCKLIST_URL a version matches, comparing its
+// core version, or an empty string
+func blockedBy(cfg *Config, v string) string {
+	if cfg.BlocklistURL == "" {
+		return ""
+	}
+	cv, err := version.NewVersion(coreVersion(v))
+	if err != nil {
+		return ""
+	}
+	for _, e := range loadBlocklist(cfg) {
+		if e.constraints.Check(cv) {
+			return e.entry
+		}
+	}
+	return ""
+}
+
+// notifyBlocked sends a notification of a version blocked by BLOCKLIST_URL once, with BLOCKLIST_NOTIFY
+func notifyBlocked(cfg *Config, s *state, v string, entry string) {
+	if !cfg.BlocklistNotify {
+		return
+	}
+	if _, ok := s.BlockNotified[v]; ok {
+		return
+	}
+	msg := fmt.Sprintf("Synology Plex Updater did not install PlexMediaServer version %s, blocked by %s in the blocklist", coreVersion(v), entry)
+	if err := sendNotification(cfg, "PKGHasUpgrade", "pkg_has_update", msg); err != nil {
+		logWarn("Unable to send the notification: ", err)
+		return
+	}
+	if s.BlockNotified == nil {
+		s.BlockNotified = map[string]time.Time{}
+	}
+	s.BlockNotified[v] = time.Now().UTC()
+	if err := s.save(); err != nil {
+		logWarn("Unable to record the notification: ", err)
+	}
+}
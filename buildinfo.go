@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build metadata, set at compile time with:
+//
+//	go build -ldflags "-X main.buildVersion=v1.0.0 -X main.buildCommit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	buildVersion = ""
+	buildCommit  = ""
+	buildDate    = ""
+)
+
+// updaterBuild returns the version, commit and date the updater was built with,
+// falling back to the module build info when not set through ldflags
+func updaterBuild() (string, string, string) {
+	v, c, d := buildVersion, buildCommit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && c == "":
+				c = s.Value
+				if len(c) > 12 {
+					c = c[:12]
+				}
+			case s.Key == "vcs.time" && d == "":
+				d = s.Value
+			}
+		}
+	}
+	if v == "" {
+		v = "dev"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return v, c, d
+}
+
+// updaterVersion returns a human readable description of the updater build
+func updaterVersion() string {
+	v, c, d := updaterBuild()
+	return fmt.Sprintf("synology-plex-updater %s (commit %s, built %s)", v, c, d)
+}
+
+// userAgent returns the User-Agent sent on every request, USER_AGENT or else the version of the updater
+// with the build type and the DSM version, read once
+func (c *Config) userAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+	c.userAgentOnce.Do(func() {
+		c.agentVersion, _, _ = updaterBuild()
+		dsm, err := dsmVersion()
+		if err != nil {
+			dsm = "unknown"
+		}
+		c.agentDSM = dsm
+	})
+	return fmt.Sprintf("synology-plex-updater/%s (%s; DSM %s)", c.agentVersion, c.BuildType, c.agentDSM)
+}
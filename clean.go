@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cleanItem is a file the clean subcommand removes
+type cleanItem struct {
+	file   string
+	reason string
+	size   int64
+}
+
+// parseAge parses a duration, also accepting a number of days such as 30d
+func parseAge(s string) (time.Duration, error) {
+	if d, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// fileSize returns the size of a file, 0 when it does not exist
+func fileSize(f string) int64 {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// latestReleaseFiles returns the package file names of the cached downloads JSON, with their checksums
+func latestReleaseFiles(cfg *Config) map[string]string {
+	files := map[string]string{}
+	body, _, err := readAPICache(cfg.StateDir)
+	if err != nil {
+		return files
+	}
+	p, err := decodePlexInfo(body, cfg.dsmMajor())
+	if err != nil {
+		return files
+	}
+	for _, r := range p.platform.Releases {
+		if f, err := releaseFilePath("", r); err == nil {
+			files[f] = r.Checksum
+		}
+	}
+	return files
+}
+
+// cleanCandidates returns the files created by the updater in the download directory that can be removed:
+// temporary files, partial downloads, orphaned manifests and, besides the keep newest and the protected ones,
+// packages downloaded more than olderThan ago
+func cleanCandidates(cfg *Config, keep int, olderThan time.Duration, protected map[string]bool) ([]cleanItem, error) {
+	dir := cfg.Dir
+	items := []cleanItem{}
+	for _, f := range []string{stateFilePath(cfg.StateDir) + ".tmp", apiCachePath(cfg.StateDir) + ".tmp", apiCacheMetaPath(cfg.StateDir) + ".tmp"} {
+		if fi, err := os.Stat(f); err == nil {
+			items = append(items, cleanItem{f, "temporary file", fi.Size()})
+		}
+	}
+
+	// only the partial downloads recorded in the state are known to be ours
+	s, err := loadState(cfg.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range s.Partials {
+		if filepath.Dir(f) != absDir {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil {
+			items = append(items, cleanItem{f, "partial download", fi.Size()})
+		}
+	}
+
+	manifests, err := filepath.Glob(filepath.Join(dir, "PlexMediaServer-*.spk.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, mf := range manifests {
+		f := strings.TrimSuffix(mf, ".json")
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			continue
+		}
+		if m, ok, err := readManifest(f); err == nil && ok && m.SHA1 != "" {
+			items = append(items, cleanItem{mf, "manifest without package", fileSize(mf)})
+		}
+	}
+
+	pkgs, err := listArchivedPackages(dir)
+	if err != nil {
+		return nil, err
+	}
+	releases := latestReleaseFiles(cfg)
+	kept := 0
+	for _, p := range pkgs {
+		m, ok, err := readManifest(p.file)
+		if err != nil {
+			return nil, err
+		}
+		size := fileSize(p.file)
+		if !ok {
+			// only a download of the latest release not matching its checksum is known to be ours
+			checksum, known := releases[filepath.Base(p.file)]
+			if !known || protected[p.file] {
+				continue
+			}
+			if match, err := verifyChecksum(p.file, checksum); err == nil && !match {
+				items = append(items, cleanItem{p.file, "partial download", size})
+			}
+			continue
+		}
+		if m.Size > 0 && size != m.Size {
+			items = append(items, cleanItem{p.file, "partial download", size}, cleanItem{manifestPath(p.file), "manifest", fileSize(manifestPath(p.file))})
+			continue
+		}
+		if protected[p.file] {
+			continue
+		}
+		kept++
+		if kept <= keep {
+			continue
+		}
+		fi, err := os.Stat(manifestPath(p.file))
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(fi.ModTime()) < olderThan {
+			continue
+		}
+		reason := fmt.Sprintf("old package %s", coreVersion(p.version))
+		items = append(items, cleanItem{p.file, reason, size}, cleanItem{manifestPath(p.file), "manifest", fileSize(manifestPath(p.file))})
+	}
+	return items, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanCandidatesPartials(t *testing.T) {
+	cfg := testConfig(t)
+	ours := filepath.Join(cfg.Dir, testPackageName+".partial")
+	other := filepath.Join(cfg.Dir, "PlexMediaServer-1.41.0.8992-8463ad060-x86_64_DSM7.spk.partial")
+	for _, f := range []string{ours, other} {
+		if err := os.WriteFile(f, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recordPartial(cfg.StateDir, ours)
+
+	items, err := cleanCandidates(cfg, 2, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the partial download the updater did not record is left in place
+	if len(items) != 1 || items[0].file != ours || items[0].reason != "partial download" {
+		t.Errorf("got candidates %v, want only %s", items, ours)
+	}
+
+	// the partial downloads since removed are forgotten
+	os.Remove(ours)
+	recordPartial(cfg.StateDir, other)
+	s, err := loadState(cfg.StateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Partials) != 1 || s.Partials[0] != other {
+		t.Errorf("recorded partials %v, want only %s", s.Partials, other)
+	}
+}
@@ -0,0 +1,1136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/go-version"
+)
+
+// command is a subcommand of the updater
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(cfg *Config, args []string)
+}
+
+// commands returns the available subcommands
+func commands() []command {
+	return []command{
+		{"check", "", "check for a new version, exit 2 when one is available", runCheck},
+		{"download", "", "download and verify the latest release", runDownload},
+		{"install", "<file>", "install a downloaded package", runInstall},
+		{"notify", "<msg>", "send a notification to the Synology Notification Center", runNotify},
+		{"self-update", "", "update the updater to its latest GitHub release", runSelfUpdate},
+		{"test-notify", "", "send a test notification through the notification channels", runTestNotify},
+		{"status", "", "show the state of the PlexMediaServer package", runStatus},
+		{"bootstrap", "", "install PlexMediaServer when it is not installed yet", runBootstrap},
+		{"version", "", "print the installed PlexMediaServer version", runVersion},
+		{"diff", "", "compare the installed and the latest versions with the changelog", runDiff},
+		{"dump-api", "", "print the raw plex.tv downloads JSON", runDumpAPI},
+		{"list-builds", "", "list the build types published by plex.tv", runListBuilds},
+		{"rollback", "", "reinstall the previous archived package", runRollback},
+		{"repair", "", "reinstall the installed version", runRepair},
+		{"schedule", "", "create or refresh the DSM Task Scheduler entry running the updater", runSchedule},
+		{"api-proxy", "", "serve a cached copy of the downloads JSON", runAPIProxy},
+		{"mirror", "", "mirror every build and serve them with the downloads JSON", runMirror},
+		{"clean", "", "remove old and partial downloads of the updater", runClean},
+		{"history", "", "show the updates performed", runHistory},
+		{"approve", "<version>", "approve the install of a version", runApprove},
+		{"skip-version", "<version>", "never install a version", runSkipVersion},
+		{"unskip-version", "<version>", "allow a skipped version again", runUnskipVersion},
+		{"list-skipped", "", "list the skipped versions", runListSkipped},
+		{"doctor", "", "diagnose the environment the updater runs in", runDoctor},
+		{"completion", "<shell>", "print the bash, zsh or fish completion script", runCompletion},
+	}
+}
+
+// runCommand runs the subcommand with the given name
+func runCommand(cfg *Config, name string, args []string) {
+	for _, c := range commands() {
+		if c.name == name {
+			c.run(cfg, args)
+			return
+		}
+	}
+	if c := closestCommand(name); c != "" {
+		fmt.Fprintf(os.Stderr, "unknown command: %s (did you mean %s?)\nRun 'plex-updater -h' for usage.\n", name, c)
+	} else {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\nRun 'plex-updater -h' for usage.\n", name)
+	}
+	os.Exit(exitError)
+}
+
+// maxCommandDistance is the largest number of edits between a subcommand and the name it is a typo of
+const maxCommandDistance = 2
+
+// closestCommand returns the subcommand a name looks like a typo of, if any
+func closestCommand(name string) string {
+	name = strings.ToLower(name)
+	closest, distance := "", maxCommandDistance+1
+	for _, c := range commands() {
+		// a short name is too far from any subcommand once most of it is edited
+		if d := editDistance(name, c.name); d < distance && d < len(name)-1 {
+			closest, distance = c.name, d
+		}
+	}
+	return closest
+}
+
+// usage returns a usage function listing the flags and subcommands
+func usage(fs *flag.FlagSet) func() {
+	return func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s [flags]\n", fs.Name())
+		fmt.Fprintf(out, "       %s <command> [flags] [args]\n\nCommands:\n", fs.Name())
+		for _, c := range commands() {
+			fmt.Fprintf(out, "  %-24s %s\n", c.name+" "+c.args, c.summary)
+		}
+		fmt.Fprintf(out, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+}
+
+// newCommandFlagSet returns a flag set for a subcommand
+func newCommandFlagSet(cfg *Config, name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: plex-updater %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	logLevelFlags(fs)
+	configFlag(fs)
+	envFileFlag(fs)
+	synologyFlags(fs, cfg)
+	return fs
+}
+
+// synologyFlags registers the flags selecting the Plex package and the Synology tools managing it
+func synologyFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.PackageName, "package-name", cfg.PackageName, "name of the Plex package managed with synopkg (env PACKAGE_NAME)")
+	fs.BoolVar(&cfg.AutoPackage, "auto", cfg.AutoPackage, "detect the name of the Plex package with synopkg list (env PACKAGE_NAME=auto)")
+	fs.BoolVar(&cfg.NoSynology, "no-synology", cfg.NoSynology, "stand in for synopkg and synonotify to try the updater off a NAS (env NO_SYNOLOGY)")
+}
+
+// buildTypeFlag registers the build type and distro flags, overriding BUILD_TYPE and DISTRO
+func buildTypeFlag(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.BuildType, "build-type", cfg.BuildType, "plex build type, auto to detect it from the hardware (env BUILD_TYPE)")
+	fs.StringVar(&cfg.Distro, "distro", cfg.Distro, "distro of the plex release (env DISTRO)")
+}
+
+// dryRunFlag registers the dry-run flag, defaulting to DRY_RUN
+func dryRunFlag(fs *flag.FlagSet, p *bool) {
+	fs.BoolVar(p, "dry-run", getenvBool("DRY_RUN", false), "walk through the steps without making changes (env DRY_RUN)")
+}
+
+// targetVersionFlag registers the target-version flag, defaulting to TARGET_VERSION
+func targetVersionFlag(fs *flag.FlagSet, p *string) {
+	fs.StringVar(p, "target-version", getenv("TARGET_VERSION", ""), "never update past this version (env TARGET_VERSION)")
+}
+
+// dirFlag registers the download directory flag
+func dirFlag(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Dir, "dir", cfg.Dir, "directory where packages are downloaded to, by default on the volume of PlexMediaServer or else in /tmp (env DOWNLOAD_DIR)")
+}
+
+// downloadFlags registers the flags of the package downloads, overriding DOWNLOAD_SEGMENTS, DOWNLOAD_BACKEND and DS_FALLBACK
+func downloadFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.IntVar(&cfg.Segments, "segments", cfg.Segments, "download packages with this many concurrent range requests (env DOWNLOAD_SEGMENTS)")
+	fs.StringVar(&cfg.DownloadBackend, "download-backend", cfg.DownloadBackend, "download packages with builtin or download-station (env DOWNLOAD_BACKEND)")
+	fs.BoolVar(&cfg.DSFallback, "ds-fallback", cfg.DSFallback, "download with the builtin downloader when Download Station fails (env DS_FALLBACK)")
+}
+
+// packageCheckFlags registers the flags overriding the checks of a package before it is installed
+func packageCheckFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.BoolVar(&cfg.IgnoreMinDSM, "ignore-os-min-ver", cfg.IgnoreMinDSM, "install a package requiring a newer DSM than the one of the NAS (env IGNORE_OS_MIN_VER)")
+}
+
+// allowDowngradeFlag registers the allow-downgrade flag, defaulting to ALLOW_DOWNGRADE
+func allowDowngradeFlag(fs *flag.FlagSet, p *bool) {
+	fs.BoolVar(p, "allow-downgrade", getenvBool("ALLOW_DOWNGRADE", false), "permit installing a version older than the installed one (env ALLOW_DOWNGRADE)")
+}
+
+// removeAfterInstallFlag registers the remove-after-install flag, defaulting to the opposite of KEEP_PACKAGE
+func removeAfterInstallFlag(fs *flag.FlagSet, p *bool) {
+	fs.BoolVar(p, "remove-after-install", !getenvBool("KEEP_PACKAGE", true), "delete the downloaded package once it is installed (env KEEP_PACKAGE=false)")
+}
+
+// assumeYesFlag registers the yes flag, defaulting to ASSUME_YES
+func assumeYesFlag(fs *flag.FlagSet, p *bool) {
+	fs.BoolVar(p, "yes", getenvBool("ASSUME_YES", false), "do not ask for confirmation before installing (env ASSUME_YES)")
+}
+
+// runCheck checks for a new version
+func runCheck(cfg *Config, args []string) {
+	var target string
+	fs := newCommandFlagSet(cfg, "check", "")
+	buildTypeFlag(fs, cfg)
+	targetVersionFlag(fs, &target)
+	fs.Parse(args)
+	cfg.DryRun = true
+	exitInvalid(cfg.Validate())
+
+	c, err := checkForUpdate(cfg)
+	if err != nil {
+		exitFailed(err)
+	}
+	if target != "" {
+		if _, err := applyTargetVersion(&c, target); err != nil {
+			exitFailed(err)
+		}
+	}
+	recordLastCheck(cfg, c.latestVersion)
+	os.Exit(printCheck(c))
+}
+
+// runDownload downloads the latest release of a build type and prints its path
+func runDownload(cfg *Config, args []string) {
+	var dryRun bool
+	fs := newCommandFlagSet(cfg, "download", "")
+	buildTypeFlag(fs, cfg)
+	dirFlag(fs, cfg)
+	downloadFlags(fs, cfg)
+	dryRunFlag(fs, &dryRun)
+	allBuilds := fs.Bool("all-builds", false, "download the release of every build type into a directory of its version under --dir")
+	fs.Parse(args)
+	cfg.DryRun = dryRun
+	exitInvalid(cfg.Validate())
+
+	if *allBuilds {
+		files, err := downloadAllBuilds(cfg, dryRun)
+		for _, f := range files {
+			fmt.Println(f)
+		}
+		if err != nil {
+			exitInvalid(err)
+		}
+		return
+	}
+	rep := report{}
+	if err := downloadLatest(cfg, dryRun, &rep); err != nil {
+		exitFailed(err)
+	}
+	if rep.File != "" {
+		fmt.Println(rep.File)
+	}
+}
+
+// downloadLatest downloads the latest release of the build type with its manifest
+func downloadLatest(cfg *Config, dryRun bool, rep *report) error {
+	p, err := getPlexInfo(cfg)
+	if err != nil {
+		return err
+	}
+	v := p.platform.Version
+	logInfo("Latest version: ", v)
+	rep.LatestVersion = v
+	rel, err := selectRelease(p, cfg.BuildType, cfg.Distro)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return dryRunUpdate(cfg, cfg.Dir, rel)
+	}
+	fp, err := downloadWithManifest(cfg, cfg.Dir, v, rel)
+	if err != nil {
+		return err
+	}
+	rep.Action = actionDownloaded
+	rep.File = fp
+	rep.Checksum = rel.Checksum
+	return nil
+}
+
+// downloadAllBuilds downloads the latest release of every build type with its manifest into a directory
+// of its version, and returns the error of every build that failed once all of them were tried
+func downloadAllBuilds(cfg *Config, dryRun bool) ([]string, error) {
+	p, err := getPlexInfo(cfg)
+	if err != nil {
+		return nil, err
+	}
+	v := p.platform.Version
+	logInfo("Latest version: ", v)
+	dir := filepath.Join(cfg.Dir, v)
+	if dryRun {
+		for _, rel := range p.platform.Releases {
+			logInfo("[dry-run] Would download build", rel.Build+": ", rel.URL)
+		}
+		logInfo("[dry-run] Would save to: ", dir)
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	var errs []error
+	for _, rel := range p.platform.Releases {
+		logInfo("Downloading build", rel.Build)
+		fp, err := downloadWithManifest(cfg, dir, v, rel)
+		if err != nil {
+			logWarn("Unable to download build", rel.Build+": ", err)
+			errs = append(errs, fmt.Errorf("build %s: %w", rel.Build, err))
+			continue
+		}
+		files = append(files, fp)
+	}
+	logNotice("Downloaded", len(files), "of", len(p.platform.Releases), "builds of version", v, "to", dir)
+	return files, errors.Join(errs...)
+}
+
+// runInstall installs a package file and prints the resulting version
+func runInstall(cfg *Config, args []string) {
+	o := installOptions{cfg: cfg}
+	fs := newCommandFlagSet(cfg, "install", "<file>")
+	dryRunFlag(fs, &o.dryRun)
+	allowDowngradeFlag(fs, &o.allowDowngrade)
+	packageCheckFlags(fs, cfg)
+	assumeYesFlag(fs, &o.assumeYes)
+	fs.StringVar(&o.checksum, "checksum", "", "expected sha1 checksum of the package")
+	fs.Parse(args)
+	cfg.DryRun = o.dryRun
+	exitInvalid(cfg.Validate())
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitError)
+	}
+
+	rep := report{}
+	if err := installPackageFile(fs.Arg(0), o, &rep); err != nil {
+		exitFailed(err)
+	}
+	fmt.Println(rep.InstalledVersion)
+}
+
+// runNotify sends a notification
+func runNotify(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "notify", "<msg>")
+	tag := fs.String("tag", "PKGHasUpgrade", "notification tag")
+	template := fs.String("template", "pkg_has_update", "notification template placeholder")
+	fs.Parse(args)
+	exitInvalid(cfg.Validate())
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitError)
+	}
+
+	if err := sendNotification(cfg, *tag, *template, fs.Arg(0)); err != nil {
+		exitFailed(err)
+	}
+}
+
+// runSelfUpdate replaces the updater binary with its latest release
+func runSelfUpdate(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "self-update", "")
+	check := fs.Bool("check", false, "only report whether a newer updater exists, exit 2 when one does")
+	force := fs.Bool("force", false, "install the latest release even when it is not newer")
+	fs.Parse(args)
+	exitInvalid(cfg.Validate())
+
+	r, err := latestUpdaterRelease(cfg)
+	if err != nil {
+		exitFailed(err)
+	}
+	current, _, _ := updaterBuild()
+	logInfo("Running updater version: ", current)
+	logInfo("Latest updater release: ", r.TagName)
+	outdated, err := updaterOutdated(r)
+	if err != nil && !*force {
+		exitFailed(err)
+	}
+	if *check {
+		fmt.Println("installed:", current)
+		fmt.Println("latest:", r.TagName)
+		if outdated {
+			os.Exit(exitUpdateAvailable)
+		}
+		return
+	}
+	if !outdated && !*force {
+		logNotice("The updater is up to date")
+		return
+	}
+	if err := replaceExecutable(cfg, r); err != nil {
+		exitFailed(err)
+	}
+	logNotice("Updater updated to version: ", r.TagName)
+}
+
+// notificationChannels returns the channels notifications are delivered through
+func notificationChannels(cfg *Config) map[string]func(msg string) (string, error) {
+	return map[string]func(string) (string, error){
+		"dsm": func(msg string) (string, error) {
+			return notifyDSM(cfg, "PKGHasUpgrade", "pkg_has_update", msg)
+		},
+	}
+}
+
+// runTestNotify sends a test message through each channel and reports how it went
+func runTestNotify(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "test-notify", "")
+	channel := fs.String("channel", "", "only test this channel: dsm")
+	fs.Parse(args)
+	exitInvalid(cfg.Validate())
+
+	channels := notificationChannels(cfg)
+	names := []string{}
+	for name := range channels {
+		if *channel == "" || *channel == name {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		exitFailed(fmt.Errorf("unknown notification channel: %q", *channel))
+	}
+	sort.Strings(names)
+
+	failed := false
+	for _, name := range names {
+		out, err := channels[name]("Synology Plex Updater test notification, sent by plex-updater test-notify")
+		out = strings.TrimSpace(out)
+		if err != nil {
+			failed = true
+			fmt.Printf("%s: FAILED: %v\n", name, err)
+		} else {
+			fmt.Printf("%s: ok\n", name)
+		}
+		if out != "" {
+			fmt.Printf("  output: %s\n", out)
+		}
+	}
+	if failed {
+		os.Exit(exitError)
+	}
+}
+
+// runStatus prints the state of the package, the installed version and the last known latest one
+func runStatus(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "status", "")
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	fs.Parse(args)
+	exitInvalid(cfg.Validate())
+
+	st := struct {
+		State            string     `json:"state"`
+		Installed        bool       `json:"installed"`
+		InstalledVersion string     `json:"installed_version,omitempty"`
+		LatestVersion    string     `json:"latest_version,omitempty"`
+		LastCheck        *time.Time `json:"last_check,omitempty"`
+		UpdateAvailable  bool       `json:"update_available"`
+	}{}
+	var err error
+	if st.State, err = getPackageStatus(cfg); err != nil {
+		exitFailed(err)
+	}
+	st.Installed = st.State != "not-installed"
+	if st.Installed {
+		if st.InstalledVersion, err = getInstalledVersion(cfg); err != nil {
+			exitFailed(err)
+		}
+	}
+	s, err := loadState(cfg.StateDir)
+	if err != nil {
+		exitFailed(err)
+	}
+	if s.LastCheck != nil {
+		st.LatestVersion = s.LastCheck.LatestVersion
+		st.LastCheck = &s.LastCheck.Time
+		if st.Installed {
+			cmp, err := compareVersions(st.InstalledVersion, st.LatestVersion)
+			st.UpdateAvailable = err == nil && cmp < 0
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(st); err != nil {
+			exitFailed(err)
+		}
+		return
+	}
+	fmt.Println("state:", st.State)
+	if st.Installed {
+		fmt.Println("installed:", st.InstalledVersion)
+	}
+	if st.LastCheck != nil {
+		fmt.Printf("latest: %s (checked %s)\n", st.LatestVersion, st.LastCheck.Local().Format(time.RFC3339))
+	} else {
+		fmt.Println("latest: unknown, run check")
+	}
+}
+
+// runBootstrap downloads and installs the latest release when PlexMediaServer is not installed
+func runBootstrap(cfg *Config, args []string) {
+	var dryRun, assumeYes, removeAfterInstall bool
+	fs := newCommandFlagSet(cfg, "bootstrap", "")
+	buildTypeFlag(fs, cfg)
+	dirFlag(fs, cfg)
+	downloadFlags(fs, cfg)
+	dryRunFlag(fs, &dryRun)
+	assumeYesFlag(fs, &assumeYes)
+	removeAfterInstallFlag(fs, &removeAfterInstall)
+	packageCheckFlags(fs, cfg)
+	fs.Parse(args)
+	cfg.DryRun = dryRun
+	exitInvalid(cfg.Validate())
+
+	installed, err := getInstalledVersion(cfg)
+	if err == nil {
+		logNotice("PlexMediaServer is already installed, version: ", installed)
+		return
+	}
+	if !errors.Is(err, errNotInstalled) {
+		exitFailed(err)
+	}
+	logInfo("PlexMediaServer is not installed")
+
+	rep := report{BuildType: cfg.BuildType}
+	if err := freshInstall(cfg, dryRun, assumeYes, removeAfterInstall, &rep); err != nil {
+		exitFailed(err)
+	}
+	if rep.Action == actionInstalled {
+		fmt.Println(rep.InstalledVersion)
+	}
+}
+
+// freshInstall downloads and installs the latest release on a NAS without PlexMediaServer
+func freshInstall(cfg *Config, dryRun, assumeYes, removeAfterInstall bool, rep *report) error {
+	if err := downloadLatest(cfg, dryRun, rep); err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	if err := checkPackageFile(rep.File); err != nil {
+		return err
+	}
+	if !confirm(fmt.Sprintf("Install PlexMediaServer %s?", rep.LatestVersion), assumeYes) {
+		logNotice("Install cancelled, package left in place: ", rep.File)
+		return nil
+	}
+	v, err := installRecorded(cfg, rep.File, "", rep.LatestVersion, rep.Checksum, false)
+	if err != nil {
+		return err
+	}
+	rep.Action = actionInstalled
+	rep.InstalledVersion = v
+	if removeAfterInstall {
+		removeInstalledPackage(rep.File, v, rep.LatestVersion)
+	}
+	logNotice("Installed version: ", v)
+	return nil
+}
+
+// runVersion prints the installed PlexMediaServer version
+func runVersion(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "version", "")
+	fs.Parse(args)
+	exitInvalid(cfg.Validate())
+
+	v, err := getInstalledVersion(cfg)
+	if err != nil {
+		exitFailed(err)
+	}
+	fmt.Println(v)
+}
+
+// changelogItems splits the changelog of a release into its items
+func changelogItems(s string) []string {
+	items := []string{}
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			items = append(items, l)
+		}
+	}
+	return items
+}
+
+// defaultChangelogItems is the default number of items of each changelog section summarized
+const defaultChangelogItems = 5
+
+// changelogSummary returns the first items of a changelog, up to n of each section, 0 returning none
+func changelogSummary(added []string, fixed []string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	sections := []string{}
+	for _, section := range []struct {
+		name  string
+		items []string
+	}{{"Added", added}, {"Fixed", fixed}} {
+		if len(section.items) == 0 {
+			continue
+		}
+		s := section.name + ": "
+		if len(section.items) > n {
+			s += strings.Join(section.items[:n], "; ") + fmt.Sprintf(" (+%d more)", len(section.items)-n)
+		} else {
+			s += strings.Join(section.items, "; ")
+		}
+		sections = append(sections, s)
+	}
+	return strings.Join(sections, ". ")
+}
+
+// runDiff prints the installed and the latest versions with the items added and fixed in the latest one
+func runDiff(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "diff", "")
+	fs.Parse(args)
+	exitInvalid(cfg.Validate())
+
+	installed, err := getInstalledVersion(cfg)
+	if err != nil {
+		exitFailed(err)
+	}
+	p, err := getPlexInfo(cfg)
+	if err != nil {
+		exitFailed(err)
+	}
+	latest := p.platform
+	cmp, err := compareVersions(installed, latest.Version)
+	if err != nil {
+		exitFailed(err)
+	}
+
+	fmt.Println("installed:", installed)
+	fmt.Println("latest:", latest.Version)
+	if latest.ReleaseDate > 0 {
+		fmt.Println("released:", time.Unix(latest.ReleaseDate, 0).Format("2006-01-02"))
+	}
+	switch {
+	case cmp == 0:
+		fmt.Println("The installed version is current")
+		return
+	case cmp > 0:
+		fmt.Println("The installed version is newer than the latest release")
+		return
+	}
+	for _, section := range []struct{ name, items string }{
+		{"Added", latest.ItemsAdded},
+		{"Fixed", latest.ItemsFixed},
+	} {
+		items := changelogItems(section.items)
+		if len(items) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s:\n", section.name)
+		for _, i := range items {
+			fmt.Println("  -", i)
+		}
+	}
+}
+
+// runDumpAPI prints the plex.tv downloads JSON as received, optionally only the NAS platforms matching a name
+func runDumpAPI(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "dump-api", "")
+	pretty := fs.Bool("pretty", false, "indent the JSON")
+	platform := fs.String("platform", "", "only print the NAS platforms containing this name, e.g. synology")
+	fs.Parse(args)
+	exitInvalid(cfg.Validate())
+
+	body, err := fetchPlexAPI(cfg)
+	if err != nil {
+		exitFailed(err)
+	}
+	if *platform != "" {
+		var api struct {
+			Nas map[string]json.RawMessage `json:"nas"`
+		}
+		if err := json.Unmarshal(body, &api); err != nil {
+			exitFailed(fmt.Errorf("decoding %s: %w", cfg.DownloadsURL, err))
+		}
+		sections := map[string]json.RawMessage{}
+		for name, s := range api.Nas {
+			if strings.Contains(strings.ToLower(name), strings.ToLower(*platform)) {
+				sections[name] = s
+			}
+		}
+		if len(sections) == 0 {
+			exitFailed(fmt.Errorf("no NAS platform matching %q", *platform))
+		}
+		if body, err = json.Marshal(sections); err != nil {
+			exitFailed(err)
+		}
+	}
+	if *pretty {
+		var b bytes.Buffer
+		if err := json.Indent(&b, body, "", "  "); err != nil {
+			exitFailed(fmt.Errorf("decoding %s: %w", cfg.DownloadsURL, err))
+		}
+		body = b.Bytes()
+	}
+	os.Stdout.WriteString(redact(string(bytes.TrimRight(body, "\n"))))
+	fmt.Println()
+}
+
+// runListBuilds prints the releases published for Synology, marking the selected build type
+func runListBuilds(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "list-builds", "")
+	buildTypeFlag(fs, cfg)
+	fs.Parse(args)
+	exitInvalid(settingsError())
+	// the builds are listed to pick one, also when the build type is wrong
+	if err := cfg.resolveBuildType(); err != nil {
+		logWarn(err)
+	}
+
+	p, err := getPlexInfo(cfg)
+	if err != nil {
+		exitFailed(err)
+	}
+	logInfo("Latest version: ", p.platform.Version)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tBUILD\tDISTRO\tLABEL\tURL")
+	for _, r := range p.platform.Releases {
+		marker := ""
+		if strings.EqualFold(r.Build, cfg.BuildType) && strings.EqualFold(r.Distro, cfg.Distro) {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", marker, r.Build, r.Distro, r.Label, r.URL)
+	}
+	w.Flush()
+	fmt.Println()
+	fmt.Println("Aliases accepted as BUILD_TYPE:", strings.Join(buildTypeAliasList(), ", "))
+}
+
+// versionArg parses the single version argument of a subcommand
+func versionArg(cfg *Config, name string, args []string) string {
+	fs := newCommandFlagSet(cfg, name, "<version>")
+	fs.Parse(args)
+	exitInvalid(settingsError())
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitError)
+	}
+	v := fs.Arg(0)
+	if _, err := version.NewVersion(coreVersion(v)); err != nil {
+		exitFailed(fmt.Errorf("invalid version %q: %w", v, err))
+	}
+	return v
+}
+
+// runSkipVersion adds a version to the blocklist
+func runSkipVersion(cfg *Config, args []string) {
+	v := versionArg(cfg, "skip-version", args)
+
+	s, err := loadState(cfg.StateDir)
+	if err != nil {
+		exitFailed(err)
+	}
+	if !s.skip(v) {
+		logNotice("Version already skipped: ", coreVersion(v))
+		return
+	}
+	if err := s.save(); err != nil {
+		exitFailed(err)
+	}
+	logNotice("Version skipped: ", coreVersion(v))
+}
+
+// runUnskipVersion removes a version from the blocklist
+func runUnskipVersion(cfg *Config, args []string) {
+	v := versionArg(cfg, "unskip-version", args)
+
+	s, err := loadState(cfg.StateDir)
+	if err != nil {
+		exitFailed(err)
+	}
+	if !s.unskip(v) {
+		logNotice("Version was not skipped: ", coreVersion(v))
+		return
+	}
+	if err := s.save(); err != nil {
+		exitFailed(err)
+	}
+	logNotice("Version no longer skipped: ", coreVersion(v))
+}
+
+// runListSkipped prints the blocklisted versions
+func runListSkipped(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "list-skipped", "")
+	fs.Parse(args)
+	exitInvalid(settingsError())
+
+	s, err := loadState(cfg.StateDir)
+	if err != nil {
+		exitFailed(err)
+	}
+	for _, v := range s.SkippedVersions {
+		fmt.Println(v)
+	}
+}
+
+// runRollback installs the newest archived package older than the installed version
+func runRollback(cfg *Config, args []string) {
+	var to string
+	o := installOptions{cfg: cfg, allowDowngrade: true, rollback: true}
+	fs := newCommandFlagSet(cfg, "rollback", "")
+	dirFlag(fs, cfg)
+	dryRunFlag(fs, &o.dryRun)
+	assumeYesFlag(fs, &o.assumeYes)
+	fs.StringVar(&to, "to", "", "version to roll back to when several packages are archived")
+	packageCheckFlags(fs, cfg)
+	fs.Parse(args)
+	cfg.DryRun = o.dryRun
+	exitInvalid(cfg.Validate())
+
+	installedVersion, err := getInstalledVersion(cfg)
+	if err != nil {
+		exitFailed(err)
+	}
+	logInfo("Installed version: ", installedVersion)
+
+	p, err := findRollbackPackage(cfg.Dir, installedVersion, to)
+	if err != nil {
+		exitFailed(fmt.Errorf("refusing to roll back: %w", err))
+	}
+	logInfo("Rolling back to version: ", p.version, "from", p.file)
+
+	rep := report{}
+	if err := installPackageFile(p.file, o, &rep); err != nil {
+		exitFailed(err)
+	}
+	if rep.Action != actionInstalled {
+		return
+	}
+	if coreVersion(rep.InstalledVersion) != coreVersion(p.version) {
+		exitFailed(fmt.Errorf("rollback failed, installed version is %s instead of %s", rep.InstalledVersion, p.version))
+	}
+	if err := sendNotification(cfg, "PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater has rolled back PlexMediaServer to version: "+rep.InstalledVersion); err != nil {
+		exitFailed(err)
+	}
+	fmt.Println(rep.InstalledVersion)
+}
+
+// runRepair reinstalls the exact installed version, from plex.tv when it is still the latest
+// release or from a verified archived package otherwise
+func runRepair(cfg *Config, args []string) {
+	o := installOptions{cfg: cfg}
+	fs := newCommandFlagSet(cfg, "repair", "")
+	buildTypeFlag(fs, cfg)
+	dirFlag(fs, cfg)
+	downloadFlags(fs, cfg)
+	dryRunFlag(fs, &o.dryRun)
+	assumeYesFlag(fs, &o.assumeYes)
+	packageCheckFlags(fs, cfg)
+	fs.Parse(args)
+	cfg.DryRun = o.dryRun
+	exitInvalid(cfg.Validate())
+
+	installedVersion, err := getInstalledVersion(cfg)
+	if err != nil {
+		exitFailed(err)
+	}
+	logInfo("Installed version: ", installedVersion)
+
+	f, err := repairPackage(cfg, installedVersion, o.dryRun)
+	if err != nil {
+		exitFailed(fmt.Errorf("unable to repair: %w", err))
+	}
+	if f == "" {
+		return
+	}
+
+	rep := report{}
+	if err := installPackageFile(f, o, &rep); err != nil {
+		exitFailed(err)
+	}
+	if rep.Action != actionInstalled {
+		return
+	}
+	if err := sendNotification(cfg, "PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater has repaired PlexMediaServer version: "+rep.InstalledVersion); err != nil {
+		exitFailed(err)
+	}
+	fmt.Println(rep.InstalledVersion)
+}
+
+// repairPackage returns a verified package of exactly the installed version,
+// or an empty path after a dry-run of its download
+func repairPackage(cfg *Config, installedVersion string, dryRun bool) (string, error) {
+	dir := cfg.Dir
+	p, err := getPlexInfo(cfg)
+	if err != nil {
+		logWarn("Unable to fetch the latest release: ", err)
+	} else if sameBuild(installedVersion, p.platform.Version) {
+		rel, err := selectRelease(p, cfg.BuildType, cfg.Distro)
+		if err != nil {
+			return "", err
+		}
+		logInfo("Installed version is the latest release, using: ", rel.URL)
+		if dryRun {
+			return "", dryRunUpdate(cfg, dir, rel)
+		}
+		return downloadWithManifest(cfg, dir, p.platform.Version, rel)
+	} else {
+		logInfo("Installed version is not the latest release: ", p.platform.Version)
+	}
+
+	pkgs, err := listArchivedPackages(cfg.Dir)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range pkgs {
+		if !sameBuild(installedVersion, a.version) {
+			continue
+		}
+		if _, ok, err := readManifest(a.file); err != nil || !ok {
+			logWarn("Skipping archived package without a manifest: ", a.file)
+			continue
+		}
+		logInfo("Using archived package: ", a.file)
+		return a.file, nil
+	}
+	return "", fmt.Errorf("no verifiable package of version %s from plex.tv or in %s", installedVersion, dir)
+}
+
+// runSchedule creates, shows or removes the DSM Task Scheduler entry running the updater daily
+func runSchedule(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "schedule", "")
+	at := fs.String("time", "03:30", "local time of the daily run, HH:MM")
+	user := fs.String("user", "root", "user running the task")
+	show := fs.Bool("show", false, "show the scheduled task")
+	remove := fs.Bool("remove", false, "remove the scheduled task")
+	printScript := fs.Bool("print-script", false, "print the script of the task without scheduling it")
+	fs.Parse(args)
+	exitInvalid(settingsError())
+
+	binary, err := os.Executable()
+	if err != nil {
+		exitFailed(err)
+	}
+	if *printScript {
+		fmt.Print(scheduledTaskScript(binary))
+		return
+	}
+	hour, minute, err := parseTaskTime(*at)
+	if err != nil {
+		exitFailed(err)
+	}
+	if err := checkTaskScheduler(); err != nil {
+		exitFailed(err)
+	}
+	t, err := findScheduledTask()
+	if err != nil {
+		exitFailed(err)
+	}
+
+	switch {
+	case *show:
+		if t == nil {
+			exitFailed(fmt.Errorf("no scheduled task named %s", scheduledTaskName))
+		}
+		for _, l := range t.lines {
+			fmt.Println(l)
+		}
+		return
+	case *remove:
+		if t == nil {
+			logNotice("No scheduled task named", scheduledTaskName)
+			return
+		}
+		if err := deleteScheduledTask(t, t.fields["Owner"]); err != nil {
+			exitFailed(err)
+		}
+		logNotice("Scheduled task removed: ", scheduledTaskName)
+		return
+	}
+
+	if t != nil {
+		logInfo("Replacing the scheduled task: ", scheduledTaskName)
+		if err := deleteScheduledTask(t, t.fields["Owner"]); err != nil {
+			exitFailed(err)
+		}
+	}
+	if err := createScheduledTask(scheduledTaskScript(binary), hour, minute, *user); err != nil {
+		exitFailed(err)
+	}
+	logNotice("Scheduled task", scheduledTaskName, "runs daily at", *at, "as", *user)
+}
+
+// runMirror keeps a copy of every build and serves it on the LAN
+func runMirror(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "mirror", "")
+	dirFlag(fs, cfg)
+	downloadFlags(fs, cfg)
+	listen := fs.String("listen", ":8080", "address to serve the mirror on")
+	interval := fs.Duration("interval", getenvDuration("INTERVAL", 6*time.Hour), "time between refreshes of the mirror (env INTERVAL)")
+	fs.Parse(args)
+	exitInvalid(cfg.Validate())
+	if *interval <= 0 {
+		exitFailed(fmt.Errorf("invalid interval: %s", *interval))
+	}
+
+	if err := serveMirror(cfg, *listen, *interval); err != nil {
+		exitFailed(err)
+	}
+}
+
+// runAPIProxy serves the downloads JSON from a cache refreshed at most every ttl
+func runAPIProxy(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "api-proxy", "")
+	listen := fs.String("listen", "127.0.0.1:8081", "address to serve the downloads JSON on")
+	ttl := fs.Duration("ttl", getenvDuration("API_CACHE_TTL", time.Hour), "time the cached downloads JSON is served before it is fetched again (env API_CACHE_TTL)")
+	fs.Parse(args)
+	exitInvalid(cfg.Validate())
+
+	logInfo("Serving the downloads JSON on", *listen+", cached in", apiCachePath(cfg.StateDir))
+	if err := http.ListenAndServe(*listen, &apiProxy{cfg: cfg, ttl: *ttl}); err != nil {
+		exitFailed(err)
+	}
+}
+
+// runCompletion prints the completion script of a shell
+func runCompletion(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "completion", "<bash|zsh|fish>")
+	fs.Parse(args)
+	exitInvalid(settingsError())
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitError)
+	}
+
+	if err := writeCompletion(os.Stdout, fs.Arg(0)); err != nil {
+		exitFailed(err)
+	}
+}
+
+// runDoctor runs the preflight diagnostics, exiting with an error when a critical one fails
+func runDoctor(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "doctor", "")
+	buildTypeFlag(fs, cfg)
+	dirFlag(fs, cfg)
+	fs.Parse(args)
+	exitInvalid(settingsError())
+
+	if !runDoctorChecks(os.Stdout, doctorChecks(cfg)) {
+		os.Exit(exitError)
+	}
+}
+
+// runClean removes the old packages and the partial and temporary files created by the updater
+func runClean(cfg *Config, args []string) {
+	var dryRun bool
+	fs := newCommandFlagSet(cfg, "clean", "")
+	dirFlag(fs, cfg)
+	dryRunFlag(fs, &dryRun)
+	keep := fs.Int("keep", 2, "number of the newest packages to keep")
+	olderThan := fs.String("older-than", "0", "only remove packages downloaded longer ago than this, e.g. 30d")
+	fs.Parse(args)
+	cfg.DryRun = dryRun
+	exitInvalid(cfg.Validate())
+
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		exitFailed(err)
+	}
+	protected := map[string]bool{}
+	s, err := loadState(cfg.StateDir)
+	if err != nil {
+		exitFailed(err)
+	}
+	if s.PendingInstall != nil {
+		protected[s.PendingInstall.File] = true
+	}
+	if installed, err := getInstalledVersion(cfg); err == nil {
+		pkgs, err := listArchivedPackages(cfg.Dir)
+		if err != nil {
+			exitFailed(err)
+		}
+		for _, p := range pkgs {
+			if coreVersion(p.version) == coreVersion(installed) {
+				protected[p.file] = true
+			}
+		}
+	}
+
+	items, err := cleanCandidates(cfg, *keep, age, protected)
+	if err != nil {
+		exitFailed(err)
+	}
+	var reclaimed int64
+	for _, i := range items {
+		if dryRun {
+			logInfo("[dry-run] Would remove", i.reason+":", i.file)
+		} else {
+			if err := os.Remove(i.file); err != nil {
+				exitFailed(err)
+			}
+			logInfo("Removed", i.reason+":", i.file)
+		}
+		reclaimed += i.size
+	}
+	if dryRun {
+		logNotice("[dry-run] Would reclaim", formatBytes(reclaimed))
+		return
+	}
+	logNotice("Reclaimed", formatBytes(reclaimed))
+}
+
+// runHistory prints the updates performed by the updater
+func runHistory(cfg *Config, args []string) {
+	fs := newCommandFlagSet(cfg, "history", "")
+	limit := fs.Int("limit", 0, "only show the last N updates")
+	asJSON := fs.Bool("json", false, "print the history as JSON")
+	fs.Parse(args)
+	exitInvalid(settingsError())
+
+	records, err := readHistory(cfg.StateDir)
+	if err != nil {
+		exitFailed(err)
+	}
+	if *limit > 0 && len(records) > *limit {
+		records = records[len(records)-*limit:]
+	}
+
+	if *asJSON {
+		if records == nil {
+			records = []historyRecord{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(records); err != nil {
+			exitFailed(err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tFROM\tTO\tDURATION\tCHECKSUM\tRESULT")
+	for _, r := range records {
+		d := time.Duration(r.Duration * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Local().Format(time.RFC3339), r.FromVersion, r.ToVersion, d, r.Checksum, r.Result)
+	}
+	w.Flush()
+}
+
+// runApprove approves the install of a version for runs with --require-approval
+func runApprove(cfg *Config, args []string) {
+	v := versionArg(cfg, "approve", args)
+
+	s, err := loadState(cfg.StateDir)
+	if err != nil {
+		exitFailed(err)
+	}
+	if s.Approval == nil || coreVersion(s.Approval.Version) != coreVersion(v) {
+		logInfo("No pending approval for version", coreVersion(v)+", approving it in advance")
+		s.Approval = &approval{Version: v}
+	}
+	s.Approval.Approved = time.Now().UTC()
+	if err := s.save(); err != nil {
+		exitFailed(err)
+	}
+	logNotice("Version approved: ", coreVersion(v))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClosestCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"chek", "check"},
+		{"CHECK", "check"},
+		{"instal", "install"},
+		{"dowload", "download"},
+		{"stauts", "status"},
+		{"rollbak", "rollback"},
+		{"selfupdate", "self-update"},
+		{"list-build", "list-builds"},
+		{"skip", ""},
+		{"up", ""},
+		{"x", ""},
+		{"upgrade", ""},
+	} {
+		if got := closestCommand(tc.name); got != tc.want {
+			t.Errorf("closestCommand(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestChangelogSummary(t *testing.T) {
+	p, err := decodePlexInfo(readFixture(t, "downloads.json"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, fixed := changelogItems(p.platform.ItemsAdded), changelogItems(p.platform.ItemsFixed)
+	for _, tc := range []struct {
+		name  string
+		added []string
+		fixed []string
+		n     int
+		want  string
+	}{
+		{"truncated", added, fixed, 2, "Added: (Music) Sonic adventures are generated for albums with enough listening history (#14671); " +
+			"(Transcoder) HEVC encoding is available on supported Intel GPUs (#14520) (+5 more). " +
+			"Fixed: (Transcoder) Subtitles burned in at the wrong size on 4K sources (#14660); " +
+			"(Scanner) TV shows with absolute episode numbering were split in two seasons (#14611) (+1 more)"},
+		{"exactly n", added[:1], fixed[:1], 1, "Added: (Music) Sonic adventures are generated for albums with enough listening history (#14671). " +
+			"Fixed: (Transcoder) Subtitles burned in at the wrong size on 4K sources (#14660)"},
+		{"no items fixed", added[:2], nil, 5, "Added: (Music) Sonic adventures are generated for albums with enough listening history (#14671); " +
+			"(Transcoder) HEVC encoding is available on supported Intel GPUs (#14520)"},
+		{"none", added, fixed, 0, ""},
+		{"empty changelog", nil, nil, 5, ""},
+	} {
+		if got := changelogSummary(tc.added, tc.fixed, tc.n); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	if got := changelogSummary(added, fixed, defaultChangelogItems); !strings.HasSuffix(got, "(+2 more). Fixed: "+strings.Join(fixed, "; ")) {
+		t.Errorf("default: got %q", got)
+	}
+}
+
+func TestChangelogItems(t *testing.T) {
+	// the DSM 6 section of the fixture has an empty changelog
+	p, err := decodePlexInfo(readFixture(t, "downloads.json"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := changelogItems(p.platform.ItemsAdded); len(items) != 0 {
+		t.Errorf("empty changelog: got %q", items)
+	}
+	if items := changelogItems("  one \r\n\n\ttwo\n"); strings.Join(items, "|") != "one|two" {
+		t.Errorf("got %q, want one and two", items)
+	}
+}
+
+func TestNotifyNewVersionChangelog(t *testing.T) {
+	p, err := decodePlexInfo(readFixture(t, "downloads.json"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := testConfig(t)
+	cfg.ChangelogItems = 1
+	c := updateCheck{latestVersion: p.platform.Version, added: changelogItems(p.platform.ItemsAdded)}
+	s, err := loadState(cfg.StateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifyNewVersion(cfg, &s, c, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := "Synology Plex Updater detected a new version: 1.41.0.8992. Added: (Music) Sonic adventures are generated for albums with enough listening history (#14671) (+6 more)"
+	if !strings.Contains(b.String(), want) {
+		t.Errorf("notification %q, want %q", b.String(), want)
+	}
+	if !s.wasNotified(p.platform.Version) {
+		t.Error("version not marked as notified")
+	}
+
+	// the notification of an empty changelog ends with the version
+	b.Reset()
+	c = updateCheck{latestVersion: "1.41.1.9057-af5eaea7a"}
+	if err := notifyNewVersion(cfg, &s, c, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "detected a new version: 1.41.1.9057\"") {
+		t.Errorf("notification %q, want no changelog", b.String())
+	}
+}
+
+func TestRepairPackage(t *testing.T) {
+	const installed, rebuild = "1.40.0.7998-c29d4c0c8", "1.40.0.7998-0a1b2c3d4"
+	pkg := testPackage(t, testPackageInfo, []byte("payload"))
+	var downloads atomic.Int32
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	latest := installed
+	mux.HandleFunc("/5.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testDownloadsJSON(t, latest, release{
+			Build:    "linux-x86_64",
+			Distro:   defaultDistro,
+			URL:      srv.URL + "/" + testPackageName,
+			Checksum: fmt.Sprintf("%x", sha1.Sum(pkg)),
+		}))
+	})
+	mux.HandleFunc("/"+testPackageName, func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		servePackage(pkg).ServeHTTP(w, r)
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+	cfg := testConfig(t)
+	cfg.DownloadsURL = srv.URL + "/5.json"
+
+	// the installed build is the latest release, downloaded with its manifest
+	archived, err := repairPackage(cfg, installed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if downloads.Load() == 0 {
+		t.Fatal("latest release of the installed build not downloaded")
+	}
+
+	// another build of the installed version is not a repair, the archived package of the installed build is
+	latest = rebuild
+	downloads.Store(0)
+	f, err := repairPackage(cfg, installed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != archived || downloads.Load() != 0 {
+		t.Errorf("repaired with %s after %d downloads, want the archived %s", f, downloads.Load(), archived)
+	}
+	if _, err := repairPackage(cfg, "1.40.0.7998-ffffffff0", false); err == nil {
+		t.Error("repaired with a package of another build")
+	}
+	// a version reported without its hash is matched on its core version
+	if f, err := repairPackage(cfg, "1.40.0.7998", false); err != nil || f == "" {
+		t.Errorf("version without a hash: %q, %v", f, err)
+	}
+}
+
+func TestSameBuild(t *testing.T) {
+	for _, tc := range []struct {
+		installed, v string
+		want         bool
+	}{
+		{"1.40.0.7998-c29d4c0c8", "1.40.0.7998-c29d4c0c8", true},
+		{"1.40.0.7998-c29d4c0c8", "1.40.0.7998-C29D4C0C8", true},
+		{"1.40.0.7998-c29d4c0c8", "1.40.0.7998-0a1b2c3d4", false},
+		{"1.40.0.7998-c29d4c0c8", "1.40.0.7998", false},
+		{"1.40.0.7998", "1.40.0.7998-0a1b2c3d4", true},
+		{"1.40.0.7998", "1.41.0.8992-8463ad060", false},
+	} {
+		if got := sameBuild(tc.installed, tc.v); got != tc.want {
+			t.Errorf("sameBuild(%q, %q) = %v, want %v", tc.installed, tc.v, got, tc.want)
+		}
+	}
+}
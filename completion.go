@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The completion scripts list the flags of a command by parsing its -h output,
+// so they never get out of date with the flags of the binary they complete.
+
+const bashCompletion = `# bash completion for plex-updater
+_plex_updater() {
+    local cur prev cmd flags
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    case "$prev" in
+        -build-type|--build-type)
+            COMPREPLY=($(compgen -W "%[2]s" -- "$cur"))
+            return
+            ;;
+    esac
+    if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then
+        COMPREPLY=($(compgen -W "%[1]s" -- "$cur"))
+        return
+    fi
+    if [[ $cur == -* ]]; then
+        cmd=""
+        [[ ${COMP_WORDS[1]} != -* ]] && cmd="${COMP_WORDS[1]}"
+        flags=$("${COMP_WORDS[0]}" $cmd -h 2>&1 | sed -n 's/^  -\([^ ]*\).*/--\1/p')
+        COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+    fi
+}
+complete -o default -F _plex_updater plex-updater
+`
+
+const zshCompletion = `#compdef plex-updater
+_plex_updater() {
+    local -a cmds flags
+    cmds=(%[1]s)
+    if [[ $words[CURRENT-1] == (-|--)build-type ]]; then
+        compadd -- %[2]s
+        return
+    fi
+    if (( CURRENT == 2 )) && [[ $words[CURRENT] != -* ]]; then
+        _describe 'command' cmds
+        return
+    fi
+    if [[ $words[CURRENT] == -* ]]; then
+        local cmd=""
+        [[ $words[2] != -* ]] && cmd=$words[2]
+        flags=(${(f)"$($words[1] $cmd -h 2>&1 | sed -n 's/^  -\([^ ]*\).*/--\1/p')"})
+        compadd -- $flags
+        return
+    fi
+    _files
+}
+compdef _plex_updater plex-updater
+`
+
+const fishCompletion = `# fish completion for plex-updater
+function __plex_updater_flags
+    set -l words (commandline -opc)
+    set -l cmd
+    if test (count $words) -gt 1; and not string match -q -- '-*' $words[2]
+        set cmd $words[2]
+    end
+    $words[1] $cmd -h 2>&1 | string replace -rf '^  -(\S+).*' -- '--$1'
+end
+%[1]scomplete -c plex-updater -n 'string match -q -- "-*" (commandline -ct)' -f -a '(__plex_updater_flags)'
+complete -c plex-updater -l build-type -x -a '%[2]s'
+`
+
+// writeCompletion writes the completion script of a shell
+func writeCompletion(w io.Writer, shell string) error {
+	cmds := commands()
+	builds := strings.Join(append([]string{buildTypeAuto}, knownBuildTypes...), " ")
+	switch shell {
+	case "bash":
+		names := []string{}
+		for _, c := range cmds {
+			names = append(names, c.name)
+		}
+		fmt.Fprintf(w, bashCompletion, strings.Join(names, " "), builds)
+	case "zsh":
+		descs := []string{}
+		for _, c := range cmds {
+			descs = append(descs, fmt.Sprintf("%q", c.name+":"+c.summary))
+		}
+		fmt.Fprintf(w, zshCompletion, strings.Join(descs, " "), builds)
+	case "fish":
+		var b strings.Builder
+		for _, c := range cmds {
+			fmt.Fprintf(&b, "complete -c plex-updater -n __fish_use_subcommand -f -a %s -d %s\n", c.name, shellQuote(c.summary))
+		}
+		fmt.Fprintf(w, fishCompletion, b.String(), builds)
+	default:
+		return fmt.Errorf("unsupported shell %q, expected bash, zsh or fish", shell)
+	}
+	return nil
+}
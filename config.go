@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// Config holds the settings shared by the commands, built once at startup from the
+// environment and the config file, the flags of a command then override them
+type Config struct {
+	Synopkg     string
+	Synonotify  string
+	PackageName string
+	AutoPackage bool
+	// NoSynology stands in for synopkg and synonotify, to run the updater off a NAS
+	NoSynology bool
+	// DryRun leaves the download directory untouched when validating, for the dry runs and the checks
+	DryRun       bool
+	DownloadsURL string
+	FallbackURLs []string
+	// APICacheMaxAge is the age past which the cached downloads JSON is no longer used
+	APICacheMaxAge time.Duration
+	StateDir       string
+	BuildType      string
+	Distro         string
+	Dir            string
+	HTTPTimeout    time.Duration
+	StallTimeout   time.Duration
+	// DSMVersion is the major version of DSM selecting the releases of the downloads JSON, detected when 0
+	DSMVersion int
+	// IgnoreMinDSM installs the packages requiring a newer DSM than the one of the NAS
+	IgnoreMinDSM bool
+	// UpdateOnRebuild installs a latest version of the same core version as the installed one, but of another build
+	UpdateOnRebuild bool
+	// SaveResponses saves the downloads JSON responses to the state directory, those failing to decode
+	// with true, all of them with always
+	SaveResponses string
+	// Channel is the release channel of the downloads JSON, public or plexpass with the PlexToken of a subscriber,
+	// or auto for the one of the settings of the server
+	Channel   string
+	PlexToken string
+	// BlocklistURL serves the JSON array of the version constraints never installed, BlocklistNotify
+	// sends a notification of a blocked version
+	BlocklistURL    string
+	BlocklistNotify bool
+	// ChangelogItems is the number of items of each changelog section in the notifications and the logs
+	ChangelogItems int
+	// IdentityCheck compares the version of the running server, answered on PlexPort, with the one of synopkg
+	IdentityCheck   bool
+	PlexPort        int
+	IdentityTimeout time.Duration
+	// RunTimeout bounds an update run, unlimited when 0
+	RunTimeout time.Duration
+	// RetryAttempts is the number of attempts of a request, RetryDelay the delay before the first retry
+	RetryAttempts int
+	RetryDelay    time.Duration
+	// RetryAfterMax caps the Retry-After delay of a rate limited request
+	RetryAfterMax time.Duration
+	// MaxDownloadRate limits the rate of the package downloads, e.g. 5MB/s, unlimited when empty
+	MaxDownloadRate string
+	// MaxPackageSize is the largest package downloaded
+	MaxPackageSize int64
+	// Segments is the number of concurrent range requests of a package download
+	Segments int
+	// DownloadBackend downloads the packages, builtin or download-station, falling back to the
+	// builtin downloader with DSFallback when Download Station fails
+	DownloadBackend string
+	DSFallback      bool
+	// DSURL is the DSM Web API of Download Station, used as DSAccount to download to the DSDestination shared folder
+	DSURL         string
+	DSAccount     string
+	DSPassword    string
+	DSDestination string
+	// ReleaseHosts are the hosts the packages may be downloaded from
+	ReleaseHosts []string
+	// PackageMirrors serve the packages by file name, tried before the URL of a release
+	PackageMirrors []string
+	// ProxyURL replaces the proxy of the environment, http, https or socks5 with credentials
+	ProxyURL string
+	// CABundle replaces the system certificate authorities, ExtraCACerts adds to them
+	CABundle     string
+	ExtraCACerts string
+	// DNSServers resolve the hosts of the requests instead of the system resolver
+	DNSServers []string
+	// IPPreference forces the IP family of the connections: v4, v6 or auto
+	IPPreference string
+	// UserAgent replaces the User-Agent of the requests
+	UserAgent string
+
+	stubSynology  *stubSynology
+	httpTransport *http.Transport
+	proxyLogged   sync.Once
+	// userAgentOnce reads the versions of the User-Agent, agentVersion and agentDSM
+	userAgentOnce  sync.Once
+	agentVersion   string
+	agentDSM       string
+	rootCAs        *x509.CertPool
+	ctx            context.Context
+	packageStopped atomic.Bool
+}
+
+// newConfig returns the configuration of the environment and the config file
+func newConfig() *Config {
+	return &Config{
+		Synopkg:         getenv("SYNOPKG_PATH", SYNPKG),
+		Synonotify:      getenv("SYNONOTIFY_PATH", existingPath(SYNOTIFY, SYNOTIFY6)),
+		DSMVersion:      getenvInt("DSM_VERSION", 0),
+		NoSynology:      getenvBool("NO_SYNOLOGY", false),
+		PackageName:     getenv("PACKAGE_NAME", defaultPackageName),
+		DownloadsURL:    getenv("PLEX_DOWNLOADS_URL", SYNURL),
+		FallbackURLs:    splitList(getenv("PLEX_DOWNLOADS_FALLBACK_URLS", "")),
+		APICacheMaxAge:  getenvDuration("API_CACHE_MAX_AGE", defaultAPICacheMaxAge),
+		UpdateOnRebuild: getenvBool("UPDATE_ON_REBUILD", false),
+		IgnoreMinDSM:    getenvBool("IGNORE_OS_MIN_VER", false),
+		SaveResponses:   getenv("DEBUG_SAVE_RESPONSES", saveResponsesOff),
+		Channel:         getenv("CHANNEL", channelPublic),
+		PlexToken:       getenv("PLEX_TOKEN", ""),
+		BlocklistURL:    getenv("BLOCKLIST_URL", ""),
+		BlocklistNotify: getenvBool("BLOCKLIST_NOTIFY", false),
+		ChangelogItems:  getenvInt("CHANGELOG_ITEMS", defaultChangelogItems),
+		IdentityCheck:   getenvBool("IDENTITY_CHECK", false),
+		PlexPort:        getenvInt("PLEX_PORT", defaultPlexPort),
+		IdentityTimeout: getenvDuration("IDENTITY_TIMEOUT", defaultIdentityTimeout),
+		StateDir:        getenv("STATE_DIR", defaultStateDir),
+		BuildType:       getenv("BUILD_TYPE", buildTypeAuto),
+		Distro:          getenv("DISTRO", defaultDistro),
+		Dir:             getenv("DOWNLOAD_DIR", ""),
+		HTTPTimeout:     getenvDuration("HTTP_TIMEOUT", defaultHTTPTimeout),
+		StallTimeout:    getenvDuration("DOWNLOAD_STALL_TIMEOUT", defaultDownloadStallTimeout),
+		RunTimeout:      getenvDuration("RUN_TIMEOUT", 0),
+		RetryAttempts:   getenvInt("RETRY_ATTEMPTS", defaultRetryAttempts),
+		RetryDelay:      getenvDuration("RETRY_DELAY", defaultRetryDelay),
+		RetryAfterMax:   getenvDuration("RETRY_AFTER_MAX", defaultRetryAfterMax),
+		MaxDownloadRate: getenv("MAX_DOWNLOAD_RATE", ""),
+		MaxPackageSize:  getenvSize("MAX_PACKAGE_SIZE", defaultMaxPackageSize),
+		Segments:        getenvInt("DOWNLOAD_SEGMENTS", 1),
+		DownloadBackend: getenv("DOWNLOAD_BACKEND", backendBuiltin),
+		DSFallback:      getenvBool("DS_FALLBACK", false),
+		DSURL:           getenv("DS_URL", defaultDSURL),
+		DSAccount:       getenv("DS_ACCOUNT", ""),
+		DSPassword:      getenv("DS_PASSWORD", ""),
+		DSDestination:   getenv("DS_DESTINATION", ""),
+		ReleaseHosts:    splitList(getenv("RELEASE_HOSTS", defaultReleaseHosts)),
+		PackageMirrors:  splitList(getenv("PACKAGE_MIRRORS", "")),
+		ProxyURL:        getenv("PROXY_URL", ""),
+		CABundle:        getenv("CA_BUNDLE", ""),
+		ExtraCACerts:    getenv("EXTRA_CA_CERTS", ""),
+		DNSServers:      splitList(getenv("DNS_SERVERS", "")),
+		IPPreference:    getenv("IP_PREFERENCE", ipAuto),
+		UserAgent:       getenv("USER_AGENT", ""),
+	}
+}
+
+// Validate returns every problem of the configuration joined in a single error, starting with the
+// settings that failed to parse, after picking the download directory when none was given
+func (c *Config) Validate() error {
+	errs := append([]error{}, invalidSettings...)
+	if !c.NoSynology {
+		for _, b := range [][2]string{{"synopkg", c.Synopkg}, {"synonotify", c.Synonotify}} {
+			if _, err := checkExecutable(b[1]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w, set %s_PATH or use --no-synology off a NAS", b[0], err, strings.ToUpper(b[0])))
+			}
+		}
+	}
+	if err := c.resolveDownloadDir(); err != nil {
+		errs = append(errs, fmt.Errorf("download directory: %w", err))
+	}
+	// the build type is checked before any request
+	if err := c.resolveBuildType(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, d := range c.downloadsURLs() {
+		if u, err := url.Parse(d); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid downloads URL %q, expected an http or https URL", d))
+		}
+	}
+	if len(c.ReleaseHosts) == 0 {
+		errs = append(errs, errors.New("RELEASE_HOSTS must allow at least one host"))
+	}
+	if c.BlocklistURL != "" {
+		if u, err := url.Parse(c.BlocklistURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid BLOCKLIST_URL %q, expected an http or https URL", c.BlocklistURL))
+		}
+	}
+	for _, m := range c.PackageMirrors {
+		if u, err := url.Parse(m); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid package mirror %q, expected an http or https URL", m))
+		}
+	}
+	if c.APICacheMaxAge <= 0 {
+		errs = append(errs, fmt.Errorf("invalid maximum age of the cached downloads JSON: %s", c.APICacheMaxAge))
+	}
+	if c.HTTPTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("invalid HTTP timeout: %s", c.HTTPTimeout))
+	}
+	if c.StallTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("invalid download stall timeout: %s", c.StallTimeout))
+	}
+	if c.RunTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid run timeout: %s", c.RunTimeout))
+	}
+	if c.ChangelogItems < 0 {
+		errs = append(errs, fmt.Errorf("invalid number of changelog items %d, expected 0 or more", c.ChangelogItems))
+	}
+	if c.PlexPort < 1 || c.PlexPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid PLEX_PORT %d", c.PlexPort))
+	}
+	if c.IdentityTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("invalid identity timeout: %s", c.IdentityTimeout))
+	}
+	if c.RetryAttempts < 1 {
+		errs = append(errs, fmt.Errorf("invalid number of retry attempts %d, expected at least 1", c.RetryAttempts))
+	}
+	if c.RetryDelay < 0 {
+		errs = append(errs, fmt.Errorf("invalid retry delay: %s", c.RetryDelay))
+	}
+	switch c.DownloadBackend {
+	case backendBuiltin:
+	case backendDownloadStation:
+		if c.DSAccount == "" || c.DSPassword == "" || c.DSDestination == "" {
+			errs = append(errs, errors.New("the download-station backend needs DS_ACCOUNT, DS_PASSWORD and DS_DESTINATION"))
+		}
+		if u, err := url.Parse(c.DSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid DS_URL %q, expected an http or https URL", c.DSURL))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown download backend %q, expected %s or %s", c.DownloadBackend, backendBuiltin, backendDownloadStation))
+	}
+	if c.MaxPackageSize <= 0 {
+		errs = append(errs, fmt.Errorf("invalid maximum package size: %d", c.MaxPackageSize))
+	}
+	if c.RetryAfterMax < 0 {
+		errs = append(errs, fmt.Errorf("invalid maximum Retry-After delay: %s", c.RetryAfterMax))
+	}
+	if c.Segments < 1 || c.Segments > maxSegments {
+		errs = append(errs, fmt.Errorf("invalid number of download segments %d, expected 1 to %d", c.Segments, maxSegments))
+	}
+	if c.MaxDownloadRate != "" {
+		if _, err := parseRate(c.MaxDownloadRate); err != nil {
+			errs = append(errs, fmt.Errorf("MAX_DOWNLOAD_RATE: %w", err))
+		}
+	}
+	if c.ProxyURL != "" {
+		if u, err := url.Parse(c.ProxyURL); err != nil || u.Host == "" || !validProxyScheme(u.Scheme) {
+			errs = append(errs, errors.New("invalid proxy URL, expected http, https, socks5 or socks5h://[user:password@]host:port"))
+		}
+	}
+	for _, s := range c.DNSServers {
+		if host, _, err := net.SplitHostPort(dnsServerAddr(s)); err != nil || net.ParseIP(host) == nil {
+			errs = append(errs, fmt.Errorf("invalid DNS server %q, expected an IP address", s))
+		}
+	}
+	if c.DSMVersion != 0 && c.DSMVersion < 6 {
+		errs = append(errs, fmt.Errorf("DSM_VERSION: DSM %d is not supported, expected 6 or 7", c.DSMVersion))
+	}
+	switch c.SaveResponses {
+	case saveResponsesOff, saveResponsesOnError, saveResponsesAlways:
+	default:
+		errs = append(errs, fmt.Errorf("DEBUG_SAVE_RESPONSES: invalid value %q, expected false, true or always", c.SaveResponses))
+	}
+	c.resolveChannel()
+	switch c.Channel {
+	case channelPublic:
+	case channelPlexPass:
+		if err := c.resolvePlexToken(); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("CHANNEL: invalid value %q, expected public, plexpass or auto", c.Channel))
+	}
+	switch c.IPPreference {
+	case ipAuto, ipV4, ipV6:
+	default:
+		errs = append(errs, fmt.Errorf("invalid IP preference %q, expected v4, v6 or auto", c.IPPreference))
+	}
+	// the state directory is created on first use
+	if fi, err := os.Stat(c.StateDir); err == nil && !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("state directory: %s is not a directory", c.StateDir))
+	}
+	return errors.Join(errs...)
+}
+
+// dsmMajor returns the major version of DSM, detected once from the DSM version file unless set with
+// DSM_VERSION, and 7 when unknown, e.g. off a NAS
+func (c *Config) dsmMajor() int {
+	if c.DSMVersion != 0 {
+		return c.DSMVersion
+	}
+	c.DSMVersion = 7
+	if major, err := dsmMajorVersion(); err != nil {
+		logDebug("Unable to detect the DSM version, using the DSM 7 releases: ", err)
+	} else {
+		c.DSMVersion = major
+		logDebug("DSM version detected: ", major)
+	}
+	return c.DSMVersion
+}
+
+// existingPath returns the first of the paths of a tool that exists, or else the first one, as the tools
+// moved between DSM 6 and 7
+func existingPath(paths ...string) string {
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return paths[0]
+}
+
+// resolveBuildType detects the build type when auto, or else checks it is a known one, whatever its case
+func (c *Config) resolveBuildType() error {
+	if strings.EqualFold(c.BuildType, buildTypeAuto) {
+		b, err := detectBuildType()
+		if err != nil {
+			return err
+		}
+		c.BuildType = b
+		return nil
+	}
+	b, ok := matchBuildType(c.BuildType, knownBuildTypes)
+	if !ok {
+		if b, ok = buildTypeAliases[strings.ToLower(c.BuildType)]; !ok {
+			return &buildTypeError{buildType: c.BuildType, available: knownBuildTypes, suggestion: closestBuildType(c.BuildType, knownBuildTypes)}
+		}
+		logInfo(fmt.Sprintf("Build type %s is an alias of %s", c.BuildType, b))
+	}
+	c.BuildType = b
+	return nil
+}
+
+// downloadDirCandidates returns the download directories tried when none was given, with why each one is
+func (c *Config) downloadDirCandidates() [][2]string {
+	candidates := [][2]string{}
+	if volume, err := c.packageVolume(); err != nil {
+		logDebug("Unable to find the volume of the package: ", err)
+	} else {
+		candidates = append(candidates, [2]string{filepath.Join(volume, "@synology-plex-updater"), "on " + volume + ", where " + c.PackageName + " is installed"})
+	}
+	return append(candidates, [2]string{filepath.Join(os.TempDir(), "synology-plex-updater"), "in " + os.TempDir() + ", no volume of PlexMediaServer is usable"})
+}
+
+// resolveDownloadDir picks the first usable download directory of the cascade when none was given
+// and creates it when missing. A dry run only logs the directory it would use.
+func (c *Config) resolveDownloadDir() error {
+	if c.Dir != "" && c.DryRun {
+		logInfo("[dry-run] Would download to", c.Dir+", set with --dir or DOWNLOAD_DIR")
+		return nil
+	}
+	if c.Dir != "" {
+		if err := os.MkdirAll(c.Dir, 0750); err != nil {
+			return err
+		}
+		logInfo("Downloading to", c.Dir+", set with --dir or DOWNLOAD_DIR")
+		return checkWritableDir(c.Dir)
+	}
+	var errs []error
+	for _, candidate := range c.downloadDirCandidates() {
+		dir, reason := candidate[0], candidate[1]
+		if c.DryRun {
+			c.Dir = dir
+			logInfo("[dry-run] Would download to", dir+",", reason)
+			return nil
+		}
+		err := os.MkdirAll(dir, 0750)
+		if err == nil {
+			err = checkWritableDir(dir)
+		}
+		if err != nil {
+			logDebug("Unable to download to", dir+": ", err)
+			errs = append(errs, err)
+			continue
+		}
+		c.Dir = dir
+		logInfo("Downloading to", dir+",", reason)
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// validProxyScheme reports whether the transport supports proxies of a scheme
+func validProxyScheme(s string) bool {
+	switch s {
+	case "http", "https", "socks5", "socks5h":
+		return true
+	}
+	return false
+}
+
+// downloadsURLs returns the URL of the downloads JSON followed by its fallbacks, in the order they are tried
+func (c *Config) downloadsURLs() []string {
+	urls := append([]string{c.DownloadsURL}, c.FallbackURLs...)
+	if c.Channel != channelPlexPass {
+		return urls
+	}
+	for i, u := range urls {
+		urls[i] = withChannel(u, c.Channel)
+	}
+	return urls
+}
+
+// splitList splits a comma separated list, dropping the empty items
+func splitList(s string) []string {
+	items := []string{}
+	for _, i := range strings.Split(s, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			items = append(items, i)
+		}
+	}
+	return items
+}
+
+// checkWritableDir returns an error when a directory does not exist or cannot be written to
+func checkWritableDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".writable-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// settingsError returns the settings that failed to parse joined in a single error, for the subcommands
+// not validating the whole configuration
+func settingsError() error {
+	return errors.Join(invalidSettings...)
+}
+
+// exitInvalid exits listing every validation error of err, when there is any
+func exitInvalid(err error) {
+	if err == nil {
+		return
+	}
+	for _, e := range strings.Split(err.Error(), "\n") {
+		logError(e)
+	}
+	os.Exit(errorExitCode(err))
+}
+
+// errorExitCode returns the exit code of a run failing with err
+func errorExitCode(err error) int {
+	var be *buildTypeError
+	switch {
+	case errors.As(err, &be):
+		return exitUnknownBuildType
+	case errors.Is(err, errNotInstalled):
+		return exitNotInstalled
+	}
+	return exitError
+}
+
+// exitFailed logs the error of a failed command and exits with its exit code
+func exitFailed(err error) {
+	logError(err)
+	os.Exit(errorExitCode(err))
+}
+
+// setting sources
+const (
+	sourceDefault = "default"
+	sourceEnv     = "env"
+	sourceFile    = "file"
+	sourceFlag    = "flag"
+)
+
+// flagEnv maps flags to the environment variables providing their defaults
+var flagEnv = map[string]string{
+	"build-type":         "BUILD_TYPE",
+	"distro":             "DISTRO",
+	"dry-run":            "DRY_RUN",
+	"force":              "FORCE",
+	"allow-downgrade":    "ALLOW_DOWNGRADE",
+	"yes":                "ASSUME_YES",
+	"daemon":             "DAEMON",
+	"interval":           "INTERVAL",
+	"schedule":           "SCHEDULE",
+	"install-window":     "INSTALL_WINDOW",
+	"min-release-age":    "MIN_RELEASE_AGE",
+	"min-check-interval": "MIN_CHECK_INTERVAL",
+	"update-on-rebuild":  "UPDATE_ON_REBUILD",
+	"install-if-missing": "INSTALL_IF_MISSING",
+	"ignore-os-min-ver":  "IGNORE_OS_MIN_VER",
+	"notify-only":        "MODE",
+	"require-approval":   "REQUIRE_APPROVAL",
+	"approval-file":      "APPROVAL_FILE",
+	"target-version":     "TARGET_VERSION",
+	"dir":                "DOWNLOAD_DIR",
+	"package-name":       "PACKAGE_NAME",
+	"no-synology":        "NO_SYNOLOGY",
+	"keep-packages":      "KEEP_PACKAGES",
+	"segments":           "DOWNLOAD_SEGMENTS",
+	"download-backend":   "DOWNLOAD_BACKEND",
+	"ds-fallback":        "DS_FALLBACK",
+	"updater-check":      "UPDATER_CHECK",
+}
+
+// isSecret reports whether a setting holds a secret that must not be printed
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"token", "password", "secret"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskSecret hides a secret entirely, telling neither its characters nor its length
+func maskSecret(v string) string {
+	return "********"
+}
+
+// resolveEffective resolves the download directory, the build type and the channel as Validate does,
+// without creating the download directory
+func (c *Config) resolveEffective() {
+	dryRun := c.DryRun
+	c.DryRun = true
+	if err := c.resolveDownloadDir(); err != nil {
+		logDebug("Unable to pick the download directory: ", err)
+	}
+	c.DryRun = dryRun
+	if err := c.resolveBuildType(); err != nil {
+		logDebug("Unable to resolve the build type: ", err)
+	}
+	c.resolveChannel()
+}
+
+// printConfig prints the effective value of every setting of a flag set and where it came from, once
+// the values resolved at startup are
+func printConfig(w io.Writer, cfg *Config, fs *flag.FlagSet) {
+	cfg.resolveEffective()
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "print-config" || f.Name == "version" || f.Name == "quiet" || f.Name == "debug" {
+			return
+		}
+		source := sourceDefault
+		name := f.Name
+		if env, ok := flagEnv[f.Name]; ok {
+			name += " (" + env + ")"
+			source = settingSource(env)
+		}
+		if set[f.Name] {
+			source = sourceFlag
+		}
+		value := f.Value.String()
+		if isSecret(f.Name) && value != "" {
+			value = maskSecret(value)
+		}
+		value = redact(value)
+		fmt.Fprintf(tw, "%s\t%q\t%s\n", name, value, source)
+	})
+	for _, c := range [][3]string{
+		{"synopkg", "SYNOPKG_PATH", cfg.Synopkg},
+		{"synonotify", "SYNONOTIFY_PATH", cfg.Synonotify},
+		{"state-dir", "STATE_DIR", cfg.StateDir},
+		{"api-url", "PLEX_DOWNLOADS_URL", cfg.DownloadsURL},
+		{"api-fallback-urls", "PLEX_DOWNLOADS_FALLBACK_URLS", strings.Join(cfg.FallbackURLs, ",")},
+		{"api-cache-max-age", "API_CACHE_MAX_AGE", cfg.APICacheMaxAge.String()},
+		{"debug-save-responses", "DEBUG_SAVE_RESPONSES", cfg.SaveResponses},
+		{"channel", "CHANNEL", cfg.Channel},
+		{"plex-token", "PLEX_TOKEN", cfg.PlexToken},
+		{"blocklist-url", "BLOCKLIST_URL", cfg.BlocklistURL},
+		{"blocklist-notify", "BLOCKLIST_NOTIFY", strconv.FormatBool(cfg.BlocklistNotify)},
+		{"changelog-items", "CHANGELOG_ITEMS", strconv.Itoa(cfg.ChangelogItems)},
+		{"identity-check", "IDENTITY_CHECK", strconv.FormatBool(cfg.IdentityCheck)},
+		{"plex-port", "PLEX_PORT", strconv.Itoa(cfg.PlexPort)},
+		{"identity-timeout", "IDENTITY_TIMEOUT", cfg.IdentityTimeout.String()},
+		{"http-timeout", "HTTP_TIMEOUT", cfg.HTTPTimeout.String()},
+		{"download-stall-timeout", "DOWNLOAD_STALL_TIMEOUT", cfg.StallTimeout.String()},
+		{"run-timeout", "RUN_TIMEOUT", cfg.RunTimeout.String()},
+		{"retry-attempts", "RETRY_ATTEMPTS", strconv.Itoa(cfg.RetryAttempts)},
+		{"retry-delay", "RETRY_DELAY", cfg.RetryDelay.String()},
+		{"retry-after-max", "RETRY_AFTER_MAX", cfg.RetryAfterMax.String()},
+		{"max-download-rate", "MAX_DOWNLOAD_RATE", cfg.MaxDownloadRate},
+		{"release-hosts", "RELEASE_HOSTS", strings.Join(cfg.ReleaseHosts, ",")},
+		{"package-mirrors", "PACKAGE_MIRRORS", strings.Join(cfg.PackageMirrors, ",")},
+		{"max-package-size", "MAX_PACKAGE_SIZE", formatBytes(cfg.MaxPackageSize)},
+		{"ds-url", "DS_URL", cfg.DSURL},
+		{"ds-account", "DS_ACCOUNT", cfg.DSAccount},
+		{"ds-password", "DS_PASSWORD", cfg.DSPassword},
+		{"ds-destination", "DS_DESTINATION", cfg.DSDestination},
+		{"proxy-url", "PROXY_URL", cfg.ProxyURL},
+		{"ca-bundle", "CA_BUNDLE", cfg.CABundle},
+		{"extra-ca-certs", "EXTRA_CA_CERTS", cfg.ExtraCACerts},
+		{"dns-servers", "DNS_SERVERS", strings.Join(cfg.DNSServers, ",")},
+		{"ip-preference", "IP_PREFERENCE", cfg.IPPreference},
+		{"user-agent", "USER_AGENT", cfg.userAgent()},
+	} {
+		source := settingSource(c[1])
+		value := c[2]
+		if isSecret(c[1]) && value != "" {
+			value = maskSecret(value)
+		}
+		fmt.Fprintf(tw, "%s (%s)\t%q\t%s\n", c[0], c[1], redact(value), source)
+	}
+	source := settingSource("LOG_LEVEL")
+	if set["quiet"] || set["debug"] {
+		source = sourceFlag
+	}
+	fmt.Fprintf(tw, "log-level (LOG_LEVEL)\t%q\t%s\n", currentLogLevel, source)
+	for _, c := range [][2]string{
+		{"notification-tag", "PKGHasUpgrade"},
+		{"notification-template", "pkg_has_update"},
+	} {
+		fmt.Fprintf(tw, "%s\t%q\t%s\n", c[0], c[1], sourceDefault)
+	}
+	tw.Flush()
+}
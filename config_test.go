@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidSettings(t *testing.T) {
+	saved := invalidSettings
+	defer func() { invalidSettings = saved }()
+	invalidSettings = nil
+
+	for k, v := range map[string]string{
+		"DRY_RUN":          "maybe",
+		"INTERVAL":         "6",
+		"KEEP_PACKAGES":    "two",
+		"MAX_PACKAGE_SIZE": "huge",
+		"LOG_LEVEL":        "loud",
+	} {
+		t.Setenv(k, v)
+	}
+	// the fallbacks are used until the configuration is validated
+	if !getenvBool("DRY_RUN", true) {
+		t.Error("DRY_RUN: fallback not used")
+	}
+	if getenvDuration("INTERVAL", time.Hour) != time.Hour {
+		t.Error("INTERVAL: fallback not used")
+	}
+	if getenvInt("KEEP_PACKAGES", 3) != 3 {
+		t.Error("KEEP_PACKAGES: fallback not used")
+	}
+	if getenvSize("MAX_PACKAGE_SIZE", 1<<30) != 1<<30 {
+		t.Error("MAX_PACKAGE_SIZE: fallback not used")
+	}
+	if getenvLogLevel("LOG_LEVEL", levelWarn) != levelWarn {
+		t.Error("LOG_LEVEL: fallback not used")
+	}
+
+	wants := []string{
+		`invalid boolean value for DRY_RUN: "maybe"`,
+		`invalid duration value for INTERVAL: "6"`,
+		`invalid integer value for KEEP_PACKAGES: "two"`,
+		`invalid size value for MAX_PACKAGE_SIZE: "huge"`,
+		`invalid log level for LOG_LEVEL: "loud"`,
+	}
+	err := testConfig(t).Validate()
+	for _, want := range wants {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want %q", err, want)
+		}
+	}
+	// the subcommands not validating the whole configuration still report them
+	err = settingsError()
+	for _, want := range wants {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("settings error %v, want %q", err, want)
+		}
+	}
+
+	invalidSettings = nil
+	if err := settingsError(); err != nil {
+		t.Errorf("settings error %v once cleared", err)
+	}
+	err = testConfig(t).Validate()
+	for _, want := range wants {
+		if err != nil && strings.Contains(err.Error(), want) {
+			t.Errorf("%q reported once cleared", want)
+		}
+	}
+}
+
+func TestResolveDownloadDirDryRun(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DryRun = true
+	cfg.Dir = filepath.Join(t.TempDir(), "downloads")
+	if err := cfg.resolveDownloadDir(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cfg.Dir); !os.IsNotExist(err) {
+		t.Errorf("dry run created %s: %v", cfg.Dir, err)
+	}
+
+	// the directory of the cascade is picked without creating it
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	cfg.Dir = ""
+	if err := cfg.resolveDownloadDir(); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(tmp, "synology-plex-updater"); cfg.Dir != want {
+		t.Errorf("dry run picked %s, want %s", cfg.Dir, want)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("dry run wrote to %s: %v", tmp, entries)
+	}
+
+	cfg.DryRun = false
+	if err := cfg.resolveDownloadDir(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(cfg.Dir); len(entries) != 0 {
+		t.Errorf("probe left in %s: %v", cfg.Dir, entries)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultConfigFile = "/etc/plex-updater.yaml"
+
+// setting types of the config file
+const (
+	typeString   = "string"
+	typeBool     = "bool"
+	typeDuration = "duration"
+	typeInt      = "integer"
+	typeRate     = "rate"
+	typeSize     = "size"
+	typeLogLevel = "log level"
+)
+
+// configKeys are the settings of the config file, by environment variable, with their types
+var configKeys = map[string]string{
+	"BUILD_TYPE":                   typeString,
+	"DISTRO":                       typeString,
+	"DRY_RUN":                      typeBool,
+	"FORCE":                        typeBool,
+	"ALLOW_DOWNGRADE":              typeBool,
+	"UPDATE_ON_REBUILD":            typeBool,
+	"INSTALL_IF_MISSING":           typeBool,
+	"IGNORE_OS_MIN_VER":            typeBool,
+	"ASSUME_YES":                   typeBool,
+	"DAEMON":                       typeBool,
+	"INTERVAL":                     typeDuration,
+	"SCHEDULE":                     typeString,
+	"INSTALL_WINDOW":               typeString,
+	"MIN_RELEASE_AGE":              typeDuration,
+	"MIN_CHECK_INTERVAL":           typeDuration,
+	"MODE":                         typeString,
+	"REQUIRE_APPROVAL":             typeBool,
+	"APPROVAL_FILE":                typeString,
+	"TARGET_VERSION":               typeString,
+	"UPDATER_CHECK":                typeBool,
+	"STATE_DIR":                    typeString,
+	"PACKAGE_NAME":                 typeString,
+	"DSM_VERSION":                  typeInt,
+	"SYNOPKG_PATH":                 typeString,
+	"SYNONOTIFY_PATH":              typeString,
+	"NO_SYNOLOGY":                  typeBool,
+	"DOWNLOAD_DIR":                 typeString,
+	"KEEP_PACKAGE":                 typeBool,
+	"KEEP_PACKAGES":                typeInt,
+	"LOG_LEVEL":                    typeLogLevel,
+	"PLEX_DOWNLOADS_URL":           typeString,
+	"PLEX_DOWNLOADS_FALLBACK_URLS": typeString,
+	"API_CACHE_TTL":                typeDuration,
+	"API_CACHE_MAX_AGE":            typeDuration,
+	"DEBUG_SAVE_RESPONSES":         typeString,
+	"CHANNEL":                      typeString,
+	"PLEX_TOKEN":                   typeString,
+	"BLOCKLIST_URL":                typeString,
+	"BLOCKLIST_NOTIFY":             typeBool,
+	"CHANGELOG_ITEMS":              typeInt,
+	"IDENTITY_CHECK":               typeBool,
+	"PLEX_PORT":                    typeInt,
+	"IDENTITY_TIMEOUT":             typeDuration,
+	"HTTP_TIMEOUT":                 typeDuration,
+	"DOWNLOAD_STALL_TIMEOUT":       typeDuration,
+	"RUN_TIMEOUT":                  typeDuration,
+	"RETRY_ATTEMPTS":               typeInt,
+	"RETRY_DELAY":                  typeDuration,
+	"RETRY_AFTER_MAX":              typeDuration,
+	"MAX_DOWNLOAD_RATE":            typeRate,
+	"MAX_PACKAGE_SIZE":             typeSize,
+	"DOWNLOAD_SEGMENTS":            typeInt,
+	"RELEASE_HOSTS":                typeString,
+	"PACKAGE_MIRRORS":              typeString,
+	"DOWNLOAD_BACKEND":             typeString,
+	"DS_FALLBACK":                  typeBool,
+	"DS_URL":                       typeString,
+	"DS_ACCOUNT":                   typeString,
+	"DS_PASSWORD":                  typeString,
+	"DS_DESTINATION":               typeString,
+	"PROXY_URL":                    typeString,
+	"NO_PROXY":                     typeString,
+	"CA_BUNDLE":                    typeString,
+	"EXTRA_CA_CERTS":               typeString,
+	"DNS_SERVERS":                  typeString,
+	"IP_PREFERENCE":                typeString,
+	"USER_AGENT":                   typeString,
+}
+
+// configFile is the config file in use, configSettings holds its settings by environment variable
+var (
+	configFile     = defaultConfigFile
+	configSettings = map[string]string{}
+)
+
+// setting returns the value of a setting from the environment, or else from the config file
+func setting(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return configSettings[key]
+}
+
+// settingSource returns where the value of a setting comes from, ignoring flags
+func settingSource(key string) string {
+	switch {
+	case os.Getenv(key) != "":
+		return sourceEnv
+	case configSettings[key] != "":
+		return sourceFile
+	}
+	return sourceDefault
+}
+
+// flagArg returns the value of a flag in args, for the flags read before the flag sets are parsed
+func flagArg(args []string, flagName string) (string, bool) {
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if !strings.HasPrefix(a, "-") || name != flagName {
+			continue
+		}
+		if hasValue {
+			return value, true
+		}
+		if i+1 < len(args) {
+			return args[i+1], true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// configFlag registers the config file flag, which is read before the other flags
+func configFlag(fs *flag.FlagSet) {
+	fs.String("config", configFile, "config file of key: value settings, overridden by the environment and the flags")
+}
+
+// configFileKey returns the environment variable of a config file key, either the
+// environment variable itself, the flag name or its snake case
+func configFileKey(k string) string {
+	if env, ok := flagEnv[k]; ok {
+		return env
+	}
+	return strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+}
+
+// validateSetting checks the value of a setting against its type
+func validateSetting(key, value string) error {
+	var err error
+	switch configKeys[key] {
+	case typeBool:
+		_, err = strconv.ParseBool(value)
+	case typeDuration:
+		_, err = time.ParseDuration(value)
+	case typeInt:
+		_, err = strconv.Atoi(value)
+	case typeRate:
+		_, err = parseRate(value)
+	case typeSize:
+		_, err = parseSize(value)
+	case typeLogLevel:
+		_, err = parseLogLevel(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s", configKeys[key])
+	}
+	return nil
+}
+
+// unquote removes the quotes around a value, or a trailing comment from an unquoted one
+func unquote(v string) (string, error) {
+	if v == "" {
+		return v, nil
+	}
+	switch v[0] {
+	case '"':
+		return strconv.Unquote(v)
+	case '\'':
+		if len(v) < 2 || v[len(v)-1] != '\'' {
+			return "", errors.New("unterminated quote")
+		}
+		return strings.ReplaceAll(v[1:len(v)-1], "''", "'"), nil
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v, nil
+}
+
+// loadConfigFile reads the flat key: value settings of a YAML config file
+func loadConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	settings := map[string]string{}
+	var errs []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s:%d: expected key: value", path, n))
+			continue
+		}
+		k = strings.TrimSpace(k)
+		key := configFileKey(k)
+		if _, known := configKeys[key]; !known {
+			errs = append(errs, fmt.Sprintf("%s:%d: unknown key %q", path, n, k))
+			continue
+		}
+		value, err := unquote(strings.TrimSpace(v))
+		if err == nil && value != "" {
+			err = validateSetting(key, value)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: key %q: %v", path, n, k, err))
+			continue
+		}
+		settings[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	return settings, nil
+}
+
+// loadConfig loads the config file given with --config, or the default one when it exists
+func loadConfig(args []string) error {
+	path, explicit := flagArg(args, "config")
+	if !explicit {
+		path = defaultConfigFile
+	}
+	configFile = path
+	settings, err := loadConfigFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	configSettings = settings
+	return nil
+}
@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// freeSpace returns the bytes available to the user in the file system of a directory
+func freeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// freeSpace returns the bytes available to the user in the file system of a directory
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free space is only available on Linux")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// minFreeSpace is the free space needed in the download directory, a package is about 200MB
+const minFreeSpace = 512 << 20
+
+// freeSpaceMargin is the free space left besides a download or an install
+const freeSpaceMargin = 64 << 20
+
+// checkFreeSpace returns an error, also sent as a notification, when a directory has less than need bytes
+// free besides the safety margin. The check is skipped when the free space is unknown.
+func (c *Config) checkFreeSpace(dir string, need int64, what string) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		logDebug("Unable to check the free space of", dir+": ", err)
+		return nil
+	}
+	if int64(free) >= need+freeSpaceMargin {
+		return nil
+	}
+	err = fmt.Errorf("not enough free space in %s to %s: %s free, %s needed", dir, what, formatBytes(int64(free)), formatBytes(need+freeSpaceMargin))
+	if nerr := sendNotification(c, "PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater stopped: "+err.Error()); nerr != nil {
+		logWarn("Unable to send the notification: ", nerr)
+	}
+	return err
+}
+
+// doctorCheck is a diagnostic of the environment the updater runs in
+type doctorCheck struct {
+	name     string
+	critical bool
+	hint     string
+	run      func() (string, error)
+}
+
+// checkExecutable returns an error when a file is missing or not executable
+func checkExecutable(f string) (string, error) {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&0111 == 0 {
+		return "", fmt.Errorf("%s is not executable", f)
+	}
+	return f, nil
+}
+
+// doctorChecks returns the diagnostics run by the doctor subcommand
+func doctorChecks(cfg *Config) []doctorCheck {
+	buildType := cfg.BuildType
+	return []doctorCheck{
+		{"synopkg", true, "the updater must run on a Synology NAS with DSM", func() (string, error) {
+			return checkExecutable(cfg.Synopkg)
+		}},
+		{"synonotify", false, "notifications will not be delivered", func() (string, error) {
+			return checkExecutable(cfg.Synonotify)
+		}},
+		{"PlexMediaServer", true, "install PlexMediaServer from the Package Center first", func() (string, error) {
+			return getInstalledVersion(cfg)
+		}},
+		{"root", true, "run the updater as root, e.g. from a root scheduled task or with sudo", func() (string, error) {
+			if os.Geteuid() != 0 {
+				return "", fmt.Errorf("running as uid %d", os.Geteuid())
+			}
+			return "running as root", nil
+		}},
+		{"DSM version", true, "the updater supports DSM 6 and 7", func() (string, error) {
+			major, err := dsmMajorVersion()
+			if err != nil {
+				return "", err
+			}
+			if major < 6 {
+				return "", fmt.Errorf("DSM %d", major)
+			}
+			return fmt.Sprintf("DSM %d", major), nil
+		}},
+		{"build type", true, "set BUILD_TYPE to the build type of the machine, see list-builds", func() (string, error) {
+			m, b, err := machineBuildType()
+			if err != nil {
+				return "", err
+			}
+			if strings.EqualFold(buildType, buildTypeAuto) {
+				return fmt.Sprintf("machine %s, build type %s detected", m, b), nil
+			}
+			if b != buildType {
+				return "", fmt.Errorf("machine %s needs %s, BUILD_TYPE is %s", m, b, buildType)
+			}
+			return fmt.Sprintf("machine %s, build type %s", m, buildType), nil
+		}},
+		{"download directory", true, "use --dir with a writable directory", func() (string, error) {
+			if err := cfg.resolveDownloadDir(); err != nil {
+				return "", err
+			}
+			return cfg.Dir + " is writable", nil
+		}},
+		{"free space", true, "free some space or use --dir on another volume", func() (string, error) {
+			free, err := freeSpace(cfg.Dir)
+			if err != nil {
+				return "", err
+			}
+			if free < minFreeSpace {
+				return "", fmt.Errorf("%s free in %s, %s needed", formatBytes(int64(free)), cfg.Dir, formatBytes(minFreeSpace))
+			}
+			return fmt.Sprintf("%s free in %s", formatBytes(int64(free)), cfg.Dir), nil
+		}},
+		{"plex.tv", true, "check the DNS, proxy and firewall settings of the NAS", func() (string, error) {
+			return checkDownloadsReachable(cfg, cfg.DownloadsURL)
+		}},
+	}
+}
+
+// checkDownloadsReachable resolves, connects over TLS and fetches the downloads JSON
+func checkDownloadsReachable(cfg *Config, downloadsURL string) (string, error) {
+	u, err := url.Parse(downloadsURL)
+	if err != nil {
+		return "", err
+	}
+	ipNetwork, tcpNetwork, _ := ipFamily(cfg.IPPreference)
+	if _, err := cfg.resolver().LookupIP(context.Background(), ipNetwork, u.Hostname()); err != nil {
+		return "", fmt.Errorf("DNS: %w", err)
+	}
+	if u.Scheme == "https" {
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: cfg.HTTPTimeout, Resolver: cfg.resolver()}, tcpNetwork, net.JoinHostPort(u.Hostname(), port), &tls.Config{RootCAs: cfg.rootCAs})
+		if err != nil {
+			return "", fmt.Errorf("TLS: %w", err)
+		}
+		conn.Close()
+	}
+	res, err := httpGet(cfg, cfg.httpClient(), u.String())
+	if err != nil {
+		return "", fmt.Errorf("HTTP: %w", err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	return u.Host + " answered " + res.Status, nil
+}
+
+// runDoctorChecks prints the result of every check and reports whether the critical ones passed
+func runDoctorChecks(w io.Writer, checks []doctorCheck) bool {
+	ok := true
+	for _, c := range checks {
+		detail, err := c.run()
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "[PASS] %s: %s\n", c.name, detail)
+			continue
+		case c.critical:
+			ok = false
+			fmt.Fprintf(w, "[FAIL] %s: %v\n", c.name, err)
+		default:
+			fmt.Fprintf(w, "[WARN] %s: %v\n", c.name, err)
+		}
+		fmt.Fprintf(w, "       %s\n", c.hint)
+	}
+	return ok
+}
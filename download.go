@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checksums are the sha1 checksum published by Plex and the sha256 one recorded in the manifests
+type checksums struct {
+	sha1   string
+	sha256 string
+}
+
+// packageHash calculates both checksums of a package in a single pass
+type packageHash struct {
+	sha1   hash.Hash
+	sha256 hash.Hash
+}
+
+// newPackageHash returns a packageHash of no data
+func newPackageHash() *packageHash {
+	return &packageHash{sha1: sha1.New(), sha256: sha256.New()}
+}
+
+// Write adds data to both checksums
+func (h *packageHash) Write(p []byte) (int, error) {
+	h.sha1.Write(p)
+	h.sha256.Write(p)
+	return len(p), nil
+}
+
+// Reset starts both checksums over
+func (h *packageHash) Reset() {
+	h.sha1.Reset()
+	h.sha256.Reset()
+}
+
+// sums returns the checksums of the data written
+func (h *packageHash) sums() checksums {
+	return checksums{sha1: fmt.Sprintf("%x", h.sha1.Sum(nil)), sha256: fmt.Sprintf("%x", h.sha256.Sum(nil))}
+}
+
+// checksumFile returns the sha1 and sha256 checksums of a file
+func checksumFile(f string) (checksums, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return checksums{}, err
+	}
+	defer file.Close()
+
+	start := time.Now()
+	h := newPackageHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return checksums{}, err
+	}
+	logDebug("Checksum of", f, "calculated in", time.Since(start))
+
+	return h.sums(), nil
+}
+
+// releaseFilePath returns the local path where a plex release is downloaded to
+func releaseFilePath(dir string, r release) (string, error) {
+	// Parse URL to get filename
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(u.Path)), nil
+}
+
+// verifyChecksum reports whether the sha1 checksum of a file matches the expected one
+func verifyChecksum(f string, expected string) (bool, error) {
+	_, match, err := verifyChecksums(f, expected)
+	return match, err
+}
+
+// verifyChecksums returns the checksums of a file and whether its sha1 one matches the expected one
+func verifyChecksums(f string, expected string) (checksums, bool, error) {
+	sums, err := checksumFile(f)
+	if err != nil {
+		return sums, false, err
+	}
+	return sums, checksumMatches(sums.sha1, expected), nil
+}
+
+// checksumMatches logs a calculated and an expected checksum and reports whether they match, whatever their case
+func checksumMatches(checksum string, expected string) bool {
+	logInfo("Calculated checksum: ", checksum)
+	logInfo("Expected checksum: ", expected)
+	return strings.EqualFold(checksum, expected)
+}
+
+// dryRunUpdate logs the actions an update would take without performing them
+func dryRunUpdate(cfg *Config, dir string, r release) error {
+	filePath, err := releaseFilePath(dir, r)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(filePath)
+	if !os.IsNotExist(err) {
+		logInfo("[dry-run] File already exists: ", filePath)
+		match, err := verifyChecksum(filePath, r.Checksum)
+		if err != nil {
+			return err
+		}
+		if match {
+			logInfo("[dry-run] Checksum match, would reuse the local file")
+		} else {
+			logInfo("[dry-run] Checksum mismatch, would remove and download again")
+			logInfo("[dry-run] Would download: ", r.URL)
+		}
+	} else {
+		logInfo("[dry-run] Would download: ", r.URL)
+	}
+	logInfo("[dry-run] Would save to: ", filePath)
+
+	logInfo("[dry-run] Would send notification: PKGHasUpgrade")
+	logInfo("[dry-run] Would run: ", cfg.Synopkg, "stop", cfg.PackageName)
+	logInfo("[dry-run] Would run: ", cfg.Synopkg, "install", filePath)
+	logInfo("[dry-run] Would run: ", cfg.Synopkg, "start", cfg.PackageName)
+	return nil
+}
+
+// partialPath returns the path of the partial download of a package
+func partialPath(f string) string {
+	return f + ".partial"
+}
+
+// defaultMaxPackageSize is the largest package downloaded, they are about 200MB
+const defaultMaxPackageSize = 2 << 30
+
+// downloadSizeMargin is the data accepted past the size announced for a download before it is aborted
+const downloadSizeMargin = 1 << 20
+
+// errPackageTooLarge is returned when a download exceeds MAX_PACKAGE_SIZE or the size announced
+var errPackageTooLarge = errors.New("package too large")
+
+// defaultReleaseHosts are the hosts the packages of Plex are downloaded from
+const defaultReleaseHosts = "plex.tv,plexapp.com"
+
+// checkReleaseURL returns an error when a package URL is not an HTTPS URL of a host of RELEASE_HOSTS or of
+// their subdomains. A host given as http://host is also allowed over plain HTTP, e.g. a mirror on the LAN,
+// as is the origin serving the downloads JSON, such as a mirror unit rewriting the URLs to its own.
+func (c *Config) checkReleaseURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("refusing the package URL %q: %w", rawURL, err)
+	}
+	if c.isDownloadsOrigin(u) {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range c.ReleaseHosts {
+		h = strings.ToLower(h)
+		scheme := "https"
+		if rest, ok := strings.CutPrefix(h, "http://"); ok {
+			h, scheme = rest, "http"
+		}
+		h = strings.TrimPrefix(h, "https://")
+		if (host != h && !strings.HasSuffix(host, "."+h)) || host == "" {
+			continue
+		}
+		if u.Scheme == "https" || u.Scheme == scheme {
+			return nil
+		}
+		return fmt.Errorf("security: refusing to download the package over %s from %s, only HTTPS is allowed, see RELEASE_HOSTS", u.Scheme, rawURL)
+	}
+	return fmt.Errorf("security: refusing to download the package from %s, %s is not one of RELEASE_HOSTS %s", rawURL, u.Host, strings.Join(c.ReleaseHosts, ","))
+}
+
+// isDownloadsOrigin reports whether a URL has the scheme, host and port of the downloads JSON URL or of
+// one of its fallbacks
+func (c *Config) isDownloadsOrigin(u *url.URL) bool {
+	if u.Host == "" {
+		return false
+	}
+	for _, raw := range append([]string{c.DownloadsURL}, c.FallbackURLs...) {
+		d, err := url.Parse(raw)
+		if err == nil && strings.EqualFold(d.Scheme, u.Scheme) && strings.EqualFold(d.Host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeStalePartials removes the partial downloads of a directory left by the downloads of other versions
+func removeStalePartials(dir string, keep string) {
+	partials, err := filepath.Glob(filepath.Join(dir, "PlexMediaServer-*.spk.partial"))
+	if err != nil {
+		return
+	}
+	version, _ := packageFileVersion(strings.TrimSuffix(keep, ".partial"))
+	for _, f := range partials {
+		// the builds of a version are downloaded together by --all-builds and the mirror
+		if v, ok := packageFileVersion(strings.TrimSuffix(f, ".partial")); f == keep || ok && v == version {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			logWarn("Unable to remove the stale partial download: ", err)
+			continue
+		}
+		logInfo("Removed the stale partial download: ", f)
+	}
+}
+
+// downloadPlexRelease downloads a plex release from the first of PACKAGE_MIRRORS serving it with its
+// checksum, or else from its URL, and returns the path to the downloaded file with its checksums
+func downloadPlexRelease(cfg *Config, dir string, r release) (string, checksums, error) {
+	if err := cfg.checkReleaseURL(r.URL); err != nil {
+		if nerr := sendNotification(cfg, "PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater stopped: "+err.Error()); nerr != nil {
+			logWarn("Unable to send the notification: ", nerr)
+		}
+		return "", checksums{}, err
+	}
+	if len(cfg.PackageMirrors) == 0 {
+		return downloadReleaseFrom(cfg, dir, r)
+	}
+	filePath, err := releaseFilePath(dir, r)
+	if err != nil {
+		return "", checksums{}, err
+	}
+	if _, err := os.Stat(filePath); err == nil {
+		if sums, match, err := verifyChecksums(filePath, r.Checksum); err == nil && match {
+			logInfo("File already exists: ", filePath)
+			logInfo("Checksum match")
+			return filePath, sums, nil
+		}
+	}
+	for _, m := range cfg.PackageMirrors {
+		mr := r
+		mr.URL = strings.TrimSuffix(m, "/") + "/" + url.PathEscape(filepath.Base(filePath))
+		fp, sums, err := downloadReleaseFrom(cfg, dir, mr)
+		if err == nil {
+			logNotice("Package downloaded from the mirror: ", m)
+			return fp, sums, nil
+		}
+		if cfg.interrupted() {
+			return "", checksums{}, err
+		}
+		logWarn("Unable to download the package from the mirror", m+", trying the next source: ", err)
+	}
+	fp, sums, err := downloadReleaseFrom(cfg, dir, r)
+	if err == nil {
+		logNotice("Package downloaded from: ", r.URL)
+	}
+	return fp, sums, err
+}
+
+// downloadReleaseFrom downloads a plex release from its URL and returns the path to the downloaded file with its checksums
+func downloadReleaseFrom(cfg *Config, dir string, r release) (string, checksums, error) {
+	// check if targe directory already exists
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return "", checksums{}, err
+	}
+
+	filePath, err := releaseFilePath(dir, r)
+	if err != nil {
+		return "", checksums{}, err
+	}
+
+	// the size announced is checked before and after the download
+	remote := cfg.head(r.URL)
+	switch {
+	case remote.size >= 0 && remote.modified != "":
+		logInfo("Package size: ", formatBytes(remote.size)+", last modified:", remote.modified)
+	case remote.size >= 0:
+		logInfo("Package size: ", formatBytes(remote.size))
+	}
+	if remote.size > cfg.MaxPackageSize {
+		return "", checksums{}, fmt.Errorf("downloading %s: %w, %s announced, see MAX_PACKAGE_SIZE", r.URL, errPackageTooLarge, formatBytes(remote.size))
+	}
+
+	// check if file already exists
+	partial := partialPath(filePath)
+	if fi, err := os.Stat(filePath); err == nil {
+		logInfo("File already exists: ", filePath)
+		logInfo("URL: ", r.URL)
+
+		// check if checksum matches, otherwise delete the local file. A file of another size does not match.
+		if remote.size >= 0 && fi.Size() != remote.size {
+			logInfo(fmt.Sprintf("Size mismatch, %d bytes instead of %d, forcing download", fi.Size(), remote.size))
+		} else {
+			sums, match, err := verifyChecksums(filePath, r.Checksum)
+			if err != nil {
+				return "", checksums{}, err
+			}
+			if match {
+				logInfo("Checksum match")
+				return filePath, sums, nil
+			}
+			logInfo("Checksum mismatch, forcing download")
+		}
+		if err := os.Remove(filePath); err != nil {
+			return "", checksums{}, err
+		}
+	}
+
+	removeStalePartials(dir, partial)
+	recordPartial(cfg.StateDir, partial)
+
+	size := remote.size
+	if size > 0 {
+		need := size
+		if fi, err := os.Stat(partial); err == nil {
+			need -= fi.Size()
+		}
+		if err := cfg.checkFreeSpace(dir, need, "download the package"); err != nil {
+			return "", checksums{}, err
+		}
+	}
+
+	if cfg.DownloadBackend == backendDownloadStation {
+		fp, sums, err := downloadReleaseWithStation(cfg, r, partial, filePath, remote.size)
+		if err == nil || !cfg.DSFallback || cfg.interrupted() {
+			return fp, sums, err
+		}
+		logWarn("Download Station failed, downloading with the builtin downloader: ", err)
+	}
+
+	// download to a partial file, renamed once verified
+	out, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", checksums{}, err
+	}
+	defer out.Close()
+	var offset int64
+	if fi, err := out.Stat(); err == nil && fi.Size() > 0 {
+		offset = fi.Size()
+		logInfo("Partial download found: ", partial)
+	}
+
+	// an interrupted download keeps its partial file, resumed by the next run
+	ctx := cfg.context()
+
+	logInfo("Downloading: ", r.URL)
+	// the checksums are calculated while downloading, instead of reading the file again
+	h := newPackageHash()
+	segmented := cfg.Segments > 1 && offset == 0 && size > 0 && remote.ranges
+	if segmented {
+		err = downloadSegments(ctx, cfg, out, r.URL, size)
+		if errors.Is(err, errNoRanges) {
+			logInfo("The server does not support range requests, downloading in a single stream")
+			segmented = false
+			err = out.Truncate(0)
+		} else if err == nil {
+			// the segments are written out of order, the checksum is calculated afterwards
+			_, err = io.Copy(h, io.NewSectionReader(out, 0, size))
+		}
+	}
+	if !segmented && err == nil {
+		err = cfg.retry("downloading "+r.URL, func() error {
+			// resume after the bytes received by the previous attempts
+			if fi, err := out.Stat(); err == nil {
+				offset = fi.Size()
+			}
+			var err error
+			size, err = fetchRelease(ctx, cfg, out, h, r.URL, offset)
+			return err
+		})
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("downloading %s: %s", r.URL, cfg.interruption())
+	}
+	if err != nil {
+		// the holes of a segmented download and the oversized ones can not be resumed
+		if fi, serr := out.Stat(); serr == nil && fi.Size() > 0 && !segmented && !errors.Is(err, errPackageTooLarge) {
+			out.Sync()
+			logInfo("Partial download kept for the next run: ", partial)
+		} else {
+			out.Close()
+			os.Remove(partial)
+		}
+		return "", checksums{}, err
+	}
+	if err := out.Sync(); err != nil {
+		return "", checksums{}, err
+	}
+	if remote.size >= 0 && size != remote.size {
+		out.Close()
+		os.Remove(partial)
+		return "", checksums{}, fmt.Errorf("downloaded %d bytes instead of the %d announced", size, remote.size)
+	}
+
+	// Verify checksum
+	sums := h.sums()
+	match := checksumMatches(sums.sha1, r.Checksum)
+	logInfo("Size: ", size, "bytes")
+
+	if !match {
+		out.Close()
+		os.Remove(partial)
+		return "", checksums{}, errors.New("checksum mismatch, aborting")
+	}
+	if err := out.Close(); err != nil {
+		return "", checksums{}, err
+	}
+	if _, err := readPackage(partial); err != nil {
+		os.Remove(partial)
+		return "", checksums{}, err
+	}
+	if err := os.Rename(partial, filePath); err != nil {
+		return "", checksums{}, err
+	}
+
+	return filePath, sums, nil
+}
+
+// fetchRelease downloads a package to a file in a single attempt, writing its content to h too, and returns
+// its size, checked against the one announced. A download is resumed after offset bytes when the server honors the range requested, and starts over otherwise.
+func fetchRelease(ctx context.Context, cfg *Config, out *os.File, h *packageHash, u string, offset int64) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", cfg.userAgent())
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := cfg.downloadClient().Do(req)
+	if isTimeout(err) && !cfg.interrupted() {
+		return 0, fmt.Errorf("downloading %s: no response within %s, see HTTP_TIMEOUT: %w", u, cfg.HTTPTimeout, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	logDebug("HTTP status: ", res.Status, "for", u)
+
+	size := res.ContentLength
+	switch {
+	case res.StatusCode == http.StatusPartialContent && offset > 0:
+		start, total, err := parseContentRange(res.Header.Get("Content-Range"))
+		if err != nil {
+			return 0, err
+		}
+		if start != offset {
+			return 0, fmt.Errorf("downloading %s: resumed at byte %d instead of %d", u, start, offset)
+		}
+		logInfo("Resuming the download after", formatBytes(offset))
+		// the checksum covers the bytes already received
+		h.Reset()
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(h, out, offset); err != nil {
+			return 0, err
+		}
+		size = total
+		if total < 0 && res.ContentLength >= 0 {
+			size = offset + res.ContentLength
+		}
+	case res.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the local file is as large as the package, it is complete but does not match
+		logInfo("Local file is complete but corrupted, downloading again")
+		res.Body.Close()
+		if err := out.Truncate(0); err != nil {
+			return 0, err
+		}
+		return fetchRelease(ctx, cfg, out, h, u, 0)
+	case res.StatusCode == http.StatusOK:
+		if offset > 0 {
+			logInfo("Server does not support resuming, downloading again")
+		}
+		if err := out.Truncate(0); err != nil {
+			return 0, err
+		}
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		h.Reset()
+	default:
+		return 0, newStatusError(u, res)
+	}
+	if size > cfg.MaxPackageSize {
+		return 0, fmt.Errorf("downloading %s: %w, %s announced, see MAX_PACKAGE_SIZE", u, errPackageTooLarge, formatBytes(size))
+	}
+
+	stall := newStallReader(res.Body, cfg.StallTimeout, cancel)
+	defer stall.stop()
+	var body io.Reader = stall
+	if rate, err := parseRate(cfg.MaxDownloadRate); err == nil {
+		body = newRateReader(stall, rate)
+	}
+	progress := newProgressReader(body, res.ContentLength)
+	// a bogus or endless body must not fill the volume
+	limit := cfg.MaxPackageSize - offset
+	if res.ContentLength >= 0 && res.ContentLength+downloadSizeMargin < limit {
+		limit = res.ContentLength + downloadSizeMargin
+	}
+	n, err := io.Copy(io.MultiWriter(out, h), io.LimitReader(progress, limit+1))
+	progress.finish()
+	if n > limit {
+		return 0, fmt.Errorf("downloading %s: %w, more than %s received, see MAX_PACKAGE_SIZE", u, errPackageTooLarge, formatBytes(limit))
+	}
+	if res.StatusCode == http.StatusPartialContent {
+		n += offset
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || err == nil && size >= 0 && n != size {
+		return 0, fmt.Errorf("download truncated: got %d of %d bytes", n, size)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// parseContentRange returns the first byte and the total size, -1 when unknown, of a Content-Range header
+func parseContentRange(h string) (int64, int64, error) {
+	var start, end, total int64
+	n, _ := fmt.Sscanf(h, "bytes %d-%d/%d", &start, &end, &total)
+	if n < 2 {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", h)
+	}
+	if n == 2 {
+		total = -1
+	}
+	return start, total, nil
+}
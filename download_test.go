@@ -0,0 +1,404 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPackageName is the file name of the packages served by the tests
+const testPackageName = "PlexMediaServer-1.40.0.7998-c29d4c0c8-x86_64_DSM7.spk"
+
+// testConfig returns the configuration of a test, off a NAS, downloading to a temporary directory
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	return &Config{
+		NoSynology:      true,
+		PackageName:     defaultPackageName,
+		StateDir:        t.TempDir(),
+		Dir:             t.TempDir(),
+		BuildType:       "linux-x86_64",
+		Distro:          defaultDistro,
+		Channel:         channelPublic,
+		DSMVersion:      7,
+		HTTPTimeout:     5 * time.Second,
+		StallTimeout:    5 * time.Second,
+		RetryAttempts:   1,
+		MaxPackageSize:  defaultMaxPackageSize,
+		Segments:        1,
+		DownloadBackend: backendBuiltin,
+		ReleaseHosts:    []string{"http://127.0.0.1"},
+		ChangelogItems:  defaultChangelogItems,
+	}
+}
+
+// tarEntry is a file of a tar archive built by a test
+type tarEntry struct {
+	name string
+	data []byte
+}
+
+// testTar returns a tar archive of entries
+func testTar(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// testPackage returns a .spk package of an INFO file, completed with the md5 checksum of
+// the payload of its package.tgz
+func testPackage(t *testing.T, info string, payload []byte) []byte {
+	t.Helper()
+	info += fmt.Sprintf("checksum=\"%x\"\n", md5.Sum(payload))
+	return testTar(t, tarEntry{"INFO", []byte(info)}, tarEntry{"package.tgz", payload})
+}
+
+// testPackageInfo is the INFO file of the packages of the tests
+const testPackageInfo = "package=\"PlexMediaServer\"\nversion=\"1.40.0.7998-c29d4c0c8\"\narch=\"noarch\"\n"
+
+// servePackage serves a package with range requests, as the Plex CDN does
+func servePackage(pkg []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(pkg))
+	})
+}
+
+func TestChecksumMatches(t *testing.T) {
+	for _, tc := range []struct {
+		checksum, expected string
+		want               bool
+	}{
+		{"0d4d8b5b0a6cbd1dbd5a4c3bdc5d0a2e7f7b1d46", "0d4d8b5b0a6cbd1dbd5a4c3bdc5d0a2e7f7b1d46", true},
+		{"0d4d8b5b0a6cbd1dbd5a4c3bdc5d0a2e7f7b1d46", "0D4D8B5B0A6CBD1DBD5A4C3BDC5D0A2E7F7B1D46", true},
+		{"0d4d8b5b0a6cbd1dbd5a4c3bdc5d0a2e7f7b1d46", "0d4d8b5b0a6cbd1dbd5a4c3bdc5d0a2e7f7b1d47", false},
+		{"0d4d8b5b0a6cbd1dbd5a4c3bdc5d0a2e7f7b1d46", "", false},
+	} {
+		if got := checksumMatches(tc.checksum, tc.expected); got != tc.want {
+			t.Errorf("checksumMatches(%q, %q) = %t, want %t", tc.checksum, tc.expected, got, tc.want)
+		}
+	}
+}
+
+func TestStreamedChecksumsMatchFile(t *testing.T) {
+	pkg := testPackage(t, testPackageInfo, bytes.Repeat([]byte("plex media server "), 50000))
+	want := fmt.Sprintf("%x", sha1.Sum(pkg))
+	srv := httptest.NewServer(servePackage(pkg))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name     string
+		checksum string
+		segments int
+	}{
+		{"single stream", want, 1},
+		{"upper case checksum", strings.ToUpper(want), 1},
+		{"segments", want, 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Segments = tc.segments
+			r := release{URL: srv.URL + "/" + testPackageName, Checksum: tc.checksum}
+			fp, sums, err := downloadReleaseFrom(cfg, cfg.Dir, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reread, err := checksumFile(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sums != reread {
+				t.Errorf("streamed checksums %+v, read again %+v", sums, reread)
+			}
+			if sums.sha1 != want {
+				t.Errorf("sha1 %s, want %s", sums.sha1, want)
+			}
+			if err := writeManifest(fp, "1.40.0.7998-c29d4c0c8", r, sums); err != nil {
+				t.Errorf("writing the manifest: %v", err)
+			}
+		})
+	}
+}
+
+func TestChecksumMismatchRemovesDownload(t *testing.T) {
+	pkg := testPackage(t, testPackageInfo, []byte("payload"))
+	srv := httptest.NewServer(servePackage(pkg))
+	defer srv.Close()
+
+	cfg := testConfig(t)
+	r := release{URL: srv.URL + "/" + testPackageName, Checksum: "0d4d8b5b0a6cbd1dbd5a4c3bdc5d0a2e7f7b1d46"}
+	_, _, err := downloadReleaseFrom(cfg, cfg.Dir, r)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("got error %v, want a checksum mismatch", err)
+	}
+	f := filepath.Join(cfg.Dir, testPackageName)
+	for _, p := range []string{f, partialPath(f)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left after a checksum mismatch", p)
+		}
+	}
+}
+
+// cutHandler serves the first half of a package, announcing all of it, then drops the connection,
+// and serves the range requests in full, recording the ranges asked for
+type cutHandler struct {
+	pkg    []byte
+	ranges []string
+	// cut is called once the first half was sent, before the connection is dropped
+	cut func()
+}
+
+func (h *cutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", fmt.Sprint(len(h.pkg)))
+		return
+	}
+	if rg := r.Header.Get("Range"); rg != "" {
+		h.ranges = append(h.ranges, rg)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(h.pkg))
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(h.pkg)))
+	w.Write(h.pkg[:len(h.pkg)/2])
+	w.(http.Flusher).Flush()
+	if h.cut != nil {
+		h.cut()
+		<-r.Context().Done()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+func TestInterruptedDownloadResumes(t *testing.T) {
+	pkg := testPackage(t, testPackageInfo, bytes.Repeat([]byte("plex media server "), 50000))
+	checksum := fmt.Sprintf("%x", sha1.Sum(pkg))
+
+	for _, tc := range []struct {
+		name string
+		// interrupt cancels the run once half of the package was received, instead of a dropped connection
+		interrupt bool
+	}{
+		{"connection dropped", false},
+		{"run interrupted", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &cutHandler{pkg: pkg}
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+			cfg := testConfig(t)
+			if tc.interrupt {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				cfg.ctx = ctx
+				h.cut = func() {
+					// the run is interrupted once the client wrote some of the data received
+					for start := time.Now(); fileSize(partialPath(filepath.Join(cfg.Dir, testPackageName))) == 0 && time.Since(start) < 5*time.Second; {
+						time.Sleep(10 * time.Millisecond)
+					}
+					cancel()
+				}
+			}
+			r := release{URL: srv.URL + "/" + testPackageName, Checksum: checksum}
+			f := filepath.Join(cfg.Dir, testPackageName)
+
+			if _, _, err := downloadReleaseFrom(cfg, cfg.Dir, r); err == nil {
+				t.Fatal("the interrupted download succeeded")
+			}
+			fi, err := os.Stat(partialPath(f))
+			if err != nil {
+				t.Fatalf("partial download not kept: %v", err)
+			}
+			if fi.Size() == 0 || fi.Size() >= int64(len(pkg)) {
+				t.Fatalf("partial download of %d bytes, want part of %d", fi.Size(), len(pkg))
+			}
+			if _, err := os.Stat(f); !os.IsNotExist(err) {
+				t.Fatalf("the interrupted download left %s", f)
+			}
+
+			// the next run resumes after the bytes received
+			cfg.ctx = nil
+			fp, sums, err := downloadReleaseFrom(cfg, cfg.Dir, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{fmt.Sprintf("bytes=%d-", fi.Size())}; fmt.Sprint(h.ranges) != fmt.Sprint(want) {
+				t.Errorf("ranges requested %q, want %q", h.ranges, want)
+			}
+			if sums.sha1 != checksum {
+				t.Errorf("resumed download checksum %s, want %s", sums.sha1, checksum)
+			}
+			if _, err := os.Stat(partialPath(f)); !os.IsNotExist(err) {
+				t.Errorf("partial download left once complete")
+			}
+			b, err := os.ReadFile(fp)
+			if err != nil || !bytes.Equal(b, pkg) {
+				t.Errorf("resumed download differs from the package")
+			}
+		})
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.spk"), filepath.Join(dir, "dst.spk")
+	if err := os.WriteFile(src, []byte("package"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("%s left after the move", src)
+	}
+	if b, err := os.ReadFile(dst); err != nil || string(b) != "package" {
+		t.Errorf("moved file %q, %v", b, err)
+	}
+	// a failed move keeps its source
+	if err := moveFile(filepath.Join(dir, "missing.spk"), dst); err == nil {
+		t.Error("moving a missing file succeeded")
+	}
+	if err := os.WriteFile(src, []byte("package"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveFile(src, filepath.Join(dir, "missing", "dst.spk")); err == nil {
+		t.Error("moving to a missing directory succeeded")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("source removed by a failed move: %v", err)
+	}
+}
+
+// endlessHandler streams data forever without announcing its size, as a captive portal may
+type endlessHandler struct{}
+
+func (endlessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		return
+	}
+	chunk := bytes.Repeat([]byte("x"), 32<<10)
+	for r.Context().Err() == nil {
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+	}
+}
+
+func TestEndlessDownloadAborted(t *testing.T) {
+	srv := httptest.NewServer(endlessHandler{})
+	defer srv.Close()
+
+	cfg := testConfig(t)
+	cfg.MaxPackageSize = 1 << 20
+	r := release{URL: srv.URL + "/" + testPackageName, Checksum: "0d4d8b5b0a6cbd1dbd5a4c3bdc5d0a2e7f7b1d46"}
+	_, _, err := downloadReleaseFrom(cfg, cfg.Dir, r)
+	if !errors.Is(err, errPackageTooLarge) {
+		t.Fatalf("got error %v, want %v", err, errPackageTooLarge)
+	}
+	// an oversized download can not be resumed
+	f := filepath.Join(cfg.Dir, testPackageName)
+	for _, p := range []string{f, partialPath(f)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left by the oversized download", p)
+		}
+	}
+}
+
+// stallHandler sends the first half of a package then nothing until the client gives up,
+// and serves the range requests in full
+type stallHandler struct {
+	pkg []byte
+}
+
+func (h stallHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", fmt.Sprint(len(h.pkg)))
+		w.Header().Set("Accept-Ranges", "bytes")
+		return
+	}
+	if r.Header.Get("Range") != "" {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(h.pkg))
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(h.pkg)))
+	w.Write(h.pkg[:len(h.pkg)/2])
+	w.(http.Flusher).Flush()
+	<-r.Context().Done()
+}
+
+func TestStalledDownloadKeepsPartial(t *testing.T) {
+	pkg := testPackage(t, testPackageInfo, bytes.Repeat([]byte("plex media server "), 50000))
+	checksum := fmt.Sprintf("%x", sha1.Sum(pkg))
+	srv := httptest.NewServer(stallHandler{pkg})
+	defer srv.Close()
+
+	cfg := testConfig(t)
+	cfg.StallTimeout = 200 * time.Millisecond
+	r := release{URL: srv.URL + "/" + testPackageName, Checksum: checksum}
+	start := time.Now()
+	_, _, err := downloadReleaseFrom(cfg, cfg.Dir, r)
+	if err == nil || !strings.Contains(err.Error(), "DOWNLOAD_STALL_TIMEOUT") {
+		t.Fatalf("got error %v, want a stalled download", err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("stalled download aborted after %s", d)
+	}
+	f := filepath.Join(cfg.Dir, testPackageName)
+	if n := fileSize(partialPath(f)); n != int64(len(pkg)/2) {
+		t.Fatalf("partial download of %d bytes kept, want the %d received", n, len(pkg)/2)
+	}
+
+	// the next run resumes the download
+	if _, sums, err := downloadReleaseFrom(cfg, cfg.Dir, r); err != nil || sums.sha1 != checksum {
+		t.Errorf("resuming the stalled download: checksum %s, %v", sums.sha1, err)
+	}
+}
+
+func TestCheckReleaseURL(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ReleaseHosts = []string{"plex.tv", "plexapp.com", "http://nas.lan"}
+	cfg.DownloadsURL = "http://mirror.lan:8080/5.json"
+	cfg.FallbackURLs = []string{"https://backup.example/plex/5.json"}
+	for u, allowed := range map[string]bool{
+		"https://downloads.plex.tv/plex-media-server-new/" + testPackageName: true,
+		"https://plex.tv/" + testPackageName:                                 true,
+		"https://PLEXAPP.COM/" + testPackageName:                             true,
+		"http://nas.lan/" + testPackageName:                                  true,
+		"https://nas.lan/" + testPackageName:                                 true,
+		"http://mirror.lan:8080/" + testPackageName:                          true,
+		"http://MIRROR.lan:8080/" + testPackageName:                          true,
+		"https://backup.example/" + testPackageName:                          true,
+		"http://downloads.plex.tv/" + testPackageName:                        false,
+		"https://notplex.tv/" + testPackageName:                              false,
+		"https://plex.tv.example/" + testPackageName:                         false,
+		"http://mirror.lan:8081/" + testPackageName:                          false,
+		"http://mirror.lan/" + testPackageName:                               false,
+		"https://mirror.lan:8080/" + testPackageName:                         false,
+		"http://backup.example/" + testPackageName:                           false,
+		"file:///tmp/" + testPackageName:                                     false,
+	} {
+		if err := cfg.checkReleaseURL(u); (err == nil) != allowed {
+			t.Errorf("%s: got error %v, want allowed %v", u, err, allowed)
+		}
+	}
+}
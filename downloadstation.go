@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// download backends
+const (
+	backendBuiltin         = "builtin"
+	backendDownloadStation = "download-station"
+)
+
+// defaultDSURL is the DSM Web API of the NAS the updater runs on
+const defaultDSURL = "http://localhost:5000"
+
+// dsPollInterval is the time between two polls of a Download Station task
+const dsPollInterval = 5 * time.Second
+
+// dsResponse is the envelope of the answers of the DSM Web API
+type dsResponse struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data"`
+	Error   struct {
+		Code int `json:"code"`
+	} `json:"error"`
+}
+
+// dsTask is a Download Station task as listed with its detail and transfer
+type dsTask struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	Size       int64  `json:"size"`
+	Status     string `json:"status"`
+	Additional struct {
+		Detail struct {
+			URI         string `json:"uri"`
+			Destination string `json:"destination"`
+		} `json:"detail"`
+		Transfer struct {
+			Downloaded int64 `json:"size_downloaded"`
+		} `json:"transfer"`
+	} `json:"additional"`
+}
+
+// dsClient calls the Download Station API in a session of the DS_ACCOUNT user
+type dsClient struct {
+	cfg *Config
+	sid string
+}
+
+// call posts a request to an endpoint of the DSM Web API and returns the data of its answer
+func (d *dsClient) call(ctx context.Context, endpoint string, params url.Values) (json.RawMessage, error) {
+	if d.sid != "" {
+		params.Set("_sid", d.sid)
+	}
+	u := strings.TrimSuffix(d.cfg.DSURL, "/") + "/webapi/" + endpoint
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", d.cfg.userAgent())
+	res, err := d.cfg.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, newStatusError(u, res)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	r := dsResponse{}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("decoding the answer of %s: %w", params.Get("api"), err)
+	}
+	if !r.Success {
+		return nil, fmt.Errorf("%s %s failed with code %d", params.Get("api"), params.Get("method"), r.Error.Code)
+	}
+	return r.Data, nil
+}
+
+// login opens a session of DS_ACCOUNT
+func (d *dsClient) login() error {
+	data, err := d.call(d.cfg.context(), "auth.cgi", url.Values{
+		"api":     {"SYNO.API.Auth"},
+		"version": {"3"},
+		"method":  {"login"},
+		"account": {d.cfg.DSAccount},
+		"passwd":  {d.cfg.DSPassword},
+		"session": {"DownloadStation"},
+		"format":  {"sid"},
+	})
+	if err != nil {
+		return fmt.Errorf("signing in to DSM as %s: %w, see DS_ACCOUNT and DS_PASSWORD", d.cfg.DSAccount, err)
+	}
+	var s struct {
+		SID string `json:"sid"`
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	d.sid = s.SID
+	return nil
+}
+
+// logout closes the session, even once the run is interrupted
+func (d *dsClient) logout() {
+	if _, err := d.call(context.Background(), "auth.cgi", url.Values{"api": {"SYNO.API.Auth"}, "version": {"1"}, "method": {"logout"}, "session": {"DownloadStation"}}); err != nil {
+		logDebug("Unable to sign out of DSM: ", err)
+	}
+}
+
+// task calls a method of the Download Station tasks
+func (d *dsClient) task(ctx context.Context, method string, params url.Values) (json.RawMessage, error) {
+	params.Set("api", "SYNO.DownloadStation.Task")
+	params.Set("version", "1")
+	params.Set("method", method)
+	return d.call(ctx, "DownloadStation/task.cgi", params)
+}
+
+// tasks returns the Download Station tasks of a URL
+func (d *dsClient) tasks(u string) ([]dsTask, error) {
+	data, err := d.task(d.cfg.context(), "list", url.Values{"additional": {"detail,transfer"}})
+	if err != nil {
+		return nil, err
+	}
+	var l struct {
+		Tasks []dsTask `json:"tasks"`
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, err
+	}
+	tasks := []dsTask{}
+	for _, t := range l.Tasks {
+		if t.Additional.Detail.URI == u {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks, nil
+}
+
+// remove deletes a task, keeping the file of a finished one, even once the run is interrupted
+func (d *dsClient) remove(t dsTask) {
+	if _, err := d.task(context.Background(), "delete", url.Values{"id": {t.ID}, "force_complete": {"false"}}); err != nil {
+		logWarn("Unable to remove the Download Station task: ", err)
+	}
+}
+
+// dsDestinationDir returns the local directory of the DS_DESTINATION shared folder, on any volume
+func dsDestinationDir(dest string) (string, error) {
+	dirs, err := filepath.Glob(filepath.Join("/volume*", dest))
+	if err != nil {
+		return "", err
+	}
+	if len(dirs) != 1 {
+		return "", fmt.Errorf("DS_DESTINATION %s: found %d shared folders of this name on the volumes", dest, len(dirs))
+	}
+	return dirs[0], nil
+}
+
+// downloadWithStation downloads a package with a Download Station task to a file, waiting for it to finish.
+// The task is removed once done, also when it fails, stalls for DOWNLOAD_STALL_TIMEOUT or the run is interrupted.
+func downloadWithStation(cfg *Config, u string, f string) error {
+	dir, err := dsDestinationDir(cfg.DSDestination)
+	if err != nil {
+		return err
+	}
+	d := &dsClient{cfg: cfg}
+	if err := d.login(); err != nil {
+		return err
+	}
+	defer d.logout()
+
+	// the tasks left by previous runs would be mistaken for the new one
+	old, err := d.tasks(u)
+	if err != nil {
+		return err
+	}
+	for _, t := range old {
+		d.remove(t)
+	}
+	if _, err := d.task(cfg.context(), "create", url.Values{"uri": {u}, "destination": {cfg.DSDestination}}); err != nil {
+		return err
+	}
+	logInfo("Downloading with Download Station to", cfg.DSDestination+": ", u)
+
+	var downloaded int64
+	progressed := time.Now()
+	for {
+		tasks, err := d.tasks(u)
+		if err != nil {
+			return err
+		}
+		if len(tasks) == 0 {
+			return errors.New("the Download Station task was removed")
+		}
+		t := tasks[0]
+		switch t.Status {
+		case "finished", "seeding":
+			d.remove(t)
+			logInfo("Download Station downloaded", formatBytes(t.Size))
+			return moveFile(filepath.Join(dir, t.Title), f)
+		case "error":
+			d.remove(t)
+			return fmt.Errorf("the Download Station task of %s failed", u)
+		}
+		if n := t.Additional.Transfer.Downloaded; n > downloaded {
+			downloaded, progressed = n, time.Now()
+			logDebug(fmt.Sprintf("Download Station task %s: %s, %s of %s", t.ID, t.Status, formatBytes(n), formatBytes(t.Size)))
+		}
+		if time.Since(progressed) > cfg.StallTimeout {
+			d.remove(t)
+			return fmt.Errorf("the Download Station task stalled, %s status and no data received for %s, see DOWNLOAD_STALL_TIMEOUT", t.Status, cfg.StallTimeout)
+		}
+		select {
+		case <-time.After(dsPollInterval):
+		case <-cfg.context().Done():
+			d.remove(t)
+			return fmt.Errorf("downloading %s: %s", u, cfg.interruption())
+		}
+	}
+}
+
+// downloadReleaseWithStation downloads a release with Download Station to its partial file, renamed once
+// its size and checksum are verified, and returns its path with its checksums
+func downloadReleaseWithStation(cfg *Config, r release, partial string, filePath string, size int64) (string, checksums, error) {
+	if err := downloadWithStation(cfg, r.URL, partial); err != nil {
+		return "", checksums{}, err
+	}
+	if n := fileSize(partial); n > cfg.MaxPackageSize {
+		os.Remove(partial)
+		return "", checksums{}, fmt.Errorf("downloading %s: %w, %s received, see MAX_PACKAGE_SIZE", r.URL, errPackageTooLarge, formatBytes(n))
+	} else if size >= 0 && n != size {
+		os.Remove(partial)
+		return "", checksums{}, fmt.Errorf("downloaded %d bytes instead of the %d announced", n, size)
+	}
+	sums, match, err := verifyChecksums(partial, r.Checksum)
+	if err != nil {
+		return "", checksums{}, err
+	}
+	if !match {
+		os.Remove(partial)
+		return "", checksums{}, errors.New("checksum mismatch, aborting")
+	}
+	logInfo("Checksum match")
+	if _, err := readPackage(partial); err != nil {
+		os.Remove(partial)
+		return "", checksums{}, err
+	}
+	if err := os.Rename(partial, filePath); err != nil {
+		return "", checksums{}, err
+	}
+	return filePath, sums, nil
+}
+
+// moveFile moves a file, copying it when on another volume
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
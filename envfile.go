@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const defaultEnvFile = ".env"
+
+// envFile is the .env file in use
+var envFile = defaultEnvFile
+
+// envFileFlag registers the .env file flag, which is read before the other flags
+func envFileFlag(fs *flag.FlagSet) {
+	fs.String("env-file", envFile, "file of KEY=value environment variables, not overriding the environment")
+}
+
+// parseEnvFile reads the KEY=value lines of a .env file
+func parseEnvFile(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var vars [][2]string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" || strings.ContainsAny(k, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, n)
+		}
+		value, err := unquote(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n, k, err)
+		}
+		vars = append(vars, [2]string{k, value})
+	}
+	return vars, scanner.Err()
+}
+
+// loadEnvFile sets the variables of the .env file given with --env-file, or of ./.env when it
+// exists, that are not set in the environment. It returns the variables set.
+func loadEnvFile(args []string) ([][2]string, error) {
+	path, explicit := flagArg(args, "env-file")
+	if !explicit {
+		path = defaultEnvFile
+	}
+	envFile = path
+	vars, err := parseEnvFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded [][2]string
+	for _, kv := range vars {
+		if _, set := os.LookupEnv(kv[0]); set {
+			continue
+		}
+		if err := os.Setenv(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, kv)
+	}
+	return loaded, nil
+}
+
+// logEnvFile logs the variables loaded from the .env file, masking the secrets
+func logEnvFile(loaded [][2]string) {
+	for _, kv := range loaded {
+		v := kv[1]
+		if isSecret(kv[0]) && v != "" {
+			v = maskSecret(v)
+		}
+		logDebug("Loaded from", envFile+":", kv[0]+"="+v)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// history results
+const (
+	resultSuccess    = "success"
+	resultFailed     = "failed"
+	resultRolledBack = "rolled back"
+)
+
+// historyRecord is a line of the history file describing an install performed by the updater
+type historyRecord struct {
+	Time        time.Time `json:"time"`
+	FromVersion string    `json:"from_version"`
+	ToVersion   string    `json:"to_version"`
+	Duration    float64   `json:"duration_seconds"`
+	Checksum    string    `json:"checksum,omitempty"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+	// Release is the version of the package as published, with the hash of its build
+	Release string `json:"release,omitempty"`
+}
+
+// historyFilePath returns the path of the history file
+func historyFilePath(dir string) string {
+	return filepath.Join(dir, "history.jsonl")
+}
+
+// appendHistory appends a record to the history file of a state directory
+func appendHistory(dir string, r historyRecord) error {
+	r.Error = redact(r.Error)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(historyFilePath(dir), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	j, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(j, '\n'))
+	return err
+}
+
+// readHistory returns the records of the history file, oldest first
+func readHistory(dir string) ([]historyRecord, error) {
+	f, err := os.Open(historyFilePath(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []historyRecord
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		r := historyRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", historyFilePath(dir), n, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// installedRelease returns the published version, with the hash of its build, of the installed version
+// as last installed by the updater, or an empty string when unknown
+func installedRelease(dir string, installedVersion string) string {
+	records, err := readHistory(dir)
+	if err != nil {
+		logDebug("Unable to read the history: ", err)
+		return ""
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		r := records[i]
+		if r.Result != resultFailed && r.ToVersion == installedVersion {
+			return r.Release
+		}
+	}
+	return ""
+}
+
+// installRecorded installs a package, records the outcome in the history and returns the installed version.
+// An empty fromVersion is the first install of the package, which has no service to stop.
+func installRecorded(cfg *Config, f string, fromVersion string, toVersion string, checksum string, rollback bool) (string, error) {
+	start := time.Now()
+	r := historyRecord{
+		Time:        start.UTC(),
+		FromVersion: fromVersion,
+		ToVersion:   toVersion,
+		Release:     toVersion,
+		Checksum:    checksum,
+		Result:      resultSuccess,
+	}
+	if rollback {
+		r.Result = resultRolledBack
+	}
+
+	if cfg.interrupted() {
+		return "", fmt.Errorf("not installing %s: %s", f, cfg.interruption())
+	}
+	info, err := cfg.checkPackage(f, toVersion)
+	if err != nil {
+		return "", err
+	}
+	// the install unpacks the package on the volume of PlexMediaServer, checked before stopping it
+	if volume, err := cfg.packageVolume(); err == nil {
+		if err := cfg.checkFreeSpace(volume, 2*fileSize(f), "install the package"); err != nil {
+			return "", err
+		}
+	}
+
+	if fromVersion == "" {
+		err = installPlex(cfg, f)
+	} else {
+		err = updatePlex(cfg, f)
+	}
+	updatedVersion := ""
+	if err == nil {
+		updatedVersion, err = getInstalledVersion(cfg)
+		r.ToVersion = updatedVersion
+	}
+	// synopkg may report the installed version without its build hash
+	if err == nil && !sameBuild(updatedVersion, info["version"]) {
+		err = fmt.Errorf("the installed version is %s instead of %s, the version of the package", updatedVersion, info["version"])
+	}
+	if err == nil {
+		checkIdentity(cfg, updatedVersion, true)
+	}
+	r.Duration = time.Since(start).Seconds()
+	if err != nil {
+		r.Result = resultFailed
+		r.Error = err.Error()
+	}
+
+	if herr := appendHistory(cfg.StateDir, r); herr != nil {
+		logWarn("Unable to record history: ", herr)
+	}
+	return updatedVersion, err
+}
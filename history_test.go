@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstallRecorded(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		reported string
+		err      string
+	}{
+		{"build reported", "1.40.0.7998-c29d4c0c8", ""},
+		{"build reported without its hash", "1.40.0.7998", ""},
+		{"other build", "1.40.0.7998-0a1b2c3d4", "the installed version is 1.40.0.7998-0a1b2c3d4 instead of 1.40.0.7998-c29d4c0c8"},
+		{"other version without its hash", "1.39.0.7000", "the installed version is 1.39.0.7000 instead of 1.40.0.7998-c29d4c0c8"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			fakeSynology(t, cfg)
+			t.Setenv("FAKE_SYNOPKG_VERSION", tc.reported)
+			f := filepath.Join(cfg.Dir, testPackageName)
+			if err := os.WriteFile(f, testPackage(t, testPackageInfo, []byte("payload")), 0644); err != nil {
+				t.Fatal(err)
+			}
+			v, err := installRecorded(cfg, f, "1.39.0.7000-a1b2c3d4e", "1.40.0.7998-c29d4c0c8", "", false)
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("got error %v, want %q", err, tc.err)
+			}
+			if v != tc.reported {
+				t.Errorf("installed version %q, want %q", v, tc.reported)
+			}
+			records, err := readHistory(cfg.StateDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := resultSuccess
+			if tc.err != "" {
+				want = resultFailed
+			}
+			if len(records) != 1 || records[0].Result != want {
+				t.Errorf("history %+v, want one %s record", records, want)
+			}
+		})
+	}
+}
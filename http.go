@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaults of the HTTP timeouts and retries
+const (
+	defaultHTTPTimeout          = 15 * time.Second
+	defaultDownloadStallTimeout = time.Minute
+	defaultRetryAttempts        = 3
+	defaultRetryDelay           = 2 * time.Second
+	defaultRetryAfterMax        = 5 * time.Minute
+)
+
+// transport returns the transport shared by the HTTP clients, created on first use
+func (c *Config) transport() *http.Transport {
+	if c.httpTransport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = c.proxy
+		t.DialContext = c.dialContext
+		t.TLSHandshakeTimeout = c.HTTPTimeout
+		t.ResponseHeaderTimeout = c.HTTPTimeout
+		if c.rootCAs != nil {
+			t.TLSClientConfig = &tls.Config{RootCAs: c.rootCAs}
+		}
+		c.httpTransport = t
+	}
+	return c.httpTransport
+}
+
+// resolver returns the resolver of the requests, querying DNS_SERVERS in order instead of the system resolver
+func (c *Config) resolver() *net.Resolver {
+	if len(c.DNSServers) == 0 {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: c.HTTPTimeout}
+			var err error
+			for _, s := range c.DNSServers {
+				var conn net.Conn
+				if conn, err = d.DialContext(ctx, network, dnsServerAddr(s)); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+}
+
+// dnsServerAddr returns the address of a DNS server, on port 53 unless given
+func dnsServerAddr(s string) string {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s
+	}
+	return net.JoinHostPort(s, "53")
+}
+
+// IP preferences
+const (
+	ipAuto = "auto"
+	ipV4   = "v4"
+	ipV6   = "v6"
+)
+
+// ipFamily returns the networks to resolve and to dial of an IP preference, with the name of its family
+func ipFamily(preference string) (string, string, string) {
+	switch preference {
+	case ipV4:
+		return "ip4", "tcp4", "IPv4"
+	case ipV6:
+		return "ip6", "tcp6", "IPv6"
+	}
+	return "ip", "tcp", ""
+}
+
+// dialContext resolves a host with the resolver of the requests, logging its addresses, and connects
+// to the first one answering, only over the IP family of IP_PREFERENCE when one is forced
+func (c *Config) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ipNetwork, tcpNetwork, family := ipFamily(c.IPPreference)
+	if family != "" {
+		network = tcpNetwork
+	}
+	d := &net.Dialer{Timeout: c.HTTPTimeout, KeepAlive: 30 * time.Second}
+	if net.ParseIP(host) != nil {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil && family != "" {
+			return nil, fmt.Errorf("connecting over %s only, see IP_PREFERENCE: %w", family, err)
+		}
+		return conn, err
+	}
+	ips, err := c.resolver().LookupIP(ctx, ipNetwork, host)
+	if err != nil {
+		if family != "" {
+			return nil, fmt.Errorf("resolving the %s addresses of %s, see IP_PREFERENCE: %w", family, host, err)
+		}
+		return nil, err
+	}
+	addrs := []string{}
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	logDebug("Resolved", host, "to", strings.Join(addrs, ", "))
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+		logDebug("Unable to connect to", ip.String()+": ", err)
+	}
+	if family != "" {
+		return nil, fmt.Errorf("connecting to %s over %s only, see IP_PREFERENCE: %w", host, family, err)
+	}
+	return nil, err
+}
+
+// loadCertificates reads the certificate authorities trusted by the requests: those of CA_BUNDLE
+// instead of the system ones, and those of EXTRA_CA_CERTS on top
+func (c *Config) loadCertificates() error {
+	if c.CABundle == "" && c.ExtraCACerts == "" {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if c.CABundle != "" {
+		if err := appendCertificates(pool, c.CABundle); err != nil {
+			return fmt.Errorf("CA_BUNDLE: %w", err)
+		}
+	} else {
+		p, err := x509.SystemCertPool()
+		if err != nil {
+			return fmt.Errorf("loading the system certificates: %w", err)
+		}
+		pool = p
+	}
+	if c.ExtraCACerts != "" {
+		if err := appendCertificates(pool, c.ExtraCACerts); err != nil {
+			return fmt.Errorf("EXTRA_CA_CERTS: %w", err)
+		}
+	}
+	c.rootCAs = pool
+	return nil
+}
+
+// appendCertificates adds the certificates of a PEM file to a pool, failing on any invalid one
+func appendCertificates(pool *x509.CertPool, f string) error {
+	rest, err := os.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s: certificate %d: %w", f, n+1, err)
+		}
+		pool.AddCert(cert)
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: no PEM certificate found", f)
+	}
+	logDebug("Trusting", n, "certificates of", f)
+	return nil
+}
+
+// proxy returns the proxy of a request: PROXY_URL unless NO_PROXY matches the host,
+// or else the one of HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+func (c *Config) proxy(req *http.Request) (*url.URL, error) {
+	var u *url.URL
+	var err error
+	if c.ProxyURL != "" && !noProxy(req.URL.Hostname()) {
+		u, err = url.Parse(c.ProxyURL)
+	} else if c.ProxyURL == "" {
+		u, err = http.ProxyFromEnvironment(req)
+	}
+	if u != nil {
+		c.proxyLogged.Do(func() { logInfo("Using proxy", u.Redacted(), "for", req.URL.Host) })
+	}
+	return u, err
+}
+
+// noProxy reports whether NO_PROXY excludes a host from PROXY_URL, by name, domain suffix or *
+func noProxy(host string) bool {
+	for _, p := range splitList(getenv("NO_PROXY", os.Getenv("no_proxy"))) {
+		p = strings.TrimPrefix(strings.TrimPrefix(p, "*"), ".")
+		if p == "" || host == p || strings.HasSuffix(host, "."+p) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpClient returns the client of the metadata requests, which time out after HTTP_TIMEOUT
+func (c *Config) httpClient() *http.Client {
+	return &http.Client{Transport: c.transport(), Timeout: c.HTTPTimeout}
+}
+
+// downloadClient returns the client of the downloads, which have no overall timeout: their
+// headers are bounded by HTTP_TIMEOUT and their body by the stall detector
+func (c *Config) downloadClient() *http.Client {
+	return &http.Client{Transport: c.transport()}
+}
+
+// isTimeout reports whether an error is a timeout of a request
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()
+}
+
+// retryable reports whether a failed request may succeed when retried: all but the 4xx statuses other
+// than 429 Too Many Requests, the cancellations and the oversized downloads
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, errNoRanges) && !errors.Is(err, errPackageTooLarge)
+}
+
+// backoff returns the delay before a retry, doubling the delay at every attempt with up to 50% of jitter
+func backoff(delay time.Duration, attempt int) time.Duration {
+	d := delay << (attempt - 1)
+	if d <= 0 {
+		return 0
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// retry calls f until it succeeds, fails with an error that is not retryable or RETRY_ATTEMPTS is reached,
+// logging every retry with its reason, or the run is interrupted. A rate limited request is retried after
+// its Retry-After delay, up to RETRY_AFTER_MAX, and returns a rateLimitedError when still rate limited at the
+// last attempt or when the run would time out first.
+func (c *Config) retry(what string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !retryable(err) || c.interrupted() {
+			return err
+		}
+		var se *statusError
+		limited := errors.As(err, &se) && se.code == http.StatusTooManyRequests
+		if attempt >= c.RetryAttempts {
+			if limited {
+				return &rateLimitedError{err, se.retryAfter}
+			}
+			return err
+		}
+		d := backoff(c.RetryDelay, attempt)
+		if se != nil && se.retryAfter > 0 {
+			d = se.retryAfter
+			if d > c.RetryAfterMax {
+				d = c.RetryAfterMax
+			}
+			if deadline, ok := c.context().Deadline(); ok && time.Now().Add(d).After(deadline) {
+				return &rateLimitedError{err, se.retryAfter}
+			}
+		}
+		logWarn(fmt.Sprintf("Attempt %d/%d of %s failed, retrying in %s: %v", attempt, c.RetryAttempts, what, d.Round(time.Millisecond), err))
+		select {
+		case <-time.After(d):
+		case <-c.context().Done():
+			return err
+		}
+	}
+}
+
+// statusError is returned when a request is not answered 200 OK
+type statusError struct {
+	url        string
+	status     string
+	code       int
+	retryAfter time.Duration
+}
+
+// newStatusError returns the error of a response, with the delay of its Retry-After header
+func newStatusError(u string, res *http.Response) *statusError {
+	return &statusError{u, res.Status, res.StatusCode, parseRetryAfter(res.Header.Get("Retry-After"), time.Now())}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("fetching %s: %s", e.url, e.status)
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, in seconds or an HTTP date, 0 when absent or invalid
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s < 0 {
+			return 0
+		}
+		return time.Duration(s) * time.Second
+	}
+	t, err := http.ParseTime(v)
+	if err != nil || !t.After(now) {
+		return 0
+	}
+	return t.Sub(now)
+}
+
+// rateLimitedError is returned when a server rate limits the requests for longer than the run may last
+type rateLimitedError struct {
+	err   error
+	retry time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	if e.retry <= 0 {
+		return fmt.Sprintf("%v: rate limited, will retry next run", e.err)
+	}
+	return fmt.Sprintf("%v: rate limited, will retry next run, asked to wait %s", e.err, e.retry)
+}
+
+func (e *rateLimitedError) Unwrap() error {
+	return e.err
+}
+
+// remoteFile describes the file at a URL as announced to a HEAD request
+type remoteFile struct {
+	size     int64 // -1 when unknown
+	modified string
+	ranges   bool
+}
+
+// head returns the description of the file at a URL, of unknown size when the server does not answer HEAD requests
+func (c *Config) head(u string) remoteFile {
+	f := remoteFile{size: -1}
+	req, err := http.NewRequestWithContext(c.context(), http.MethodHead, u, nil)
+	if err != nil {
+		return f
+	}
+	req.Header.Set("User-Agent", c.userAgent())
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		logDebug("HEAD request failed for", u+": ", err)
+		return f
+	}
+	res.Body.Close()
+	logDebug("HTTP status: ", res.Status, "for HEAD", u)
+	if res.StatusCode != http.StatusOK {
+		return f
+	}
+	f.size = res.ContentLength
+	f.modified = res.Header.Get("Last-Modified")
+	f.ranges = res.Header.Get("Accept-Ranges") == "bytes"
+	return f
+}
+
+// httpGet performs a GET request identifying the updater
+func httpGet(cfg *Config, client *http.Client, url string) (*http.Response, error) {
+	return httpGetHeader(cfg, client, url, nil)
+}
+
+// httpGetHeader performs a GET request identifying the updater with extra headers, a 304 Not Modified
+// answering a conditional request is not an error
+func httpGetHeader(cfg *Config, client *http.Client, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(cfg.context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("User-Agent", cfg.userAgent())
+	res, err := client.Do(req)
+	if isTimeout(err) && !cfg.interrupted() {
+		return nil, fmt.Errorf("fetching %s: timed out, see HTTP_TIMEOUT: %w", url, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logDebug("HTTP status: ", res.Status, "for", url)
+	conditional := header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != ""
+	if res.StatusCode != http.StatusOK && (res.StatusCode != http.StatusNotModified || !conditional) {
+		res.Body.Close()
+		return nil, newStatusError(url, res)
+	}
+	return res, nil
+}
+
+// stallReader cancels a download when no data was received for timeout
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+// newStallReader returns a stall reader calling cancel once the download stalls
+func newStallReader(r io.Reader, timeout time.Duration, cancel func()) *stallReader {
+	s := &stallReader{r: r, timeout: timeout}
+	s.timer = time.AfterFunc(timeout, func() {
+		s.stalled.Store(true)
+		cancel()
+	})
+	return s
+}
+
+func (s *stallReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	if err != nil && err != io.EOF && s.stalled.Load() {
+		err = fmt.Errorf("download stalled, no data received for %s, see DOWNLOAD_STALL_TIMEOUT", s.timeout)
+	}
+	return n, err
+}
+
+// stop stops watching the download
+func (s *stallReader) stop() {
+	s.timer.Stop()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testDownloadsJSON returns a downloads JSON of a version publishing releases for DSM 7
+func testDownloadsJSON(t *testing.T, version string, releases ...release) []byte {
+	t.Helper()
+	b, err := json.Marshal(map[string]interface{}{
+		"nas": map[string]interface{}{
+			"Synology (DSM 7)": synologyPlatform{Version: version, Releases: releases},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUserAgent(t *testing.T) {
+	pkg := testPackage(t, testPackageInfo, []byte("payload"))
+	var mu sync.Mutex
+	agents := map[string]string{}
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/5.json", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents["json"] = r.UserAgent()
+		mu.Unlock()
+		w.Write(testDownloadsJSON(t, "1.40.0.7998-c29d4c0c8", release{
+			Build:    "linux-x86_64",
+			Distro:   defaultDistro,
+			URL:      srv.URL + "/" + testPackageName,
+			Checksum: fmt.Sprintf("%x", sha1.Sum(pkg)),
+		}))
+	})
+	mux.HandleFunc("/"+testPackageName, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents[r.Method] = r.UserAgent()
+		mu.Unlock()
+		servePackage(pkg).ServeHTTP(w, r)
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name      string
+		userAgent string
+		want      func(string) bool
+	}{
+		{"default", "", func(ua string) bool {
+			return strings.HasPrefix(ua, "synology-plex-updater/") && strings.Contains(ua, " (linux-x86_64; DSM ")
+		}},
+		{"USER_AGENT", "my-proxy-tag/1.0", func(ua string) bool { return ua == "my-proxy-tag/1.0" }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agents = map[string]string{}
+			cfg := testConfig(t)
+			cfg.UserAgent = tc.userAgent
+			cfg.DownloadsURL = srv.URL + "/5.json"
+			p, err := getPlexInfo(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := selectRelease(p, cfg.BuildType, cfg.Distro)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := downloadPlexRelease(cfg, cfg.Dir, r); err != nil {
+				t.Fatal(err)
+			}
+			for _, request := range []string{"json", http.MethodHead, http.MethodGet} {
+				ua, ok := agents[request]
+				if !ok {
+					t.Errorf("no %s request", request)
+					continue
+				}
+				if !tc.want(ua) {
+					t.Errorf("User-Agent of the %s request: %q", request, ua)
+				}
+			}
+		})
+	}
+}
+
+func TestUserAgentFollowsBuildType(t *testing.T) {
+	cfg := &Config{BuildType: "auto"}
+	before := cfg.userAgent()
+	cfg.BuildType = "linux-aarch64"
+	if after := cfg.userAgent(); after == before || !strings.Contains(after, "(linux-aarch64; ") {
+		t.Errorf("User-Agent %q once the build type is resolved, was %q", after, before)
+	}
+}
+
+func TestHTTPGetHeaderNotModified(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+	cfg := testConfig(t)
+
+	// a 304 only answers a conditional request
+	if _, err := httpGet(cfg, cfg.httpClient(), srv.URL); err == nil {
+		t.Error("304 Not Modified accepted for an unconditional request")
+	}
+	res, err := httpGetHeader(cfg, cfg.httpClient(), srv.URL, http.Header{"If-None-Match": {`"v1"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("status %d, want 304", res.StatusCode)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultPlexPort is the port Plex Media Server listens on
+const defaultPlexPort = 32400
+
+// defaultIdentityTimeout bounds a request of the /identity API
+const defaultIdentityTimeout = 5 * time.Second
+
+// identityStartWait is how long a server just started is given to answer the /identity API
+const identityStartWait = 2 * time.Minute
+
+// identityPollInterval is the time between two requests of the /identity API of a server starting
+const identityPollInterval = 5 * time.Second
+
+// plexIdentity is the answer of the /identity API of Plex Media Server
+type plexIdentity struct {
+	Version string `xml:"version,attr"`
+}
+
+// runningVersion returns the version of the server running on the NAS, as reported by its /identity API
+func runningVersion(ctx context.Context, cfg *Config) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.IdentityTimeout)
+	defer cancel()
+	u := fmt.Sprintf("http://127.0.0.1:%d/identity", cfg.PlexPort)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	// the default transport does not proxy the loopback address
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", newStatusError(u, res)
+	}
+	id := plexIdentity{}
+	if err := xml.NewDecoder(res.Body).Decode(&id); err != nil {
+		return "", fmt.Errorf("decoding the answer of %s: %w", u, err)
+	}
+	if id.Version == "" {
+		return "", fmt.Errorf("no version in the answer of %s", u)
+	}
+	return id.Version, nil
+}
+
+// checkIdentity warns when the version of the running server differs from the version of the
+// package reported by synopkg, with IDENTITY_CHECK. A server just started is waited for.
+func checkIdentity(cfg *Config, installed string, started bool) {
+	if !cfg.IdentityCheck {
+		return
+	}
+	deadline := time.Now().Add(identityStartWait)
+	for {
+		v, err := runningVersion(cfg.context(), cfg)
+		if err == nil {
+			if !strings.EqualFold(v, installed) {
+				logWarn(fmt.Sprintf("VERSION MISMATCH: the running Plex Media Server is version %s, synopkg reports version %s", v, installed))
+				return
+			}
+			logInfo("Running version: ", v)
+			return
+		}
+		if !started || time.Now().After(deadline) || cfg.interrupted() {
+			logWarn(fmt.Sprintf("Plex not responding on port %d, unable to check the running version: %v", cfg.PlexPort, err))
+			return
+		}
+		logDebug("Waiting for Plex to respond: ", err)
+		select {
+		case <-time.After(identityPollInterval):
+		case <-cfg.context().Done():
+		}
+	}
+}
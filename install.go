@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// checkPackageFile returns an error when a file is not readable or does not look like a .spk package
+func checkPackageFile(f string) error {
+	if !strings.EqualFold(filepath.Ext(f), ".spk") {
+		return fmt.Errorf("%s: not a .spk package", f)
+	}
+
+	file, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// spk packages are tar archives, check the ustar magic of the first header
+	header := make([]byte, 512)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return fmt.Errorf("%s: %w: %v", f, errInvalidPackage, err)
+	}
+	if !bytes.HasPrefix(header[257:], []byte("ustar")) {
+		return fmt.Errorf("%s: %w: missing tar header", f, errInvalidPackage)
+	}
+	return nil
+}
+
+// checkDowngrade returns an error when installing a version older than the installed one is not allowed
+func checkDowngrade(installedVersion string, v string, allowDowngrade bool) error {
+	cmp, err := compareVersions(installedVersion, v)
+	if err != nil || cmp <= 0 {
+		return err
+	}
+	if !allowDowngrade {
+		return fmt.Errorf("refusing to downgrade from %s to %s, use --allow-downgrade", installedVersion, v)
+	}
+	logWarn("DOWNGRADING PlexMediaServer from", installedVersion, "to", v)
+	return nil
+}
+
+// installOptions controls how a package file is verified and installed
+type installOptions struct {
+	cfg            *Config
+	checksum       string
+	allowDowngrade bool
+	dryRun         bool
+	assumeYes      bool
+	rollback       bool
+	// removeAfterInstall deletes the package once installed, for packages downloaded by the updater
+	removeAfterInstall bool
+}
+
+// installPackageFile verifies and installs a local package file, recording the outcome in the report
+func installPackageFile(f string, o installOptions, rep *report) error {
+	if err := checkPackageFile(f); err != nil {
+		return err
+	}
+	rep.File = f
+
+	// the manifest is preferred, it also records the sha256 checksum
+	m, ok, err := readManifest(f)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if o.checksum != "" && !strings.EqualFold(o.checksum, m.SHA1) {
+			return fmt.Errorf("checksum %s does not match the one of the manifest %s, aborting", o.checksum, manifestPath(f))
+		}
+		logInfo("Verifying against manifest: ", manifestPath(f))
+		if err := verifyManifest(f, m); err != nil {
+			return fmt.Errorf("manifest verification failed, aborting: %w", err)
+		}
+		logInfo("Manifest match")
+		rep.Checksum = m.SHA1
+	} else if o.checksum != "" {
+		match, err := verifyChecksum(f, o.checksum)
+		if err != nil {
+			return err
+		}
+		if !match {
+			return errors.New("checksum mismatch, aborting")
+		}
+		logInfo("Checksum match")
+		rep.Checksum = o.checksum
+	}
+	if _, err := readPackage(f); err != nil {
+		return err
+	}
+
+	installedVersion, err := getInstalledVersion(o.cfg)
+	if err != nil {
+		return err
+	}
+	rep.InstalledVersion = installedVersion
+	logInfo("Installed version: ", installedVersion)
+	if v, ok := packageFileVersion(f); ok {
+		logInfo("Package version: ", v)
+		rep.LatestVersion = v
+		if err := checkDowngrade(installedVersion, v, o.allowDowngrade); err != nil {
+			return err
+		}
+	}
+
+	if o.dryRun {
+		logInfo("[dry-run] Would run: ", o.cfg.Synopkg, "stop", o.cfg.PackageName)
+		logInfo("[dry-run] Would run: ", o.cfg.Synopkg, "install", f)
+		logInfo("[dry-run] Would run: ", o.cfg.Synopkg, "start", o.cfg.PackageName)
+		return nil
+	}
+
+	if !confirm(fmt.Sprintf("Install %s (installed %s)? PlexMediaServer will be stopped.", filepath.Base(f), installedVersion), o.assumeYes) {
+		logNotice("Install cancelled, package left in place: ", f)
+		return nil
+	}
+
+	updatedVersion, err := installRecorded(o.cfg, f, installedVersion, rep.LatestVersion, rep.Checksum, o.rollback)
+	if err != nil {
+		return err
+	}
+	logNotice("Updated version: ", updatedVersion)
+	rep.InstalledVersion = updatedVersion
+	rep.Action = actionInstalled
+	if o.removeAfterInstall {
+		removeInstalledPackage(f, updatedVersion, rep.LatestVersion)
+	}
+	return nil
+}
+
+// removeInstalledPackage deletes a package and its manifest once the installed version is the one of the
+// package, a package that failed to install is kept so a retry does not download it again
+func removeInstalledPackage(f string, installedVersion string, packageVersion string) {
+	if packageVersion == "" || coreVersion(installedVersion) != coreVersion(packageVersion) {
+		logWarn("Keeping the package, the installed version", installedVersion, "is not the one of", f)
+		return
+	}
+	for _, p := range []string{f, manifestPath(f)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			logWarn("Unable to remove the installed package: ", err)
+			return
+		}
+	}
+	logInfo("Removed the installed package: ", f)
+}
+
+// installFromURL downloads a package from an arbitrary URL, verifies its checksum and installs it
+func installFromURL(rawURL string, o installOptions, rep *report) error {
+	if o.checksum == "" {
+		return errors.New("refusing to install an unverified URL, --checksum is required")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	v, ok := packageFileVersion(path.Base(u.Path))
+	if !ok {
+		return fmt.Errorf("unable to derive the package version from the URL: %s", rawURL)
+	}
+	logInfo("Package version: ", v)
+	rep.LatestVersion = v
+
+	installedVersion, err := getInstalledVersion(o.cfg)
+	if err != nil {
+		return err
+	}
+	rep.InstalledVersion = installedVersion
+	if err := checkDowngrade(installedVersion, v, o.allowDowngrade); err != nil {
+		return err
+	}
+
+	r := release{URL: rawURL, Checksum: o.checksum}
+	if o.dryRun {
+		return dryRunUpdate(o.cfg, o.cfg.Dir, r)
+	}
+	fp, err := downloadWithManifest(o.cfg, o.cfg.Dir, v, r)
+	if err != nil {
+		return err
+	}
+	rep.Action = actionDownloaded
+	o.checksum = ""
+	return installPackageFile(fp, o, rep)
+}
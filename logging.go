@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logLevel is the severity of a log message
+type logLevel int
+
+// log levels, notice is used for the outcome of a run
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelNotice
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "notice", "warn", "error"}
+
+// currentLogLevel is the minimum level of the messages logged
+var currentLogLevel = levelInfo
+
+// String returns the name of a log level
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel parses the name of a log level
+func parseLogLevel(s string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(s, n) {
+			return logLevel(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return levelWarn, nil
+	}
+	return levelInfo, fmt.Errorf("invalid log level %q, expected one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+// getenvLogLevel returns the log level of an environment variable or a default value
+func getenvLogLevel(key string, fallback logLevel) logLevel {
+	value := getenv(key, "")
+	if value == "" {
+		return fallback
+	}
+	l, err := parseLogLevel(value)
+	if err != nil {
+		invalidSetting("invalid log level for %s: %q", key, value)
+		return fallback
+	}
+	return l
+}
+
+// logLevelFlag is a boolean flag switching to a log level when given
+type logLevelFlag logLevel
+
+func (f logLevelFlag) String() string {
+	return strconv.FormatBool(currentLogLevel == logLevel(f))
+}
+
+func (f logLevelFlag) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if b {
+		currentLogLevel = logLevel(f)
+	}
+	return nil
+}
+
+func (f logLevelFlag) IsBoolFlag() bool { return true }
+
+// logLevelFlags registers the flags changing the log level, overriding LOG_LEVEL
+func logLevelFlags(fs *flag.FlagSet) {
+	fs.Var(logLevelFlag(levelNotice), "quiet", "only log warnings, errors and the outcome (env LOG_LEVEL=notice)")
+	fs.Var(logLevelFlag(levelDebug), "debug", "also log commands, HTTP statuses and timings (env LOG_LEVEL=debug)")
+}
+
+// logLevelArgs applies the log level flags in args before the flag sets are parsed
+func logLevelArgs(args []string) {
+	for _, a := range args {
+		if a == "--" {
+			break
+		}
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		switch strings.TrimLeft(a, "-") {
+		case "quiet":
+			currentLogLevel = levelNotice
+		case "debug":
+			currentLogLevel = levelDebug
+		}
+	}
+}
+
+// logAt logs a message when its level is enabled
+func logAt(l logLevel, v ...interface{}) {
+	if l < currentLogLevel {
+		return
+	}
+	switch l {
+	case levelDebug:
+		v = append([]interface{}{"DEBUG:"}, v...)
+	case levelWarn:
+		v = append([]interface{}{"WARNING:"}, v...)
+	case levelError:
+		v = append([]interface{}{"Error:"}, v...)
+	}
+	log.Output(3, fmt.Sprintln(v...))
+}
+
+// logDebug logs the details useful to troubleshoot a run
+func logDebug(v ...interface{}) { logAt(levelDebug, v...) }
+
+// logInfo logs the progress of a run
+func logInfo(v ...interface{}) { logAt(levelInfo, v...) }
+
+// logNotice logs the outcome of a run
+func logNotice(v ...interface{}) { logAt(levelNotice, v...) }
+
+// logWarn logs an unexpected condition that does not stop the run
+func logWarn(v ...interface{}) { logAt(levelWarn, v...) }
+
+// logError logs an error
+func logError(v ...interface{}) { logAt(levelError, v...) }
+
+// commandOutput runs a command and returns its standard output, logging its command line. The command
+// is killed once ctx is done.
+func commandOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	logDebug("Running:", strings.Join(append([]string{name}, args...), " "))
+	cmd := exec.CommandContext(ctx, name, args...)
+	// the children of a killed command may keep its output open
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if err != nil && ctx.Err() != nil {
+		reason := "interrupted"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = "timed out, see RUN_TIMEOUT"
+		}
+		return out, fmt.Errorf("%s: %s", strings.Join(append([]string{name}, args...), " "), reason)
+	}
+	if err != nil {
+		logDebug("Command failed:", name, err)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(bytes.TrimSpace(exitErr.Stderr)) > 0 {
+			err = fmt.Errorf("%s: %w: %s", name, err, bytes.TrimSpace(exitErr.Stderr))
+		}
+	}
+	return out, err
+}
@@ -1,26 +1,35 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
-	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+)
 
-	"github.com/hashicorp/go-version"
+const (
+	SYNPKG        = "/usr/syno/bin/synopkg"
+	SYNOTIFY      = "/usr/syno/synobin/synonotify"
+	SYNOTIFY6     = "/usr/syno/bin/synonotify"
+	SYNOWEBAPI    = "/usr/syno/bin/synowebapi"
+	SYNOSCHEDTASK = "/usr/syno/bin/synoschedtask"
+	SYNURL        = "https://plex.tv/api/downloads/5.json"
+	RELEASESURL   = "https://api.github.com/repos/tonyskapunk/synology-plex-updater/releases/latest"
 )
 
+// exit codes
 const (
-	SYNPKG = "/usr/syno/bin/synopkg"
-	SYNOTIFY = "/usr/syno/synobin/synonotify"
-	SYNURL   = "https://plex.tv/api/downloads/5.json"
+	exitOK              = 0
+	exitError           = 1
+	exitUpdateAvailable = 2
+	// exitUnknownBuildType is returned when no release matches BUILD_TYPE
+	exitUnknownBuildType = 3
+	// exitNotInstalled is returned when PlexMediaServer is not installed
+	exitNotInstalled = 4
+	exitTimeout      = 124
+	exitInterrupted  = 130
 )
 
 type release struct {
@@ -31,237 +40,129 @@ type release struct {
 	Checksum string `json:"checksum"`
 }
 
-type synologyDSM7 struct {
-	Version  string    `json:"version"`
-	Releases []release `json:"releases"`
+// synologyPlatform is the section of a DSM version in the downloads JSON
+type synologyPlatform struct {
+	Version     string    `json:"version"`
+	ReleaseDate int64     `json:"release_date"`
+	ItemsAdded  string    `json:"items_added"`
+	ItemsFixed  string    `json:"items_fixed"`
+	Releases    []release `json:"releases"`
 }
 
 type nas struct {
-	synologyDSM7 `json:"Synology (DSM 7)"`
+	DSM7 synologyPlatform `json:"Synology (DSM 7)"`
+	DSM6 synologyPlatform `json:"Synology"`
 }
 
 type plex struct {
 	Nas nas `json:"nas"`
+	// platform is the section of the DSM version of the NAS
+	platform synologyPlatform
+	// plexPass are the releases of the platform labeled as needing Plex Pass, left out on the public channel
+	plexPass []release
 }
 
+// getenv returns the value of an environment variable, or of the config file, or the fallback when unset
 func getenv(key, fallback string) string {
-	value := os.Getenv(key)
+	value := setting(key)
 	if len(value) == 0 {
 		return fallback
 	}
 	return value
 }
 
-func main() {
-	// build types:
-	// linux-x86
-	// linux-x86_64
-	// linux-armv7hf_neon
-	// linux-aarch64
-	// linux-ppc64le
-	buildType := getenv("BUILD_TYPE", "linux-x86_64")
-	log.Println("Synology Plex Updater - PlexMediaServer for NAS (DSM7)")
-
-	installedVersion := getInstalledVersion()
-	log.Println("Installed version: ", installedVersion)
-
-	p := getPlexInfo()
-	plexVersion := p.Nas.synologyDSM7.Version
-	log.Println("Latest version: ", plexVersion)
+// invalidSettings are the values of the typed settings that failed to parse, reported by Config.Validate
+// once the flags are parsed, the fallback being used until then
+var invalidSettings []error
 
-	var rel release
-	for _, r := range p.Nas.synologyDSM7.Releases {
-		if r.Build == buildType {
-			rel = r
-			break
-		}
-	}
-
-	iv := strings.Split(installedVersion, "-")[0]
-	uv := strings.Split(plexVersion, "-")[0]
-	vi, err := version.NewVersion(iv)
-	if err != nil {
-		log.Fatal(err)
-	}
-	vu, err := version.NewVersion(uv)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if vi.LessThan(vu) {
-		log.Println("New version available: ", uv)
-		sendNotification("PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater detected a new version: "+uv)
-		fp := downloadPlexRelease("./", rel)
-
-		updatePlex(fp)
-		updatedVersion := getInstalledVersion()
-		log.Println("Updated version: ", updatedVersion)
-		sendNotification("PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater has updated PlexMediaServer to version: "+updatedVersion)
-	} else {
-		log.Println("No new version available")
-	}
-}
-
-// getInstalledVersion returns the installed version of plex
-func getInstalledVersion() string {
-	out, err := exec.Command(SYNPKG, "version", "PlexMediaServer").Output()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return strings.Split(string(out), "\n")[0]
+// invalidSetting records a value of a typed setting that failed to parse
+func invalidSetting(format string, key string, value string) {
+	invalidSettings = append(invalidSettings, fmt.Errorf(format, key, value))
 }
 
-// getPlexInfo returns a plex struct
-func getPlexInfo() plex {
-	p := plex{}
-
-	cmd := exec.Command("curl", "-s", SYNURL)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := json.NewDecoder(stdout).Decode(&p); err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+// getenvBool returns the boolean value of an environment variable or the fallback when unset
+func getenvBool(key string, fallback bool) bool {
+	value := setting(key)
+	if len(value) == 0 {
+		return fallback
 	}
-
-	return p
-}
-
-// checksumFile returns the sha1 checksum of a file
-func checksumFile(f string) string {
-	file, err := os.Open(f)
+	b, err := strconv.ParseBool(value)
 	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-
-	hash := sha1.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		log.Fatal(err)
+		invalidSetting("invalid boolean value for %s: %q", key, value)
+		return fallback
 	}
-
-	return fmt.Sprintf("%x", hash.Sum(nil))
+	return b
 }
 
-// downloadPlexRelease downloads a plex release and returns the path to the downloaded file
-func downloadPlexRelease(dir string, r release) string {
-	// check if targe directory already exists
-	_, err := os.Stat(dir)
-	if os.IsNotExist(err) {
-		log.Fatal(err)
-	}
-
-	// Parse URL to get filename
-	u, err := url.Parse(r.URL)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fileName := path.Base(u.Path)
-	filePath := filepath.Join(dir, fileName)
-
-	// check if file already exists
-	_, err = os.Stat(filePath)
-	if !os.IsNotExist(err) {
-		log.Println("File already exists: ", filePath)
-		log.Println("URL: ", r.URL)
-
-		// check if checksum matches, otherwise delete the local file
-		checksum := checksumFile(filePath)
-		log.Println("Calculated checksum: ", checksum)
-		log.Println("Expected checksum: ", r.Checksum)
-		if checksum != r.Checksum {
-			log.Println("Checksum mismatch, forcing download")
-			err := os.Remove(filePath)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			log.Println("Checksum match")
-			return filePath
-		}
+// getenvDuration returns the duration value of an environment variable or the fallback when unset
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value := setting(key)
+	if len(value) == 0 {
+		return fallback
 	}
-
-	// Create and Download the file
-	out, err := os.Create(filePath)
+	d, err := time.ParseDuration(value)
 	if err != nil {
-		log.Fatal(err)
-	}
-	defer out.Close()
-
-	log.Println("Downloading: ", r.URL)
-	res, err := http.Get(r.URL)
-	if err != nil {
-		log.Fatal(err)
+		invalidSetting("invalid duration value for %s: %q", key, value)
+		return fallback
 	}
-	defer res.Body.Close()
+	return d
+}
 
-	if res.StatusCode != http.StatusOK {
-		log.Fatal(res.Status)
+// getenvInt returns the integer value of an environment variable or the fallback when unset
+func getenvInt(key string, fallback int) int {
+	value := setting(key)
+	if len(value) == 0 {
+		return fallback
 	}
-
-	_, err = io.Copy(out, res.Body)
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Verify checksum
-	checksum := checksumFile(filePath)
-	log.Println("Size: ", res.ContentLength, "bytes")
-	log.Println("Calculated checksum: ", checksum)
-	log.Println("Expected checksum: ", r.Checksum)
-
-	if checksum != r.Checksum {
-		log.Fatal("Checksum mismatch, aborting...")
+		invalidSetting("invalid integer value for %s: %q", key, value)
+		return fallback
 	}
-
-	return filePath
+	return n
 }
 
-// updatePlexPackage updates the plex package
-func updatePlex(f string) {
-	log.Println("Stopping PlexMediaServer service")
-	out, err := exec.Command(SYNPKG, "stop", "PlexMediaServer").Output()
-	if err != nil {
-		log.Fatal(err)
+// getenvSize returns the size value of an environment variable, such as 2GB, or the fallback when unset
+func getenvSize(key string, fallback int64) int64 {
+	value := setting(key)
+	if len(value) == 0 {
+		return fallback
 	}
-	log.Println(strings.Split(string(out), "\n")[0])
-
-	log.Println("Updating PlexMediaServer package")
-	out, err = exec.Command(SYNPKG, "install", f).Output()
+	n, err := parseSize(value)
 	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println(strings.Split(string(out), "\n")[0])
-
-	log.Println("Starting PlexMediaServer service")
-	out, err = exec.Command(SYNPKG, "start", "PlexMediaServer").Output()
-	if err != nil {
-		log.Fatal(err)
+		invalidSetting("invalid size value for %s: %q", key, value)
+		return fallback
 	}
-	log.Println(strings.Split(string(out), "\n")[0])
-
-	log.Println("PlexMediaServer package updated successfully")
+	return n
 }
 
-// sendNotification sends a notification of a particular tag to the Synology Notification Center
-func sendNotification(tag string, template string, msg string) {
-	j, err := json.Marshal(map[string]interface{}{
-		"%" + strings.ToUpper(template) + "%": msg,
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
+// knownBuildTypes are the build types published for Synology, run list-builds for the current ones
+var knownBuildTypes = []string{
+	"linux-x86",
+	"linux-x86_64",
+	"linux-armv7hf_neon",
+	"linux-aarch64",
+	"linux-ppc64le",
+}
 
-	log.Println("Sending notification: ", SYNOTIFY, tag, string(j))
-	out, err := exec.Command(SYNOTIFY, tag, string(j)).Output()
+func main() {
+	log.SetOutput(redactWriter{os.Stderr})
+	loaded, err := loadEnvFile(os.Args[1:])
 	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("Notification sent: ", strings.Split(string(out), "\n")[0])
+		exitFailed(err)
+	}
+	if err := loadConfig(os.Args[1:]); err != nil {
+		exitFailed(err)
+	}
+	currentLogLevel = getenvLogLevel("LOG_LEVEL", levelInfo)
+	logLevelArgs(os.Args[1:])
+	logEnvFile(loaded)
+	cfg := newConfig()
+	cfg.handleSignals()
+	exitInvalid(cfg.loadCertificates())
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		runCommand(cfg, os.Args[1], os.Args[2:])
+		return
+	}
+	runUpdate(cfg, os.Args[1:])
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// manifest describes a downloaded package so it can be verified before being installed elsewhere.
+// SHA256 and Downloaded are missing from the manifests of older versions.
+type manifest struct {
+	Version    string    `json:"version"`
+	Build      string    `json:"build"`
+	URL        string    `json:"url"`
+	SHA1       string    `json:"sha1"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Size       int64     `json:"size"`
+	Downloaded time.Time `json:"downloaded"`
+}
+
+// manifestPath returns the path of the manifest of a package file
+func manifestPath(f string) string {
+	return f + ".json"
+}
+
+// writeManifest writes the manifest of a package file verified against the sha1 checksum of its release
+// next to it, with the checksums calculated while verifying it
+func writeManifest(f string, v string, r release, sums checksums) error {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sums.sha1, r.Checksum) {
+		return fmt.Errorf("%s: checksum %s instead of %s, not writing its manifest", f, sums.sha1, r.Checksum)
+	}
+	m := manifest{
+		Version:    v,
+		Build:      r.Build,
+		URL:        r.URL,
+		SHA1:       sums.sha1,
+		SHA256:     sums.sha256,
+		Size:       fi.Size(),
+		Downloaded: time.Now().UTC().Truncate(time.Second),
+	}
+
+	j, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(manifestPath(f), append(j, '\n'), 0644); err != nil {
+		return err
+	}
+	logInfo("Manifest written: ", manifestPath(f))
+	return nil
+}
+
+// readManifest returns the manifest of a package file, if there is one
+func readManifest(f string) (manifest, bool, error) {
+	m := manifest{}
+	j, err := os.ReadFile(manifestPath(f))
+	if os.IsNotExist(err) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	if err := json.Unmarshal(j, &m); err != nil {
+		return m, false, fmt.Errorf("%s: %w", manifestPath(f), err)
+	}
+	return m, true, nil
+}
+
+// verifyManifest checks a package file against its manifest, and its sha256 checksum when recorded
+func verifyManifest(f string, m manifest) error {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return err
+	}
+	if m.Size > 0 && fi.Size() != m.Size {
+		return fmt.Errorf("size mismatch: manifest %d bytes, file %d bytes", m.Size, fi.Size())
+	}
+	sums, match, err := verifyChecksums(f, m.SHA1)
+	if err != nil {
+		return err
+	}
+	if !match {
+		return errors.New("checksum mismatch")
+	}
+	if m.SHA256 != "" {
+		logInfo("Calculated sha256 checksum: ", sums.sha256)
+		logInfo("Expected sha256 checksum: ", m.SHA256)
+		if !strings.EqualFold(sums.sha256, m.SHA256) {
+			return errors.New("sha256 checksum mismatch")
+		}
+	}
+	return nil
+}
+
+// downloadWithManifest downloads a plex release and writes its manifest
+func downloadWithManifest(cfg *Config, dir string, v string, r release) (string, error) {
+	fp, sums, err := downloadPlexRelease(cfg, dir, r)
+	if err != nil {
+		return "", err
+	}
+	return fp, writeManifest(fp, v, r, sums)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirror keeps a copy of every release of the DSM version of the NAS and serves it with a rewritten downloads JSON
+type mirror struct {
+	cfg *Config
+
+	mu       sync.RWMutex
+	api      []byte
+	mirrored map[string]string // release URL to local file name
+}
+
+// refresh fetches the downloads JSON and downloads every release that is not mirrored yet
+func (m *mirror) refresh() error {
+	body, err := fetchPlexAPI(m.cfg)
+	if err != nil {
+		return err
+	}
+	p, err := decodePlexInfo(body, m.cfg.dsmMajor())
+	if err != nil {
+		return err
+	}
+	v := p.platform.Version
+	logInfo("Latest version: ", v)
+
+	mirrored := map[string]string{}
+	for _, r := range p.platform.Releases {
+		fp, err := downloadWithManifest(m.cfg, m.cfg.Dir, v, r)
+		if err != nil {
+			logWarn("Unable to mirror build", r.Build+":", err)
+			continue
+		}
+		mirrored[r.URL] = filepath.Base(fp)
+	}
+	if len(mirrored) == 0 {
+		return fmt.Errorf("no release of version %s could be mirrored", v)
+	}
+
+	m.mu.Lock()
+	m.api = body
+	m.mirrored = mirrored
+	m.mu.Unlock()
+	logNotice("Mirrored", len(mirrored), "of", len(p.platform.Releases), "builds of version", v)
+	return nil
+}
+
+// rewrite returns the downloads JSON with the URLs of the mirrored releases pointing at base
+func (m *mirror) rewrite(base string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var api map[string]interface{}
+	if err := json.Unmarshal(m.api, &api); err != nil {
+		return nil, err
+	}
+	nas, _ := api["nas"].(map[string]interface{})
+	platform, _ := nas[dsmPlatform(m.cfg.dsmMajor())].(map[string]interface{})
+	releases, _ := platform["releases"].([]interface{})
+	for _, r := range releases {
+		r, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		u, _ := r["url"].(string)
+		if f, ok := m.mirrored[u]; ok {
+			r["url"] = base + "/" + f
+		}
+	}
+	return json.Marshal(api)
+}
+
+// ServeHTTP serves the rewritten downloads JSON and the mirrored packages
+func (m *mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logInfo(r.RemoteAddr, r.Method, r.URL.Path)
+	name := path.Base(r.URL.Path)
+	switch {
+	case name == "5.json":
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		body, err := m.rewrite(scheme + "://" + r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	case strings.HasSuffix(name, ".spk") && m.isMirrored(name):
+		http.ServeFile(w, r, filepath.Join(m.cfg.Dir, name))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// isMirrored reports whether a file name is one of the mirrored packages
+func (m *mirror) isMirrored(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, f := range m.mirrored {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// serveMirror mirrors the releases to the download directory every interval and serves them on addr
+func serveMirror(cfg *Config, addr string, interval time.Duration) error {
+	m := &mirror{cfg: cfg}
+	if err := m.refresh(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := m.refresh(); err != nil {
+				logWarn("Mirror refresh failed, retrying at the next check: ", err)
+			}
+		}
+	}()
+	host := addr
+	if strings.HasPrefix(addr, ":") {
+		host = "<mirror>" + addr
+	}
+	// the packages served from the origin of PLEX_DOWNLOADS_URL need no RELEASE_HOSTS entry
+	logInfo("Serving the mirror on", addr+", set PLEX_DOWNLOADS_URL=http://"+host+"/5.json on the other units")
+	return http.ListenAndServe(addr, m)
+}
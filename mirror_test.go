@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	const v = "1.40.0.7998-c29d4c0c8"
+	x86 := testPackage(t, testPackageInfo, []byte("x86_64 payload"))
+	arm := testPackage(t, testPackageInfo, []byte("aarch64 payload"))
+	var upstream *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/5.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testDownloadsJSON(t, v,
+			release{Build: "linux-x86_64", Distro: defaultDistro, URL: upstream.URL + "/" + testPackageName, Checksum: fmt.Sprintf("%x", sha1.Sum(x86))},
+			release{Build: "linux-aarch64", Distro: defaultDistro, URL: upstream.URL + "/aarch64.spk", Checksum: fmt.Sprintf("%x", sha1.Sum(arm))},
+			release{Build: "linux-x86", Distro: defaultDistro, URL: upstream.URL + "/missing.spk", Checksum: strings.Repeat("0", 40)},
+		))
+	})
+	mux.Handle("/"+testPackageName, servePackage(x86))
+	mux.Handle("/aarch64.spk", servePackage(arm))
+	upstream = httptest.NewServer(mux)
+	defer upstream.Close()
+
+	cfg := testConfig(t)
+	cfg.DownloadsURL = upstream.URL + "/5.json"
+	m := &mirror{cfg: cfg}
+	if err := m.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	// the release failing to download is left out
+	if len(m.mirrored) != 2 {
+		t.Fatalf("%d releases mirrored, want 2: %v", len(m.mirrored), m.mirrored)
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	// the other units download the mirrored releases from the mirror and the others upstream
+	unit := testConfig(t)
+	unit.DownloadsURL = srv.URL + "/5.json"
+	// the packages of the mirror are allowed without a RELEASE_HOSTS entry
+	unit.ReleaseHosts = splitList(defaultReleaseHosts)
+	p, err := getPlexInfo(unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		buildType string
+		url       string
+		pkg       []byte
+	}{
+		{"linux-x86_64", srv.URL + "/" + testPackageName, x86},
+		{"linux-aarch64", srv.URL + "/aarch64.spk", arm},
+		{"linux-x86", upstream.URL + "/missing.spk", nil},
+	} {
+		r, err := selectRelease(p, tc.buildType, unit.Distro)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.URL != tc.url {
+			t.Errorf("%s: URL %s, want %s", tc.buildType, r.URL, tc.url)
+		}
+		if tc.pkg == nil {
+			continue
+		}
+		fp, _, err := downloadPlexRelease(unit, unit.Dir, r)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.buildType, err)
+		}
+		if filepath.Dir(fp) != unit.Dir {
+			t.Errorf("%s: downloaded to %s", tc.buildType, fp)
+		}
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/aarch64.spk", http.StatusOK},
+		{"/mirror/" + testPackageName, http.StatusOK},
+		{"/missing.spk", http.StatusNotFound},
+		{"/" + testPackageName + ".json", http.StatusNotFound},
+		{"/", http.StatusNotFound},
+	} {
+		res, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.path, res.StatusCode, tc.status)
+		}
+		if tc.status == http.StatusOK && !bytes.Equal(body, arm) && !bytes.Equal(body, x86) {
+			t.Errorf("%s: not a mirrored package", tc.path)
+		}
+	}
+}
+
+func TestMirrorNothingMirrored(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/5.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(testDownloadsJSON(t, "1.40.0.7998-c29d4c0c8",
+			release{Build: "linux-x86_64", Distro: defaultDistro, URL: "http://" + r.Host + "/" + testPackageName, Checksum: strings.Repeat("0", 40)}))
+	}))
+	defer upstream.Close()
+
+	cfg := testConfig(t)
+	cfg.DownloadsURL = upstream.URL + "/5.json"
+	m := &mirror{cfg: cfg}
+	if err := m.refresh(); err == nil || !strings.Contains(err.Error(), "no release of version 1.40.0.7998-c29d4c0c8 could be mirrored") {
+		t.Errorf("got error %v, want no release mirrored", err)
+	}
+	if m.api != nil {
+		t.Error("downloads JSON served without any release mirrored")
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxDownloadsJSONSize is the largest downloads JSON accepted, it is about 100KB
+const maxDownloadsJSONSize = 10 << 20
+
+// downloadsJSONError is returned when the downloads JSON can not be fetched from a URL
+type downloadsJSONError struct {
+	url string
+	err error
+}
+
+func (e *downloadsJSONError) Error() string {
+	return e.url + ": " + e.err.Error()
+}
+
+func (e *downloadsJSONError) Unwrap() error {
+	return e.err
+}
+
+// fetchDownloadsJSON returns the raw downloads JSON served at a URL with its validators. The request is
+// conditional when the cached copy was fetched from the same URL and did not expire, which is returned
+// when not modified.
+func fetchDownloadsJSON(cfg *Config, u string) ([]byte, apiCacheMeta, error) {
+	meta := apiCacheMeta{URL: u}
+	header := http.Header{}
+	cached, fetched, cerr := readAPICache(cfg.StateDir)
+	if m, err := readAPICacheMeta(cfg.StateDir); cerr == nil && err == nil && m.URL == u && time.Since(fetched) < cfg.APICacheMaxAge {
+		if m.ETag != "" {
+			header.Set("If-None-Match", m.ETag)
+		}
+		if m.LastModified != "" {
+			header.Set("If-Modified-Since", m.LastModified)
+		}
+	}
+	// the token is sent in a header, keeping it out of the URLs logged
+	token := cfg.PlexToken != "" && isPlexHost(u)
+	if token {
+		header.Set("X-Plex-Token", cfg.PlexToken)
+	}
+	res, err := httpGetHeader(cfg, cfg.httpClient(), u, header)
+	var serr *statusError
+	if token && errors.As(err, &serr) && serr.code == http.StatusUnauthorized {
+		return nil, meta, fmt.Errorf("%w, see PLEX_TOKEN", err)
+	}
+	if err != nil {
+		return nil, meta, err
+	}
+	defer res.Body.Close()
+	meta.ETag = res.Header.Get("ETag")
+	meta.LastModified = res.Header.Get("Last-Modified")
+	if res.StatusCode == http.StatusNotModified {
+		logInfo("Downloads JSON not modified since", fetched.Format(time.RFC3339)+", using the cached copy")
+		if m, err := readAPICacheMeta(cfg.StateDir); err == nil {
+			meta = m
+		}
+		return cached, meta, nil
+	}
+	body, err := readDownloadsJSON(cfg, res)
+	if err != nil || cfg.SaveResponses == saveResponsesOff {
+		return body, meta, err
+	}
+	_, derr := decodePlexInfo(body, cfg.dsmMajor())
+	if derr == nil && cfg.SaveResponses != saveResponsesAlways {
+		return body, meta, nil
+	}
+	f, err := saveResponse(cfg, u, res, body)
+	if err != nil {
+		logWarn("Unable to save the response: ", err)
+		return body, meta, derr
+	}
+	if derr != nil {
+		return body, meta, fmt.Errorf("%w, response saved to %s", derr, f)
+	}
+	logDebug("Response saved to: ", f)
+	return body, meta, nil
+}
+
+// readDownloadsJSON reads the body of a response serving the downloads JSON, up to maxDownloadsJSONSize
+func readDownloadsJSON(cfg *Config, res *http.Response) ([]byte, error) {
+	if res.ContentLength > maxDownloadsJSONSize {
+		return nil, fmt.Errorf("response of %s exceeds the limit of %s", formatBytes(res.ContentLength), formatBytes(maxDownloadsJSONSize))
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxDownloadsJSONSize+1))
+	if isTimeout(err) && !cfg.interrupted() {
+		return nil, fmt.Errorf("timed out after %s, see HTTP_TIMEOUT: %w", cfg.HTTPTimeout, err)
+	}
+	if len(body) > maxDownloadsJSONSize {
+		return nil, fmt.Errorf("response exceeds the limit of %s", formatBytes(maxDownloadsJSONSize))
+	}
+	return body, err
+}
+
+// fetchPlexAPI returns the raw downloads JSON of the first of the downloads URL and its
+// fallbacks serving a valid one, retrying each on transient failures, and caches it
+func fetchPlexAPI(cfg *Config) ([]byte, error) {
+	urls := cfg.downloadsURLs()
+	var errs []error
+	for i, u := range urls {
+		var body []byte
+		var meta apiCacheMeta
+		err := cfg.retry("fetching "+u, func() error {
+			var err error
+			if body, meta, err = fetchDownloadsJSON(cfg, u); err == nil {
+				_, err = decodePlexInfo(body, cfg.dsmMajor())
+			}
+			return err
+		})
+		if err != nil {
+			if i < len(urls)-1 {
+				logWarn("Unable to fetch the downloads JSON from", u+", trying the next fallback: ", err)
+			}
+			errs = append(errs, &downloadsJSONError{u, err})
+			continue
+		}
+		logInfo("Downloads JSON served by", u)
+		if err := writeAPICache(cfg.StateDir, body, meta); err != nil {
+			logDebug("Unable to cache the downloads JSON: ", err)
+		}
+		return body, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// release channels of the downloads JSON
+const (
+	channelPublic   = "public"
+	channelPlexPass = "plexpass"
+	channelAuto     = "auto"
+)
+
+// withChannel adds the channel query parameter to a downloads JSON URL
+func withChannel(rawURL string, channel string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	q.Set("channel", channel)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// isPlexHost reports whether a URL is served by plex.tv, the only host the PLEX_TOKEN is sent to
+func isPlexHost(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == "plex.tv" || strings.HasSuffix(host, ".plex.tv")
+}
+
+// dsmPlatform returns the name of the platform of a DSM major version in the downloads JSON
+func dsmPlatform(dsm int) string {
+	if dsm < 7 {
+		return "Synology"
+	}
+	return "Synology (DSM 7)"
+}
+
+// decodePlexInfo decodes the downloads JSON, which must hold a version for the platform of a DSM major version
+func decodePlexInfo(body []byte, dsm int) (plex, error) {
+	p := plex{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return p, fmt.Errorf("decoding the downloads JSON: %w", err)
+	}
+	p.platform = p.Nas.DSM7
+	if dsm < 7 {
+		p.platform = p.Nas.DSM6
+	}
+	if p.platform.Version == "" {
+		return p, fmt.Errorf("decoding the downloads JSON: no %s version", dsmPlatform(dsm))
+	}
+	return p, nil
+}
+
+// getPlexInfo returns a plex struct, from the cached downloads JSON when the request fails
+func getPlexInfo(cfg *Config) (plex, error) {
+	body, err := fetchPlexAPI(cfg)
+	if err == nil {
+		var p plex
+		if p, err = decodePlexInfo(body, cfg.dsmMajor()); err == nil {
+			return cfg.publicReleases(p), nil
+		}
+	}
+
+	cached, fetched, cerr := readAPICache(cfg.StateDir)
+	if cerr != nil || cfg.apiCacheExpired(fetched) {
+		return plex{}, err
+	}
+	p, cerr := decodePlexInfo(cached, cfg.dsmMajor())
+	if cerr != nil {
+		return plex{}, err
+	}
+	logWarn("Unable to fetch the downloads JSON, using the cached copy from", time.Since(fetched).Round(time.Second), "ago: ", err)
+	return cfg.publicReleases(p), nil
+}
+
+// errPlexPassOnly is returned when the releases of a build type all need Plex Pass on the public channel
+var errPlexPassOnly = errors.New("the latest release needs Plex Pass")
+
+// isPlexPassLabel reports whether the label of a release marks it as needing Plex Pass
+func isPlexPassLabel(label string) bool {
+	l := strings.ToLower(label)
+	return strings.Contains(l, "plex pass") || strings.Contains(l, "plexpass")
+}
+
+// publicReleases leaves the releases labeled as needing Plex Pass out on the public channel, the latest
+// version being one the public builds may lag behind
+func (c *Config) publicReleases(p plex) plex {
+	if c.Channel != channelPublic {
+		return p
+	}
+	kept := []release{}
+	labels := []string{}
+	for _, r := range p.platform.Releases {
+		if isPlexPassLabel(r.Label) {
+			p.plexPass = append(p.plexPass, r)
+			labels = append(labels, fmt.Sprintf("%s (%s)", r.Label, r.Build))
+			continue
+		}
+		kept = append(kept, r)
+	}
+	if len(labels) > 0 {
+		logNotice("Ignoring the releases needing Plex Pass on the public channel: ", strings.Join(labels, ", "))
+	}
+	p.platform.Releases = kept
+	return p
+}
+
+// buildTypeError is returned when the build type is not a known one, or when no release of the downloads
+// JSON matches it, with the build types available
+type buildTypeError struct {
+	buildType string
+	available []string
+	// published tells the available build types are those of the downloads JSON
+	published bool
+	// suggestion is the available build type the build type looks like a typo of
+	suggestion string
+}
+
+func (e *buildTypeError) Error() string {
+	b := fmt.Sprintf("%q", e.buildType)
+	if e.suggestion != "" {
+		b += fmt.Sprintf(" (did you mean %s?)", e.suggestion)
+	}
+	if !e.published {
+		return fmt.Sprintf("unknown build type %s, expected one of %s or an alias: %s", b, strings.Join(e.available, ", "), strings.Join(buildTypeAliasList(), ", "))
+	}
+	if len(e.available) == 0 {
+		return fmt.Sprintf("no release found for build type %s, the downloads JSON has none for this DSM version", b)
+	}
+	return fmt.Sprintf("no release found for build type %s, the downloads JSON has: %s, see BUILD_TYPE", b, strings.Join(e.available, ", "))
+}
+
+// defaultDistro is the distro of the releases for Synology, those of DSM 6 and 7 being in their own sections
+const defaultDistro = "synology"
+
+// selectRelease returns the release of a build type and a distro, which must be the only one
+func selectRelease(p plex, buildType string, distro string) (release, error) {
+	available := []string{}
+	builds := []release{}
+	matches := []release{}
+	for _, r := range p.platform.Releases {
+		available = append(available, r.Build)
+		if !strings.EqualFold(r.Build, buildType) {
+			continue
+		}
+		builds = append(builds, r)
+		if strings.EqualFold(r.Distro, distro) {
+			matches = append(matches, r)
+		}
+	}
+	if len(builds) == 0 {
+		for _, r := range p.plexPass {
+			if strings.EqualFold(r.Build, buildType) {
+				return release{}, fmt.Errorf("%w for build type %s: %s, see CHANNEL", errPlexPassOnly, buildType, r.Label)
+			}
+		}
+		return release{}, &buildTypeError{buildType: buildType, available: available, published: true, suggestion: closestBuildType(buildType, available)}
+	}
+	candidates := []string{}
+	for _, r := range builds {
+		candidates = append(candidates, fmt.Sprintf("%s (%s, distro %s)", r.Label, r.Build, r.Distro))
+	}
+	switch len(matches) {
+	case 0:
+		return release{}, fmt.Errorf("no release found for build type %s and distro %s, the releases of this build type are: %s, see DISTRO", buildType, distro, strings.Join(candidates, ", "))
+	case 1:
+		r := matches[0]
+		logInfo(fmt.Sprintf("Release selected: %s, build %s, distro %s", r.Label, r.Build, r.Distro))
+		return r, nil
+	}
+	return release{}, fmt.Errorf("%d releases found for build type %s and distro %s, not picking one: %s", len(matches), buildType, distro, strings.Join(candidates, ", "))
+}
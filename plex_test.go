@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readFixture returns a file of testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecodePlexInfo(t *testing.T) {
+	body := readFixture(t, "downloads.json")
+	for _, tc := range []struct {
+		dsm      int
+		version  string
+		releases int
+		added    int
+		fixed    int
+	}{
+		{7, "1.41.0.8992-8463ad060", 4, 7, 3},
+		{6, "1.41.0.8992-8463ad060", 4, 0, 0},
+	} {
+		p, err := decodePlexInfo(body, tc.dsm)
+		if err != nil {
+			t.Fatalf("DSM %d: %v", tc.dsm, err)
+		}
+		if p.platform.Version != tc.version {
+			t.Errorf("DSM %d: version %s, want %s", tc.dsm, p.platform.Version, tc.version)
+		}
+		if len(p.platform.Releases) != tc.releases {
+			t.Errorf("DSM %d: %d releases, want %d", tc.dsm, len(p.platform.Releases), tc.releases)
+		}
+		if n := len(changelogItems(p.platform.ItemsAdded)); n != tc.added {
+			t.Errorf("DSM %d: %d items added, want %d", tc.dsm, n, tc.added)
+		}
+		if n := len(changelogItems(p.platform.ItemsFixed)); n != tc.fixed {
+			t.Errorf("DSM %d: %d items fixed, want %d", tc.dsm, n, tc.fixed)
+		}
+		if p.platform.ReleaseDate == 0 {
+			t.Errorf("DSM %d: no release date", tc.dsm)
+		}
+	}
+}
+
+func TestDecodePlexInfoInvalid(t *testing.T) {
+	for name, body := range map[string]string{
+		"not JSON":      "<html>Service Unavailable</html>",
+		"no DSM 7":      `{"nas":{"Synology":{"version":"1.41.0.8992-8463ad060"}}}`,
+		"empty version": `{"nas":{"Synology (DSM 7)":{"version":"","releases":[]}}}`,
+	} {
+		if _, err := decodePlexInfo([]byte(body), 7); err == nil {
+			t.Errorf("%s: decoded", name)
+		}
+	}
+}
+
+func TestSelectRelease(t *testing.T) {
+	body := readFixture(t, "downloads.json")
+	for _, tc := range []struct {
+		dsm       int
+		buildType string
+		distro    string
+		suffix    string
+	}{
+		{7, "linux-x86_64", "synology", "/synology-dsm7/PlexMediaServer-1.41.0.8992-8463ad060-x86_64_DSM7.spk"},
+		{7, "linux-x86", "synology", "/synology-dsm7/PlexMediaServer-1.41.0.8992-8463ad060-x86_DSM7.spk"},
+		{7, "linux-aarch64", "synology", "/synology-dsm7/PlexMediaServer-1.41.0.8992-8463ad060-aarch64_DSM7.spk"},
+		{7, "linux-armv7hf_neon", "synology", "/synology-dsm7/PlexMediaServer-1.41.0.8992-8463ad060-armv7hf_neon_DSM7.spk"},
+		{7, "LINUX-X86_64", "Synology", "/synology-dsm7/PlexMediaServer-1.41.0.8992-8463ad060-x86_64_DSM7.spk"},
+		{6, "linux-x86_64", "synology", "/synology/PlexMediaServer-1.41.0.8992-8463ad060-x86_64.spk"},
+		{6, "linux-aarch64", "synology", "/synology/PlexMediaServer-1.41.0.8992-8463ad060-armv8.spk"},
+	} {
+		p, err := decodePlexInfo(body, tc.dsm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := selectRelease(p, tc.buildType, tc.distro)
+		if err != nil {
+			t.Errorf("DSM %d %s %s: %v", tc.dsm, tc.buildType, tc.distro, err)
+			continue
+		}
+		if !strings.HasSuffix(r.URL, tc.suffix) {
+			t.Errorf("DSM %d %s %s: %s, want a URL ending in %s", tc.dsm, tc.buildType, tc.distro, r.URL, tc.suffix)
+		}
+		if len(r.Checksum) != 40 {
+			t.Errorf("DSM %d %s: checksum %q", tc.dsm, tc.buildType, r.Checksum)
+		}
+	}
+}
+
+func TestSelectReleaseErrors(t *testing.T) {
+	p, err := decodePlexInfo(readFixture(t, "downloads.json"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the builds of other platforms are not those of Synology
+	_, err = selectRelease(p, "linux-armv7neon", defaultDistro)
+	var be *buildTypeError
+	if !errors.As(err, &be) {
+		t.Fatalf("unknown build type: got %v, want a buildTypeError", err)
+	}
+	if be.suggestion != "linux-armv7hf_neon" {
+		t.Errorf("suggestion %q, want linux-armv7hf_neon", be.suggestion)
+	}
+	if errorExitCode(err) != exitUnknownBuildType {
+		t.Errorf("exit code %d, want %d", errorExitCode(err), exitUnknownBuildType)
+	}
+
+	// synology-dsm7 is the section of the URLs, not a distro
+	_, err = selectRelease(p, "linux-x86_64", "synology-dsm7")
+	if err == nil || !strings.Contains(err.Error(), "see DISTRO") || errors.As(err, &be) {
+		t.Errorf("unknown distro: got %v, want an error pointing to DISTRO", err)
+	}
+
+	// two releases of a build and a distro are ambiguous
+	p.platform.Releases = append(p.platform.Releases, p.platform.Releases[1])
+	if _, err := selectRelease(p, "linux-x86_64", defaultDistro); err == nil || !strings.Contains(err.Error(), "2 releases found") {
+		t.Errorf("duplicate release: got %v", err)
+	}
+}
+
+// serveChannels serves the downloads JSON of the channel query parameter, recording the tokens received
+func serveChannels(t *testing.T, tokens *[]string) *httptest.Server {
+	t.Helper()
+	public, plexPass := readFixture(t, "downloads.json"), readFixture(t, "downloads_plexpass.json")
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*tokens = append(*tokens, r.Header.Get("X-Plex-Token"))
+		mu.Unlock()
+		switch r.URL.Query().Get("channel") {
+		case "":
+			w.Write(public)
+		case channelPlexPass:
+			w.Write(plexPass)
+		default:
+			http.Error(w, "unknown channel", http.StatusBadRequest)
+		}
+	}))
+}
+
+func TestChannels(t *testing.T) {
+	var tokens []string
+	srv := serveChannels(t, &tokens)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		channel string
+		version string
+		added   int
+		fixed   int
+	}{
+		{channelPublic, "1.41.0.8992-8463ad060", 7, 3},
+		{channelPlexPass, "1.41.1.9057-af5eaea7a", 1, 0},
+	} {
+		t.Run(tc.channel, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.DownloadsURL = srv.URL + "/api/downloads/5.json"
+			cfg.Channel = tc.channel
+			cfg.PlexToken = testToken
+			p, err := getPlexInfo(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.platform.Version != tc.version {
+				t.Errorf("version %s, want %s", p.platform.Version, tc.version)
+			}
+			if n := len(changelogItems(p.platform.ItemsAdded)); n != tc.added {
+				t.Errorf("%d items added, want %d", n, tc.added)
+			}
+			if n := len(changelogItems(p.platform.ItemsFixed)); n != tc.fixed {
+				t.Errorf("%d items fixed, want %d", n, tc.fixed)
+			}
+			r, err := selectRelease(p, cfg.BuildType, cfg.Distro)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(r.URL, "/"+tc.version+"/") {
+				t.Errorf("release %s of another version than %s", r.URL, tc.version)
+			}
+		})
+	}
+	// the token is only sent to plex.tv
+	for _, token := range tokens {
+		if token != "" {
+			t.Errorf("X-Plex-Token %q sent to %s", token, srv.URL)
+		}
+	}
+}
+
+func TestPublicReleasesLeavePlexPassOut(t *testing.T) {
+	p, err := decodePlexInfo(readFixture(t, "downloads.json"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range p.platform.Releases {
+		if p.platform.Releases[i].Build == "linux-aarch64" {
+			p.platform.Releases[i].Label = "ARMv8 (Plex Pass)"
+		}
+	}
+
+	cfg := testConfig(t)
+	public := cfg.publicReleases(p)
+	if len(public.platform.Releases) != 3 || len(public.plexPass) != 1 {
+		t.Fatalf("%d public and %d Plex Pass releases, want 3 and 1", len(public.platform.Releases), len(public.plexPass))
+	}
+	if _, err := selectRelease(public, "linux-x86_64", defaultDistro); err != nil {
+		t.Error(err)
+	}
+	if _, err := selectRelease(public, "linux-aarch64", defaultDistro); !errors.Is(err, errPlexPassOnly) {
+		t.Errorf("got error %v, want %v", err, errPlexPassOnly)
+	}
+
+	cfg.Channel = channelPlexPass
+	if _, err := selectRelease(cfg.publicReleases(p), "linux-aarch64", defaultDistro); err != nil {
+		t.Errorf("plexpass channel: %v", err)
+	}
+}
+
+func TestDownloadsURLs(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DownloadsURL = "https://plex.tv/api/downloads/5.json"
+	cfg.FallbackURLs = []string{"https://mirror.example/5.json?v=1"}
+	if got := strings.Join(cfg.downloadsURLs(), " "); got != "https://plex.tv/api/downloads/5.json https://mirror.example/5.json?v=1" {
+		t.Errorf("public: %s", got)
+	}
+	cfg.Channel = channelPlexPass
+	if got := strings.Join(cfg.downloadsURLs(), " "); got != "https://plex.tv/api/downloads/5.json?channel=plexpass https://mirror.example/5.json?channel=plexpass&v=1" {
+		t.Errorf("plexpass: %s", got)
+	}
+}
+
+func TestIsPlexHost(t *testing.T) {
+	for u, want := range map[string]bool{
+		"https://plex.tv/api/downloads/5.json":          true,
+		"https://PLEX.TV/api/downloads/5.json":          true,
+		"https://downloads.plex.tv/plex-media-server/x": true,
+		"http://plex.tv/api/downloads/5.json":           false,
+		"https://notplex.tv/api/downloads/5.json":       false,
+		"https://plex.tv.example/api/downloads/5.json":  false,
+		"https://mirror.example/5.json":                 false,
+	} {
+		if got := isPlexHost(u); got != want {
+			t.Errorf("isPlexHost(%s) = %v, want %v", u, got, want)
+		}
+	}
+}
+
+func TestFetchPlexAPIFallbacks(t *testing.T) {
+	body := readFixture(t, "downloads.json")
+	huge := bytes.Repeat([]byte(" "), maxDownloadsJSONSize+1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/down.json", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/announced.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(huge)))
+		w.Write(huge)
+	})
+	mux.HandleFunc("/streamed.json", func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		w.Write(huge)
+	})
+	mux.HandleFunc("/5.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := testConfig(t)
+	cfg.DownloadsURL = srv.URL + "/down.json"
+	cfg.FallbackURLs = []string{srv.URL + "/announced.json", srv.URL + "/streamed.json"}
+	_, err := fetchPlexAPI(cfg)
+	var se *statusError
+	if !errors.As(err, &se) || se.code != http.StatusServiceUnavailable {
+		t.Errorf("got error %v, want a 503 status error", err)
+	}
+	var je *downloadsJSONError
+	if !errors.As(err, &je) || je.url != cfg.DownloadsURL {
+		t.Errorf("got error %v, want an error of %s", err, cfg.DownloadsURL)
+	}
+	for _, want := range []string{
+		"announced.json: response of 10.0MiB exceeds the limit of 10.0MiB",
+		"streamed.json: response exceeds the limit of 10.0MiB",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want %q", err, want)
+		}
+	}
+
+	cfg.FallbackURLs = append(cfg.FallbackURLs, srv.URL+"/5.json")
+	got, err := fetchPlexAPI(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Error("got another body than the one of the last fallback")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// plexPreferences holds the attributes of the Preferences.xml of Plex Media Server read by the updater
+type plexPreferences struct {
+	PlexOnlineToken string `xml:"PlexOnlineToken,attr"`
+	// ButlerUpdateChannel is the update channel chosen in the settings of the server, 8 for beta
+	ButlerUpdateChannel string `xml:"ButlerUpdateChannel,attr"`
+}
+
+// butlerChannelBeta is the ButlerUpdateChannel of the beta releases of Plex Pass
+const butlerChannelBeta = "8"
+
+// preferencesPaths returns the paths of the Preferences.xml of a package: in the PlexMediaServer shared
+// folder or the home of the package on DSM 7, and in the Plex shared folder on DSM 6
+func preferencesPaths(name string) []string {
+	paths := []string{
+		filepath.Join("/var/packages", name, "shares/PlexMediaServer/AppData/Plex Media Server/Preferences.xml"),
+		filepath.Join("/var/packages", name, "home/Plex Media Server/Preferences.xml"),
+	}
+	dsm6, _ := filepath.Glob("/volume*/Plex/Library/Application Support/Plex Media Server/Preferences.xml")
+	return append(paths, dsm6...)
+}
+
+// readPreferences returns the first Preferences.xml found with its path
+func readPreferences(paths []string) (plexPreferences, string, error) {
+	prefs := plexPreferences{}
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if os.IsPermission(err) {
+			return prefs, p, fmt.Errorf("%w, run the updater as root", err)
+		}
+		if err != nil {
+			return prefs, p, err
+		}
+		if err := xml.Unmarshal(b, &prefs); err != nil {
+			return prefs, p, fmt.Errorf("decoding %s: %w", p, err)
+		}
+		return prefs, p, nil
+	}
+	return prefs, "", errors.New("no Preferences.xml of Plex Media Server found in " + strings.Join(paths, ", "))
+}
+
+// readPlexOnlineToken returns the PlexOnlineToken of the first Preferences.xml found, the token the
+// server signed in to plex.tv with. The token is only kept in memory.
+func readPlexOnlineToken(paths []string) (string, error) {
+	prefs, p, err := readPreferences(paths)
+	if err != nil {
+		return "", fmt.Errorf("reading the PlexOnlineToken: %w, set PLEX_TOKEN", err)
+	}
+	if prefs.PlexOnlineToken == "" {
+		return "", fmt.Errorf("%s has no PlexOnlineToken, sign in the server to plex.tv with a Plex Pass account or set PLEX_TOKEN", p)
+	}
+	logInfo("Using the PlexOnlineToken of", p)
+	return prefs.PlexOnlineToken, nil
+}
+
+// resolveChannel sets CHANNEL=auto to the update channel chosen in the settings of the server, plexpass for
+// beta and public otherwise, falling back to public when its Preferences.xml can not be read
+func (c *Config) resolveChannel() {
+	if c.Channel != channelAuto {
+		return
+	}
+	c.Channel = channelPublic
+	name, err := c.packageName()
+	if err != nil {
+		logNotice("Unable to read the update channel of the server, using the public channel: ", err)
+		return
+	}
+	prefs, p, err := readPreferences(preferencesPaths(name))
+	if err != nil {
+		logNotice("Unable to read the update channel of the server, using the public channel: ", err)
+		return
+	}
+	if prefs.ButlerUpdateChannel == butlerChannelBeta {
+		c.Channel = channelPlexPass
+	}
+	logInfo(fmt.Sprintf("Update channel of the server: %s, ButlerUpdateChannel %q of %s", c.Channel, prefs.ButlerUpdateChannel, p))
+}
+
+// resolvePlexToken reads the PLEX_TOKEN from the Preferences.xml of the server when the Plex Pass
+// channel is used without one
+func (c *Config) resolvePlexToken() error {
+	if c.Channel != channelPlexPass || c.PlexToken != "" {
+		return nil
+	}
+	name, err := c.packageName()
+	if err != nil {
+		return fmt.Errorf("reading the PlexOnlineToken: %w, set PLEX_TOKEN", err)
+	}
+	token, err := readPlexOnlineToken(preferencesPaths(name))
+	if err != nil {
+		return fmt.Errorf("CHANNEL=plexpass: %w", err)
+	}
+	c.PlexToken = token
+	return nil
+}
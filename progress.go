@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressLogBytes is how often the progress of a download of unknown size is logged
+const progressLogBytes = 20 << 20
+
+// progressReader reports the progress of a download, in place on a terminal
+// and as a log line every 10% otherwise
+type progressReader struct {
+	r io.Reader
+	// mu guards the progress shared by the writers of the segments of a download
+	mu      sync.Mutex
+	total   int64
+	read    int64
+	start   time.Time
+	tty     bool
+	drawn   time.Time
+	logNext int64
+}
+
+// newProgressReader returns a progress reader of a download of total bytes, -1 when unknown
+func newProgressReader(r io.Reader, total int64) *progressReader {
+	p := &progressReader{
+		r:     r,
+		total: total,
+		start: time.Now(),
+		tty:   isTerminal(os.Stderr) && currentLogLevel <= levelInfo,
+	}
+	p.logNext = p.logStep()
+	return p
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.add(n, err == io.EOF)
+	return n, err
+}
+
+// add reports n more bytes received, done being the end of the download
+func (p *progressReader) add(n int, done bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.read += int64(n)
+	if p.tty {
+		if now := time.Now(); now.Sub(p.drawn) >= 200*time.Millisecond || done {
+			p.draw()
+			p.drawn = now
+		}
+	} else if p.read >= p.logNext {
+		logInfo("Downloaded", p.status())
+		for p.logNext <= p.read {
+			p.logNext += p.logStep()
+		}
+	}
+}
+
+// progressWriter reports the bytes written to w to a progress shared with other writers, such as those of
+// the segments of a download
+type progressWriter struct {
+	w        io.Writer
+	progress *progressReader
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.progress.add(n, false)
+	return n, err
+}
+
+// logStep returns the number of bytes between two progress log lines
+func (p *progressReader) logStep() int64 {
+	if p.total <= 0 {
+		return progressLogBytes
+	}
+	if step := p.total / 10; step > 0 {
+		return step
+	}
+	return 1
+}
+
+// drawProgress renders the progress of a download in place, ending the line when done
+var drawProgress = func(status string, done bool) {
+	fmt.Fprintf(os.Stderr, "\r%s\033[K", status)
+	if done {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// draw renders the progress line
+func (p *progressReader) draw() {
+	drawProgress(p.status(), false)
+}
+
+// finish ends the progress line and logs the average rate of the download
+func (p *progressReader) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		drawProgress(p.status(), true)
+	}
+	elapsed := time.Since(p.start)
+	if elapsed > 0 && p.read > 0 {
+		logInfo("Downloaded", formatBytes(p.read), "in", elapsed.Round(time.Millisecond), "at", formatBytes(int64(float64(p.read)/elapsed.Seconds()))+"/s")
+	}
+}
+
+// rateReader limits the rate of a download to a number of bytes per second
+type rateReader struct {
+	r     io.Reader
+	rate  int64
+	read  int64
+	start time.Time
+}
+
+// newRateReader returns a reader limited to rate bytes per second
+func newRateReader(r io.Reader, rate int64) *rateReader {
+	return &rateReader{r: r, rate: rate, start: time.Now()}
+}
+
+func (l *rateReader) Read(b []byte) (int, error) {
+	// small reads keep the rate steady
+	if max := l.rate / 10; max > 0 && int64(len(b)) > max {
+		b = b[:max]
+	}
+	n, err := l.r.Read(b)
+	l.read += int64(n)
+	if ahead := time.Duration(float64(l.read)/float64(l.rate)*float64(time.Second)) - time.Since(l.start); ahead > 0 {
+		time.Sleep(ahead)
+	}
+	return n, err
+}
+
+// parseSize parses a size such as 500MB or 2GB to bytes, the units are binary
+func parseSize(s string) (int64, error) {
+	v := strings.TrimSpace(s)
+	i := strings.IndexFunc(v, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(v)
+	}
+	n, err := strconv.ParseFloat(v[:i], 64)
+	multipliers := map[string]float64{"": 1, "b": 1, "kb": 1 << 10, "kib": 1 << 10, "mb": 1 << 20, "mib": 1 << 20, "gb": 1 << 30, "gib": 1 << 30}
+	m, ok := multipliers[strings.ToLower(strings.TrimSpace(v[i:]))]
+	if err != nil || n <= 0 || !ok {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 500MB or 2GB", s)
+	}
+	return int64(n * m), nil
+}
+
+// parseRate parses a download rate such as 500KB/s, 5MB/s, 20Mbit/s or 20Mbps to bytes per second. Byte
+// units are binary, bit units decimal.
+func parseRate(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	// the case tells a bit rate, such as 20Mbps, from a byte rate, such as 5MBps, before it is ignored
+	if b, ok := strings.CutSuffix(v, "bps"); ok {
+		v = b + "bit"
+	} else {
+		v = strings.TrimSuffix(v, "ps")
+	}
+	i := strings.IndexFunc(v, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(v)
+	}
+	n, err := strconv.ParseFloat(v[:i], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected e.g. 500KB/s, 5MB/s, 20Mbit/s or 20Mbps", s)
+	}
+	unit := strings.TrimSpace(v[i:])
+	multipliers := map[string]float64{
+		"": 1, "b": 1, "kb": 1 << 10, "kib": 1 << 10, "k": 1 << 10, "mb": 1 << 20, "mib": 1 << 20, "m": 1 << 20, "gb": 1 << 30, "gib": 1 << 30,
+		"bit": 1.0 / 8, "kbit": 1e3 / 8, "mbit": 1e6 / 8, "gbit": 1e9 / 8,
+	}
+	m, ok := multipliers[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q, expected e.g. 500KB/s, 5MB/s, 20Mbit/s or 20Mbps", s)
+	}
+	return int64(n * m), nil
+}
+
+// status returns the percent complete, bytes transferred, rate and ETA
+func (p *progressReader) status() string {
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.read) / elapsed
+	}
+	if p.total <= 0 {
+		return fmt.Sprintf("%s %s/s", formatBytes(p.read), formatBytes(int64(rate)))
+	}
+	eta := "--:--"
+	if rate > 0 {
+		left := time.Duration(float64(p.total-p.read) / rate * float64(time.Second)).Round(time.Second)
+		eta = fmt.Sprintf("%d:%02d", int(left.Minutes()), int(left.Seconds())%60)
+	}
+	return fmt.Sprintf("%3.0f%% %s/%s %s/s ETA %s",
+		float64(p.read)*100/float64(p.total), formatBytes(p.read), formatBytes(p.total), formatBytes(int64(rate)), eta)
+}
+
+// formatBytes returns a human readable size
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGT"[exp])
+}
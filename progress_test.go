@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		rate string
+		want int64
+	}{
+		{"1000", 1000},
+		{"500KB/s", 500 << 10},
+		{"500kb/s", 500 << 10},
+		{"500KiB/s", 500 << 10},
+		{"500K", 500 << 10},
+		{"5MB/s", 5 << 20},
+		{"1.5MB/s", 3 << 19},
+		{"1GB/s", 1 << 30},
+		{"5MBps", 5 << 20},
+		{"100Bps", 100},
+		{" 5 MB/s ", 5 << 20},
+		{"20Mbit/s", 2500000},
+		{"20mbit", 2500000},
+		{"800Kbit/s", 100000},
+		{"1Gbit/s", 125000000},
+		// bps is a bit rate, whatever the case of its prefix
+		{"20Mbps", 2500000},
+		{"20mbps", 2500000},
+		{"20 Mbps", 2500000},
+		{"800Kbps", 100000},
+		{"800kbps", 100000},
+		{"1Gbps", 125000000},
+		{"8000bps", 1000},
+	} {
+		got, err := parseRate(tc.rate)
+		if err != nil {
+			t.Errorf("parseRate(%q): %v", tc.rate, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseRate(%q) = %d, want %d", tc.rate, got, tc.want)
+		}
+	}
+	for _, rate := range []string{"", "0", "-5MB/s", "fast", "5TB/s", "5Mbits", "5MB/m", "MB/s"} {
+		if n, err := parseRate(rate); err == nil {
+			t.Errorf("parseRate(%q) = %d, want an error", rate, n)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		size string
+		want int64
+	}{
+		{"1024", 1024},
+		{"1KB", 1 << 10},
+		{"500MB", 500 << 20},
+		{"500mib", 500 << 20},
+		{"2GB", 2 << 30},
+		{"1.5GB", 3 << 29},
+	} {
+		got, err := parseSize(tc.size)
+		if err != nil || got != tc.want {
+			t.Errorf("parseSize(%q) = %d %v, want %d", tc.size, got, err, tc.want)
+		}
+	}
+	for _, size := range []string{"", "0", "-1GB", "2TB", "big"} {
+		if n, err := parseSize(size); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", size, n)
+		}
+	}
+}
+
+func TestSegmentedDownloadProgress(t *testing.T) {
+	pkg := testPackage(t, testPackageInfo, bytes.Repeat([]byte("plex media server "), 50000))
+	srv := httptest.NewServer(servePackage(pkg))
+	defer srv.Close()
+
+	for _, segments := range []int{1, 4} {
+		var b bytes.Buffer
+		log.SetOutput(&b)
+		cfg := testConfig(t)
+		cfg.Segments = segments
+		r := release{URL: srv.URL + "/" + testPackageName, Checksum: fmt.Sprintf("%x", sha1.Sum(pkg))}
+		_, _, err := downloadReleaseFrom(cfg, cfg.Dir, r)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the progress is logged every 10% and ends with the average rate, whatever the segments
+		lines := 0
+		for _, l := range strings.Split(b.String(), "\n") {
+			if strings.Contains(l, "Downloaded") && strings.Contains(l, "% ") {
+				lines++
+			}
+		}
+		if lines < 9 {
+			t.Errorf("%d segments: %d progress lines, want at least 9:\n%s", segments, lines, b.String())
+		}
+		total := formatBytes(int64(len(pkg)))
+		for _, want := range []string{"100% " + total + "/" + total, "Downloaded " + total + " in "} {
+			if !strings.Contains(b.String(), want) {
+				t.Errorf("%d segments: no %q logged:\n%s", segments, want, b.String())
+			}
+		}
+	}
+}
+
+func TestProgressWriters(t *testing.T) {
+	const writers, writes = 8, 1000
+	p := newProgressReader(nil, writers*writes*3)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := progressWriter{io.Discard, p}
+			for j := 0; j < writes; j++ {
+				w.Write([]byte("abc"))
+			}
+		}()
+	}
+	wg.Wait()
+	if p.read != writers*writes*3 {
+		t.Errorf("%d bytes reported, want %d", p.read, writers*writes*3)
+	}
+}
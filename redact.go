@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+	"regexp"
+)
+
+// redacted replaces the secrets removed from the output, as url.URL.Redacted does
+const redacted = "xxxxx"
+
+// secretRegexp matches the value of a secret given as key=value or key: value, such as a Plex token
+// in a query string (X-Plex-Token=...), a header (X-Plex-Token: ...) or a setting (PLEX_TOKEN=...)
+var secretRegexp = regexp.MustCompile(`(?i)(\b[a-z_]*(?:token|password|secret)["']?\s*[=:]\s*["']?)[^&\s"',;]+`)
+
+// urlPasswordRegexp matches the password of a URL
+var urlPasswordRegexp = regexp.MustCompile(`(://[^/@:\s]*:)[^/@\s]+@`)
+
+// redact masks the secrets of a text
+func redact(s string) string {
+	s = secretRegexp.ReplaceAllString(s, "${1}"+redacted)
+	return urlPasswordRegexp.ReplaceAllString(s, "${1}"+redacted+"@")
+}
+
+// redactWriter masks the secrets of everything written to a writer
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(b))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// report actions
+const (
+	actionNone       = "none"
+	actionDownloaded = "downloaded"
+	actionInstalled  = "installed"
+	actionFailed     = "failed"
+)
+
+// report is the machine readable summary of a run printed with --output json.
+// Its fields are a stable contract, only add new ones.
+type report struct {
+	InstalledVersion string  `json:"installed_version"`
+	LatestVersion    string  `json:"latest_version"`
+	BuildType        string  `json:"build_type"`
+	UpdateAvailable  bool    `json:"update_available"`
+	Action           string  `json:"action"`
+	File             string  `json:"file,omitempty"`
+	Checksum         string  `json:"checksum,omitempty"`
+	Size             int64   `json:"size,omitempty"`
+	Duration         float64 `json:"duration_seconds"`
+	Error            string  `json:"error,omitempty"`
+	// ItemsAdded and ItemsFixed are the changelog of the latest version
+	ItemsAdded []string `json:"items_added,omitempty"`
+	ItemsFixed []string `json:"items_fixed,omitempty"`
+}
+
+// write writes the report as a single JSON document
+func (r report) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// checkGolden compares got with a golden file of testdata, rewriting it with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch, run go test -update if the change is intended\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	for _, tc := range []struct {
+		golden string
+		rep    report
+	}{
+		{"report_none.json", report{
+			InstalledVersion: "1.40.0.7998-c29d4c0c8",
+			LatestVersion:    "1.40.0.7998-c29d4c0c8",
+			BuildType:        "linux-x86_64",
+			Action:           actionNone,
+			Duration:         1.5,
+		}},
+		{"report_installed.json", report{
+			InstalledVersion: "1.41.0.8992-8463ad060",
+			LatestVersion:    "1.41.0.8992-8463ad060",
+			BuildType:        "linux-aarch64",
+			UpdateAvailable:  true,
+			Action:           actionInstalled,
+			File:             "/volume1/@synology-plex-updater/PlexMediaServer-1.41.0.8992-8463ad060-aarch64_DSM7.spk",
+			Checksum:         "0d4d8b5b0a6cbd1dbd5a4c3bdc5d0a2e7f7b1d46",
+			Size:             123456789,
+			Duration:         42.25,
+			ItemsAdded:       []string{"(Music) Sonic adventures"},
+			ItemsFixed:       []string{"(Transcoder) Crash on HEVC", "(Library) Scanner hang"},
+		}},
+		{"report_failed.json", report{
+			InstalledVersion: "1.40.0.7998-c29d4c0c8",
+			BuildType:        "linux-x86_64",
+			Action:           actionFailed,
+			Duration:         0.75,
+			Error:            "fetching https://plex.tv/api/downloads/5.json: 503 Service Unavailable",
+		}},
+	} {
+		t.Run(tc.golden, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tc.rep.write(&b); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tc.golden, b.Bytes())
+		})
+	}
+}
+
+func TestErrorExitCode(t *testing.T) {
+	bt := &buildTypeError{buildType: "linux-arm64", available: knownBuildTypes}
+	for _, tc := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"plain error", errors.New("checksum mismatch, aborting"), exitError},
+		{"unknown build type", bt, exitUnknownBuildType},
+		{"wrapped unknown build type", fmt.Errorf("selecting the release: %w", bt), exitUnknownBuildType},
+		{"joined unknown build type", errors.Join(errors.New("invalid interval: 0s"), bt), exitUnknownBuildType},
+		{"not installed", errNotInstalled, exitNotInstalled},
+		{"wrapped not installed", fmt.Errorf("%w, or use --install-if-missing", errNotInstalled), exitNotInstalled},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := errorExitCode(tc.err); got != tc.want {
+				t.Errorf("errorExitCode(%v) = %d, want %d", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestExitCodes pins the exit codes scripts rely on
+func TestExitCodes(t *testing.T) {
+	for name, tc := range map[string]struct{ got, want int }{
+		"ok":                 {exitOK, 0},
+		"error":              {exitError, 1},
+		"update available":   {exitUpdateAvailable, 2},
+		"unknown build type": {exitUnknownBuildType, 3},
+		"not installed":      {exitNotInstalled, 4},
+		"timeout":            {exitTimeout, 124},
+		"interrupted":        {exitInterrupted, 130},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("exit code %s = %d, want %d", name, tc.got, tc.want)
+		}
+	}
+}
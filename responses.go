@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DEBUG_SAVE_RESPONSES values, saving the downloads JSON when decoding it fails or on every run
+const (
+	saveResponsesOff     = "false"
+	saveResponsesOnError = "true"
+	saveResponsesAlways  = "always"
+)
+
+// savedResponsesKept is the number of saved responses kept in the state directory
+const savedResponsesKept = 5
+
+// savedResponsesDir returns the directory of the saved responses of a state directory
+func savedResponsesDir(dir string) string {
+	return filepath.Join(dir, "responses")
+}
+
+// saveResponse writes the status, the headers and the raw body of a downloads JSON response to a
+// timestamped file of the state directory, removing the older ones, and returns its path
+func saveResponse(cfg *Config, u string, res *http.Response, body []byte) (string, error) {
+	dir := savedResponsesDir(cfg.StateDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "GET %s\n%s %s\n", redact(u), res.Proto, res.Status)
+	// the headers are redacted once written, Header.Write writes a key and its value separately
+	h := &bytes.Buffer{}
+	res.Header.Write(h)
+	b.WriteString(redact(h.String()))
+	b.WriteString("\n")
+	b.Write(body)
+	f := filepath.Join(dir, "downloads-"+time.Now().UTC().Format("20060102T150405.000Z")+".txt")
+	if err := os.WriteFile(f, b.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	rotateSavedResponses(dir)
+	return f, nil
+}
+
+// rotateSavedResponses removes the saved responses of a directory but the savedResponsesKept newest
+func rotateSavedResponses(dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, "downloads-*.txt"))
+	if err != nil {
+		return
+	}
+	// the timestamps of the names sort in time order
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	for i := savedResponsesKept; i < len(files); i++ {
+		if err := os.Remove(files[i]); err != nil {
+			logDebug("Unable to remove the saved response: ", err)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduledTaskName is the name of the DSM Task Scheduler entry managed by the schedule subcommand
+const scheduledTaskName = "Synology Plex Updater"
+
+// dsmVersionFile holds the version of DSM
+const dsmVersionFile = "/etc.defaults/VERSION"
+
+var taskFieldRegexp = regexp.MustCompile(`^(\w+): \[(.*)\]$`)
+
+// scheduledTask is an entry of the DSM Task Scheduler as listed by synoschedtask
+type scheduledTask struct {
+	id     int
+	fields map[string]string
+	lines  []string
+}
+
+// dsmVersionField returns a field of the DSM version file
+func dsmVersionField(key string) (string, error) {
+	return confField(dsmVersionFile, key)
+}
+
+// confField returns a field of a DSM key="value" file
+func confField(file string, key string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), "=")
+		if ok && k == key {
+			return strings.Trim(v, `"`), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no %s in %s", key, file)
+}
+
+// dsmMajorVersion returns the major version of DSM
+func dsmMajorVersion() (int, error) {
+	v, err := dsmVersionField("majorversion")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
+
+// dsmVersion returns the version of DSM, such as 7.2.1
+func dsmVersion() (string, error) {
+	return dsmVersionField("productversion")
+}
+
+// checkTaskScheduler returns an error when the DSM Task Scheduler cannot be managed from the command line
+func checkTaskScheduler() error {
+	major, err := dsmMajorVersion()
+	if err != nil {
+		return fmt.Errorf("unable to detect the DSM version, is this a Synology NAS? %w", err)
+	}
+	if major < 7 {
+		return fmt.Errorf("DSM %d is not supported, create the task in Control Panel > Task Scheduler with the script printed by --print-script", major)
+	}
+	for _, b := range []string{SYNOWEBAPI, SYNOSCHEDTASK} {
+		if _, err := os.Stat(b); err != nil {
+			return fmt.Errorf("task scheduler binary not found: %s", b)
+		}
+	}
+	return nil
+}
+
+// findScheduledTask returns the task managed by the schedule subcommand, nil when there is none
+func findScheduledTask() (*scheduledTask, error) {
+	out, err := commandOutput(context.Background(), SYNOSCHEDTASK, "--get")
+	if err != nil {
+		return nil, err
+	}
+	var t *scheduledTask
+	for _, l := range append(strings.Split(string(out), "\n"), "") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			if t != nil && t.fields["Name"] == scheduledTaskName {
+				return t, nil
+			}
+			t = nil
+			continue
+		}
+		if t == nil {
+			t = &scheduledTask{fields: map[string]string{}}
+		}
+		t.lines = append(t.lines, l)
+		if m := taskFieldRegexp.FindStringSubmatch(l); m != nil {
+			t.fields[m[1]] = m[2]
+			if m[1] == "ID" {
+				t.id, _ = strconv.Atoi(m[2])
+			}
+		}
+	}
+	return nil, nil
+}
+
+// shellQuote quotes a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// scheduledTaskScript returns the script run by the task, exporting the current configuration
+func scheduledTaskScript(binary string) string {
+	keys := []string{"STATE_DIR", "LOG_LEVEL"}
+	for _, env := range flagEnv {
+		keys = append(keys, env)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n# managed by plex-updater schedule\n")
+	prev := ""
+	for _, k := range keys {
+		if k == prev {
+			continue
+		}
+		prev = k
+		if v := os.Getenv(k); v != "" {
+			fmt.Fprintf(&b, "export %s=%s\n", k, shellQuote(v))
+		}
+	}
+	fmt.Fprintf(&b, "exec %s --yes\n", shellQuote(binary))
+	return b.String()
+}
+
+// deleteScheduledTask removes a task from the DSM Task Scheduler
+func deleteScheduledTask(t *scheduledTask, user string) error {
+	task, err := json.Marshal([]map[string]interface{}{{"id": t.id, "real_owner": user}})
+	if err != nil {
+		return err
+	}
+	_, err = commandOutput(context.Background(), SYNOWEBAPI, "--exec", "api=SYNO.Core.TaskScheduler", "method=delete", "version=2", "task="+string(task))
+	return err
+}
+
+// createScheduledTask adds a daily task running the script at hour:minute as user
+func createScheduledTask(script string, hour, minute int, user string) error {
+	schedule, err := json.Marshal(map[string]interface{}{
+		"date_type":      0,
+		"week_day":       "0,1,2,3,4,5,6",
+		"hour":           hour,
+		"minute":         minute,
+		"repeat_hour":    0,
+		"repeat_min":     0,
+		"last_work_hour": hour,
+	})
+	if err != nil {
+		return err
+	}
+	extra, err := json.Marshal(map[string]interface{}{
+		"notify_enable":   false,
+		"notify_mail":     "",
+		"notify_if_error": true,
+		"script":          script,
+	})
+	if err != nil {
+		return err
+	}
+	quoted := func(s string) string {
+		j, _ := json.Marshal(s)
+		return string(j)
+	}
+	out, err := commandOutput(context.Background(), SYNOWEBAPI, "--exec", "api=SYNO.Core.TaskScheduler", "method=create", "version=4",
+		"name="+quoted(scheduledTaskName), "real_owner="+quoted(user), "owner="+quoted(user), "enable=true",
+		"type="+quoted("script"), "schedule="+string(schedule), "extra="+string(extra))
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Success bool `json:"success"`
+		Error   struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(out, &res); err == nil && !res.Success {
+		return fmt.Errorf("creating the scheduled task failed with code %d", res.Error.Code)
+	}
+	return nil
+}
+
+// parseTaskTime parses a HH:MM time of day
+func parseTaskTime(s string) (int, int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time %q: expected HH:MM", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
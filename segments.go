@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// maxSegments is the largest number of segments of a download
+const maxSegments = 16
+
+// errNoRanges is returned when a server does not honor the range requests of a segmented download
+var errNoRanges = errors.New("the server does not support range requests")
+
+// downloadSegments downloads a package of size bytes to a file with --segments concurrent range requests,
+// each one retried on its own. It returns errNoRanges when the server does not honor them.
+func downloadSegments(ctx context.Context, cfg *Config, out *os.File, u string, size int64) error {
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	n := int64(cfg.Segments)
+	length := (size + n - 1) / n
+	errs := make([]error, n)
+	// the segments report to a single progress, as a download in one stream does
+	progress := newProgressReader(nil, size)
+	var wg sync.WaitGroup
+	for i := int64(0); i < n && i*length < size; i++ {
+		first, last := i*length, (i+1)*length-1
+		if last >= size {
+			last = size - 1
+		}
+		wg.Add(1)
+		go func(i, first, last int64) {
+			defer wg.Done()
+			var done int64
+			errs[i] = cfg.retry(fmt.Sprintf("downloading segment %d/%d of %s", i+1, n, u), func() error {
+				written, err := fetchSegment(ctx, cfg, out, progress, u, first+done, last)
+				done += written
+				return err
+			})
+			if errs[i] != nil {
+				// the other segments are useless once one failed
+				cancel()
+				return
+			}
+			logDebug("Downloaded segment", fmt.Sprintf("%d/%d", i+1, n), "of", formatBytes(last-first+1))
+		}(i, first, last)
+	}
+	wg.Wait()
+	progress.finish()
+
+	// report the failure of a segment rather than the cancellation of the others
+	var err error
+	for _, e := range errs {
+		if e != nil && (err == nil || errors.Is(err, context.Canceled)) {
+			err = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+	logDebug("Downloaded", formatBytes(size), "in", n, "segments")
+	return nil
+}
+
+// fetchSegment downloads the bytes first to last of a package to the same offsets of a file in a single
+// attempt, reporting them to the progress of the download, and returns the number of bytes written
+func fetchSegment(ctx context.Context, cfg *Config, out *os.File, progress *progressReader, u string, first, last int64) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", cfg.userAgent())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+	res, err := cfg.downloadClient().Do(req)
+	if isTimeout(err) && !cfg.interrupted() {
+		return 0, fmt.Errorf("downloading %s: no response within %s, see HTTP_TIMEOUT: %w", u, cfg.HTTPTimeout, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	logDebug("HTTP status: ", res.Status, "for", u, "bytes", fmt.Sprintf("%d-%d", first, last))
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return 0, errNoRanges
+	default:
+		return 0, newStatusError(u, res)
+	}
+	if start, _, err := parseContentRange(res.Header.Get("Content-Range")); err != nil || start != first {
+		return 0, errNoRanges
+	}
+
+	stall := newStallReader(res.Body, cfg.StallTimeout, cancel)
+	defer stall.stop()
+	var body io.Reader = io.LimitReader(stall, last-first+1)
+	if rate, err := parseRate(cfg.MaxDownloadRate); err == nil {
+		// the segments share the rate limit
+		body = newRateReader(body, rate/int64(cfg.Segments)+1)
+	}
+	written, err := io.Copy(progressWriter{io.NewOffsetWriter(out, first), progress}, body)
+	if err == nil && written != last-first+1 {
+		err = fmt.Errorf("download truncated: got %d of %d bytes of segment %d-%d", written, last-first+1, first, last)
+	}
+	return written, err
+}
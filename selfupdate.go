@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+)
+
+// updaterRelease is a GitHub release of the updater
+type updaterRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// latestUpdaterRelease returns the latest updater release published on GitHub
+func latestUpdaterRelease(cfg *Config) (updaterRelease, error) {
+	return fetchUpdaterRelease(cfg, RELEASESURL)
+}
+
+// fetchUpdaterRelease returns the updater release described at a URL of the GitHub API
+func fetchUpdaterRelease(cfg *Config, url string) (updaterRelease, error) {
+	r := updaterRelease{}
+	res, err := httpGet(cfg, cfg.httpClient(), url)
+	if err != nil {
+		return r, err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return r, fmt.Errorf("decoding %s: %w", url, err)
+	}
+	return r, nil
+}
+
+// updaterOutdated reports whether a release is newer than the running updater
+func updaterOutdated(r updaterRelease) (bool, error) {
+	current, _, _ := updaterBuild()
+	if current == "dev" {
+		return false, errors.New("development build, unable to compare with the released versions")
+	}
+	cv, err := version.NewVersion(current)
+	if err != nil {
+		return false, err
+	}
+	rv, err := version.NewVersion(r.TagName)
+	if err != nil {
+		return false, err
+	}
+	return cv.LessThan(rv), nil
+}
+
+// asset returns the name and download URL of the first release asset matching
+func (r updaterRelease) asset(match func(string) bool) (string, string, bool) {
+	for _, a := range r.Assets {
+		if match(a.Name) {
+			return a.Name, a.URL, true
+		}
+	}
+	return "", "", false
+}
+
+// binaryAsset returns the name and download URL of the binary for the running platform
+func (r updaterRelease) binaryAsset() (string, string, error) {
+	platform := runtime.GOOS + "_" + runtime.GOARCH
+	name, url, ok := r.asset(func(n string) bool {
+		n = strings.ToLower(strings.ReplaceAll(n, "-", "_"))
+		return strings.Contains(n, platform) && !strings.HasSuffix(n, ".sha256") && !strings.HasSuffix(n, ".txt")
+	})
+	if !ok {
+		return "", "", fmt.Errorf("release %s has no asset for %s", r.TagName, platform)
+	}
+	return name, url, nil
+}
+
+// assetChecksum returns the sha256 checksum published for an asset, from checksums.txt or <asset>.sha256
+func (r updaterRelease) assetChecksum(cfg *Config, asset string) (string, error) {
+	_, url, ok := r.asset(func(n string) bool { return n == asset+".sha256" || strings.HasSuffix(n, "checksums.txt") })
+	if !ok {
+		return "", fmt.Errorf("release %s has no checksum for %s", r.TagName, asset)
+	}
+	res, err := httpGet(cfg, cfg.httpClient(), url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 1:
+			return fields[0], nil
+		case len(fields) >= 2 && strings.TrimPrefix(fields[1], "*") == asset:
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("release %s has no checksum for %s", r.TagName, asset)
+}
+
+// replaceExecutable atomically replaces the running binary with the asset of a release
+func replaceExecutable(cfg *Config, r updaterRelease) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	return replaceBinary(cfg, r, exe)
+}
+
+// replaceBinary atomically replaces a binary with the asset of a release, once its checksum is verified
+func replaceBinary(cfg *Config, r updaterRelease, exe string) error {
+	name, url, err := r.binaryAsset()
+	if err != nil {
+		return err
+	}
+	expected, err := r.assetChecksum(cfg, name)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+
+	logInfo("Downloading: ", url)
+	res, err := httpGet(cfg, cfg.downloadClient(), url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), "."+filepath.Base(exe)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), res.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if checksum := fmt.Sprintf("%x", hash.Sum(nil)); !strings.EqualFold(checksum, expected) {
+		return fmt.Errorf("checksum mismatch for %s: got %s, expected %s", name, checksum, expected)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+// logUpdaterHint logs a line when a newer updater release exists
+func logUpdaterHint(cfg *Config) {
+	r, err := latestUpdaterRelease(cfg)
+	if err != nil {
+		logDebug("Unable to check for a newer updater: ", err)
+		return
+	}
+	if outdated, err := updaterOutdated(r); err == nil && outdated {
+		logNotice("A newer updater is available:", r.TagName+", run plex-updater self-update")
+	}
+}
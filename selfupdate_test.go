@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testBinaryName is the release asset of the binary of the platform running the tests
+var testBinaryName = fmt.Sprintf("synology-plex-updater_%s_%s", runtime.GOOS, runtime.GOARCH)
+
+// serveUpdaterRelease serves a release of the GitHub API at /releases/latest and its assets, the
+// checksums being those of files
+func serveUpdaterRelease(t *testing.T, tag string, binary []byte, checksums string) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		rel := map[string]interface{}{
+			"tag_name": tag,
+			"assets": []map[string]string{
+				{"name": "synology-plex-updater_windows_amd64.exe", "browser_download_url": srv.URL + "/windows"},
+				{"name": testBinaryName, "browser_download_url": srv.URL + "/" + testBinaryName},
+				{"name": "checksums.txt", "browser_download_url": srv.URL + "/checksums.txt"},
+			},
+		}
+		json.NewEncoder(w).Encode(rel)
+	})
+	mux.HandleFunc("/"+testBinaryName, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	})
+	mux.HandleFunc("/checksums.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, checksums)
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writeExecutable writes a binary standing for the updater to a temporary directory
+func writeExecutable(t *testing.T) string {
+	t.Helper()
+	exe := filepath.Join(t.TempDir(), "synology-plex-updater")
+	if err := os.WriteFile(exe, []byte("old updater"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	return exe
+}
+
+func TestReplaceBinary(t *testing.T) {
+	binary := []byte("new updater")
+	sum := fmt.Sprintf("%x", sha256.Sum256(binary))
+	for _, tc := range []struct {
+		name      string
+		checksums string
+		want      string
+	}{
+		{"checksums.txt", "0123  synology-plex-updater_windows_amd64.exe\n" + sum + "  " + testBinaryName + "\n", ""},
+		{"binary mode checksum", sum + " *" + testBinaryName + "\n", ""},
+		{"upper case checksum", strings.ToUpper(sum) + "  " + testBinaryName + "\n", ""},
+		{"checksum mismatch", strings.Repeat("0", 64) + "  " + testBinaryName + "\n", "checksum mismatch for " + testBinaryName},
+		{"no checksum", "0123  synology-plex-updater_windows_amd64.exe\n", "has no checksum for " + testBinaryName},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := serveUpdaterRelease(t, "v1.3.0", binary, tc.checksums)
+			cfg := testConfig(t)
+			r, err := fetchUpdaterRelease(cfg, srv.URL+"/releases/latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.TagName != "v1.3.0" {
+				t.Errorf("tag %s, want v1.3.0", r.TagName)
+			}
+			exe := writeExecutable(t)
+			err = replaceBinary(cfg, r, exe)
+			want, mode := "new updater", os.FileMode(0750)
+			if tc.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.want) {
+					t.Fatalf("got error %v, want %q", err, tc.want)
+				}
+				want = "old updater"
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(exe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != want {
+				t.Errorf("binary %q, want %q", b, want)
+			}
+			if info, err := os.Stat(exe); err != nil || info.Mode().Perm() != mode {
+				t.Errorf("mode %v, want %v: %v", info.Mode().Perm(), mode, err)
+			}
+			// the temporary file is removed whether the binary is replaced or not
+			entries, err := os.ReadDir(filepath.Dir(exe))
+			if err != nil || len(entries) != 1 {
+				t.Errorf("files left next to the binary: %v %v", entries, err)
+			}
+		})
+	}
+}
+
+func TestBinaryAsset(t *testing.T) {
+	platform := strings.ReplaceAll(testBinaryName, "_", "-")
+	r := updaterRelease{TagName: "v1.3.0"}
+	for _, n := range []string{platform + ".sha256", "checksums.txt", platform} {
+		r.Assets = append(r.Assets, struct {
+			Name string `json:"name"`
+			URL  string `json:"browser_download_url"`
+		}{n, "https://example.com/" + n})
+	}
+	name, url, err := r.binaryAsset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != platform || url != "https://example.com/"+platform {
+		t.Errorf("asset %s %s, want %s", name, url, platform)
+	}
+
+	r.Assets = r.Assets[:2]
+	if _, _, err := r.binaryAsset(); err == nil || !strings.Contains(err.Error(), "has no asset for") {
+		t.Errorf("got error %v, want no asset", err)
+	}
+}
+
+func TestUpdaterOutdated(t *testing.T) {
+	saved := buildVersion
+	defer func() { buildVersion = saved }()
+
+	for _, tc := range []struct {
+		current, latest string
+		want            bool
+	}{
+		{"v1.2.0", "v1.3.0", true},
+		{"v1.2.0", "v1.2.0", false},
+		{"v1.3.0", "v1.2.9", false},
+		{"1.2.0", "v1.10.0", true},
+	} {
+		buildVersion = tc.current
+		got, err := updaterOutdated(updaterRelease{TagName: tc.latest})
+		if err != nil || got != tc.want {
+			t.Errorf("%s < %s: got %v %v, want %v", tc.current, tc.latest, got, err, tc.want)
+		}
+	}
+
+	buildVersion = "dev"
+	if _, err := updaterOutdated(updaterRelease{TagName: "v1.3.0"}); err == nil {
+		t.Error("development build compared with a release")
+	}
+	buildVersion = "v1.2.0"
+	if _, err := updaterOutdated(updaterRelease{TagName: "latest"}); err == nil {
+		t.Error("invalid tag compared")
+	}
+}
+
+func TestFetchUpdaterReleaseInvalid(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>rate limited</html>")
+	}))
+	defer srv.Close()
+	if _, err := fetchUpdaterRelease(testConfig(t), srv.URL); err == nil || !strings.Contains(err.Error(), "decoding "+srv.URL) {
+		t.Errorf("got error %v, want a decoding error", err)
+	}
+}
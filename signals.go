@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals cancels the context of the run on SIGINT or SIGTERM, which aborts its requests, downloads
+// and commands. A second signal exits right away, unless the package is stopped and about to be started again.
+func (c *Config) handleSignals() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.ctx = ctx
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		s := <-sigs
+		logNotice(fmt.Sprintf("Received %s, stopping the run", s))
+		cancel()
+		for s := range sigs {
+			if c.packageStopped.Load() {
+				logNotice(fmt.Sprintf("Received %s again, waiting for %s to be started again", s, c.PackageName))
+				continue
+			}
+			logNotice(fmt.Sprintf("Received %s again, exiting", s))
+			os.Exit(exitInterrupted)
+		}
+	}()
+}
+
+// context returns the context of the run, cancelled once interrupted
+func (c *Config) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// withRunTimeout bounds the run by RUN_TIMEOUT until the returned function is called
+func (c *Config) withRunTimeout() func() {
+	if c.RunTimeout <= 0 {
+		return func() {}
+	}
+	parent := c.context()
+	ctx, cancel := context.WithTimeout(parent, c.RunTimeout)
+	c.ctx = ctx
+	return func() {
+		cancel()
+		c.ctx = parent
+	}
+}
+
+// interrupted reports whether the run was interrupted by a signal or RUN_TIMEOUT
+func (c *Config) interrupted() bool {
+	return c.context().Err() != nil
+}
+
+// timedOut reports whether the run was stopped by RUN_TIMEOUT
+func (c *Config) timedOut() bool {
+	return errors.Is(c.context().Err(), context.DeadlineExceeded)
+}
+
+// interruption describes why the run was stopped
+func (c *Config) interruption() string {
+	if c.timedOut() {
+		return fmt.Sprintf("run timed out after %s, see RUN_TIMEOUT", c.RunTimeout)
+	}
+	return "interrupted"
+}
+
+// interruptedExitCode returns the exit code of a run stopped by a signal or RUN_TIMEOUT, sending
+// a notification of the timeout
+func (c *Config) interruptedExitCode() int {
+	if !c.timedOut() {
+		return exitInterrupted
+	}
+	if err := sendNotification(c, "PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater stopped: "+c.interruption()); err != nil {
+		logWarn("Unable to send the notification: ", err)
+	}
+	return exitTimeout
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+)
+
+// maxPackageInfoSize is the largest INFO file read from a package, it is about 2KB
+const maxPackageInfoSize = 1 << 20
+
+// errInvalidPackage is returned for a file that is not a .spk package, such as a truncated download or an
+// error page
+var errInvalidPackage = errors.New("invalid package")
+
+// packageKeyRegexp matches the keys of the INFO file of a package
+var packageKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// packageInfo holds the key="value" fields of the INFO file of a .spk package
+type packageInfo map[string]string
+
+// readPackage checks the structure of a .spk package, a tar archive of an INFO file and a package.tgz
+// among others, read to its end, and returns the fields of its INFO file. The md5 checksum of the INFO
+// file is verified against the package.tgz entry, hashed while reading the archive.
+func readPackage(f string) (packageInfo, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var info packageInfo
+	var packageSum string
+	tr := tar.NewReader(file)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", f, errInvalidPackage, err)
+		}
+		switch strings.TrimPrefix(h.Name, "./") {
+		case "INFO":
+			if info, err = parsePackageInfo(io.LimitReader(tr, maxPackageInfoSize)); err != nil {
+				return nil, fmt.Errorf("%s: %w: INFO: %v", f, errInvalidPackage, err)
+			}
+		case "package.tgz":
+			h := md5.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, fmt.Errorf("%s: %w: package.tgz: %v", f, errInvalidPackage, err)
+			}
+			packageSum = fmt.Sprintf("%x", h.Sum(nil))
+		}
+	}
+	if info == nil {
+		return nil, fmt.Errorf("%s: %w: no INFO file", f, errInvalidPackage)
+	}
+	if packageSum == "" {
+		return nil, fmt.Errorf("%s: %w: no package.tgz", f, errInvalidPackage)
+	}
+	if sum := info["checksum"]; sum == "" {
+		logDebug("No checksum of package.tgz in the INFO of", f)
+	} else if !strings.EqualFold(sum, packageSum) {
+		return nil, fmt.Errorf("%s: %w: package.tgz checksum mismatch, md5 %s instead of %s", f, errInvalidPackage, packageSum, sum)
+	}
+	return info, nil
+}
+
+// parsePackageInfo parses the key="value" lines of an INFO file, the values being quoted or not
+func parsePackageInfo(r io.Reader) (packageInfo, error) {
+	info := packageInfo{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || !packageKeyRegexp.MatchString(k) {
+			return nil, fmt.Errorf("line %d: expected key=\"value\"", n)
+		}
+		if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = v[1 : len(v)-1]
+		}
+		info[k] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(info) == 0 {
+		return nil, errors.New("no fields")
+	}
+	return info, nil
+}
+
+// checkPackage returns the INFO of a package, or an error, sending a notification, when it is not the
+// expected version or can not be installed on the NAS. It is checked before PlexMediaServer is stopped.
+func (c *Config) checkPackage(f string, expected string) (packageInfo, error) {
+	info, err := readPackage(f)
+	if err == nil {
+		err = c.checkPackageName(info)
+	}
+	if err == nil {
+		err = checkPackageVersion(info, expected)
+	}
+	if err == nil {
+		err = checkPackageArch(info)
+	}
+	if err == nil {
+		err = c.checkMinDSM(info)
+	}
+	if err == nil {
+		return info, nil
+	}
+	if nerr := sendNotification(c, "PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater stopped: "+err.Error()); nerr != nil {
+		logWarn("Unable to send the notification: ", nerr)
+	}
+	return nil, err
+}
+
+// checkPackageName returns an error when a package is not the Plex package of PACKAGE_NAME, or the one
+// detected with auto, such as the package of another application served under the URL of a release
+func (c *Config) checkPackageName(info packageInfo) error {
+	name := info["package"]
+	if name == "" {
+		logDebug("No package name in the INFO of the package")
+		return nil
+	}
+	want, err := c.packageName()
+	if err != nil {
+		// a first install has no installed package to detect, PACKAGE_NAME=auto stands for the default one
+		logDebug("Unable to detect the Plex package, expecting ", c.PackageName+": ", err)
+		want = c.PackageName
+	}
+	if strings.EqualFold(name, want) {
+		return nil
+	}
+	return fmt.Errorf("the package is %s and not %s, not installing it", name, want)
+}
+
+// checkPackageVersion returns an error when the version of a package is not the expected one, such as
+// the old package of a stale mirror served under the URL of a new release
+func checkPackageVersion(info packageInfo, expected string) error {
+	v := info["version"]
+	if v == "" {
+		return errors.New("no version in the INFO of the package")
+	}
+	if expected != "" && !strings.EqualFold(v, expected) {
+		return fmt.Errorf("the package is version %s instead of %s, not installing it", v, expected)
+	}
+	return nil
+}
+
+// machinePackageArches maps the machine hardware names reported by uname to the arch names of the
+// package INFO files, besides the platforms of the NAS such as apollolake
+var machinePackageArches = map[string][]string{
+	"x86_64":  {"x86_64"},
+	"i686":    {"i686", "x86"},
+	"i386":    {"i686", "x86"},
+	"aarch64": {"armv8", "aarch64"},
+	"armv7l":  {"armv7"},
+	"ppc64le": {"ppc64le"},
+}
+
+// checkPackageArch returns an error when the arch list of a package names neither the platform of the NAS
+// nor its machine, before a wrong BUILD_TYPE stops PlexMediaServer with a package synopkg fails to install
+func checkPackageArch(info packageInfo) error {
+	arches := strings.Fields(info["arch"])
+	if len(arches) == 0 {
+		return nil
+	}
+	accepted := map[string]bool{"noarch": true}
+	platform, err := confField(synoinfoFile, "platform_name")
+	if err == nil {
+		accepted[strings.ToLower(platform)] = true
+	} else {
+		logDebug("Unable to read the platform of the NAS: ", err)
+	}
+	m, merr := machineArch()
+	if merr == nil {
+		for _, a := range machinePackageArches[m] {
+			accepted[a] = true
+		}
+	}
+	if err != nil && merr != nil {
+		logDebug("Unable to check the arch of the package: ", merr)
+		return nil
+	}
+	for _, a := range arches {
+		if accepted[strings.ToLower(a)] {
+			logDebug("The package is built for ", a)
+			return nil
+		}
+	}
+	if platform == "" {
+		platform = "unknown"
+	}
+	return fmt.Errorf("the package is built for %s and the NAS is of platform %s, machine %s, not installing it, see BUILD_TYPE", strings.Join(arches, " "), platform, m)
+}
+
+// checkMinDSM returns an error when the DSM of the NAS is older than the os_min_ver of a package, such as
+// 7.0-40000, comparing the build numbers when known, unless IGNORE_OS_MIN_VER is set
+func (c *Config) checkMinDSM(info packageInfo) error {
+	min := info["os_min_ver"]
+	if min == "" {
+		return nil
+	}
+	dsm, err := dsmVersion()
+	if err != nil {
+		logDebug("Unable to check the os_min_ver of the package: ", err)
+		return nil
+	}
+	minVersion, minBuild, _ := strings.Cut(min, "-")
+	older := false
+	build, berr := dsmVersionField("buildnumber")
+	if mb, err := strconv.Atoi(minBuild); err == nil && berr == nil {
+		b, err := strconv.Atoi(build)
+		if err != nil {
+			return fmt.Errorf("invalid DSM build number %q", build)
+		}
+		older = b < mb
+		dsm += "-" + build
+	} else {
+		vm, err := version.NewVersion(minVersion)
+		if err != nil {
+			return fmt.Errorf("invalid os_min_ver %q in the package", min)
+		}
+		vd, err := version.NewVersion(dsm)
+		if err != nil {
+			return fmt.Errorf("invalid DSM version %q", dsm)
+		}
+		older = vd.LessThan(vm)
+	}
+	if !older {
+		logDebug("DSM", dsm, "meets the os_min_ver of the package: ", min)
+		return nil
+	}
+	if c.IgnoreMinDSM {
+		logWarn(fmt.Sprintf("The package needs DSM %s, installing it on DSM %s anyway as IGNORE_OS_MIN_VER is set", min, dsm))
+		return nil
+	}
+	return errors.New("the package needs DSM " + min + " or later and the NAS runs DSM " + dsm + ", not installing it, see IGNORE_OS_MIN_VER")
+}
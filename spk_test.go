@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePackage writes a package to a temporary file and returns its path
+func writePackage(t *testing.T, pkg []byte) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), testPackageName)
+	if err := os.WriteFile(f, pkg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestReadPackage(t *testing.T) {
+	payload := []byte("payload")
+	for _, tc := range []struct {
+		name string
+		pkg  []byte
+	}{
+		{"package", testPackage(t, testPackageInfo, payload)},
+		{"dot prefixed entries", testTar(t,
+			tarEntry{"./INFO", []byte(testPackageInfo)},
+			tarEntry{"./package.tgz", payload})},
+		{"no checksum", testTar(t,
+			tarEntry{"INFO", []byte(testPackageInfo)},
+			tarEntry{"package.tgz", payload})},
+		{"comments and unquoted values", testPackage(t, "# Plex\n\npackage=PlexMediaServer\nversion=\"1.40.0.7998-c29d4c0c8\"\n", payload)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := readPackage(writePackage(t, tc.pkg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info["package"] != "PlexMediaServer" || info["version"] != "1.40.0.7998-c29d4c0c8" {
+				t.Errorf("got INFO %v", info)
+			}
+		})
+	}
+}
+
+func TestReadPackageInvalid(t *testing.T) {
+	payload := []byte("payload")
+	pkg := testPackage(t, testPackageInfo, payload)
+	for _, tc := range []struct {
+		name string
+		pkg  []byte
+		want string
+	}{
+		{"bad INFO line", testPackage(t, testPackageInfo+"not a field\n", payload), "INFO: line 4"},
+		{"bad INFO key", testPackage(t, "plex server=\"1\"\n", payload), "INFO: line 1"},
+		{"empty INFO", testTar(t, tarEntry{"INFO", []byte("# none\n")}, tarEntry{"package.tgz", payload}), "INFO: no fields"},
+		{"no INFO", testTar(t, tarEntry{"package.tgz", payload}), "no INFO file"},
+		{"no package.tgz", testTar(t, tarEntry{"INFO", []byte(testPackageInfo)}), "no package.tgz"},
+		{"checksum mismatch", testTar(t,
+			tarEntry{"INFO", []byte(testPackageInfo + "checksum=\"d41d8cd98f00b204e9800998ecf8427e\"\n")},
+			tarEntry{"package.tgz", payload}), "package.tgz checksum mismatch"},
+		{"error page", []byte("<html><body>503 Service Unavailable</body></html>"), "invalid package"},
+		{"truncated", pkg[:len(pkg)-1024-600], "invalid package"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readPackage(writePackage(t, tc.pkg))
+			if !errors.Is(err, errInvalidPackage) {
+				t.Fatalf("got error %v, want an invalid package", err)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// otherArch returns a package arch the machine running the tests does not match
+func otherArch(t *testing.T) string {
+	t.Helper()
+	m, err := machineArch()
+	if err != nil {
+		t.Skip("unable to read the machine arch: ", err)
+	}
+	for _, a := range []string{"ppc64le", "armv7"} {
+		matched := false
+		for _, p := range machinePackageArches[m] {
+			matched = matched || p == a
+		}
+		if !matched {
+			return a
+		}
+	}
+	t.Skip("no arch other than the one of ", m)
+	return ""
+}
+
+func TestCheckPackage(t *testing.T) {
+	payload := []byte("payload")
+	const expected = "1.40.0.7998-c29d4c0c8"
+	for _, tc := range []struct {
+		name        string
+		packageName string
+		info        string
+		want        string
+	}{
+		{"package", "", testPackageInfo, ""},
+		{"package name of another case", "plexmediaserver", testPackageInfo, ""},
+		{"DSM 6 package name", "Plex Media Server", "package=\"Plex Media Server\"\nversion=\"" + expected + "\"\n", ""},
+		{"DSM 6 package of a DSM 7 install", "", "package=\"Plex Media Server\"\nversion=\"" + expected + "\"\n",
+			"the package is Plex Media Server and not PlexMediaServer"},
+		{"other package named plex", "", "package=\"PlexMediaServerBeta\"\nversion=\"" + expected + "\"\n",
+			"the package is PlexMediaServerBeta and not PlexMediaServer"},
+		{"package containing plex", "", "package=\"notplex\"\nversion=\"" + expected + "\"\n",
+			"the package is notplex and not PlexMediaServer"},
+		{"no package name", "", "version=\"" + expected + "\"\n", ""},
+		{"wrong package", "", "package=\"VideoStation\"\nversion=\"" + expected + "\"\n",
+			"the package is VideoStation and not PlexMediaServer"},
+		{"wrong version", "", "package=\"PlexMediaServer\"\nversion=\"1.39.0.7000-a1b2c3d4e\"\n",
+			"the package is version 1.39.0.7000-a1b2c3d4e instead of " + expected},
+		{"no version", "", "package=\"PlexMediaServer\"\n", "no version in the INFO of the package"},
+		{"wrong arch", "", "package=\"PlexMediaServer\"\nversion=\"" + expected + "\"\narch=\"" + otherArch(t) + "\"\n",
+			"the package is built for " + otherArch(t)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			if tc.packageName != "" {
+				cfg.PackageName = tc.packageName
+			}
+			info, err := cfg.checkPackage(writePackage(t, testPackage(t, tc.info, payload)), expected)
+			if tc.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info["version"] != expected {
+					t.Errorf("got INFO %v", info)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("got error %v, want %q", err, tc.want)
+			}
+			if info != nil {
+				t.Errorf("got INFO %v for a rejected package", info)
+			}
+		})
+	}
+}
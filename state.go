@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultStateDir = "/var/lib/synology-plex-updater"
+
+// state is persisted between runs in the state directory
+type state struct {
+	SkippedVersions []string        `json:"skipped_versions,omitempty"`
+	PendingInstall  *pendingInstall `json:"pending_install,omitempty"`
+	// FirstSeen records when each latest version was first seen, to enforce MIN_RELEASE_AGE
+	FirstSeen map[string]time.Time `json:"first_seen,omitempty"`
+	// Notified records when a new version notification was sent for each version
+	Notified map[string]time.Time `json:"notified,omitempty"`
+	Approval *approval            `json:"approval,omitempty"`
+	// LastCheck is the latest version seen by the last check
+	LastCheck *lastCheck `json:"last_check,omitempty"`
+	// BlockNotified records when the notification of a version blocked by BLOCKLIST_URL was sent
+	BlockNotified map[string]time.Time `json:"block_notified,omitempty"`
+	// Partials are the partial downloads created by the updater, the only ones clean removes
+	Partials []string `json:"partials,omitempty"`
+
+	// dir is the state directory the state was loaded from
+	dir string
+}
+
+// lastCheck is the outcome of the last check for a new version
+type lastCheck struct {
+	LatestVersion string    `json:"latest_version"`
+	Time          time.Time `json:"time"`
+}
+
+// approval is a request to install a version, approved with the approve subcommand or the approval file
+type approval struct {
+	Version   string    `json:"version"`
+	Requested time.Time `json:"requested,omitempty"`
+	Approved  time.Time `json:"approved,omitempty"`
+}
+
+// pendingInstall is a verified package waiting for the install window
+type pendingInstall struct {
+	Version  string    `json:"version"`
+	File     string    `json:"file"`
+	Checksum string    `json:"checksum"`
+	Since    time.Time `json:"since"`
+}
+
+// stateFilePath returns the path of the state file in a state directory
+func stateFilePath(dir string) string {
+	return filepath.Join(dir, "state.json")
+}
+
+// loadState reads the state file of a state directory, returning an empty state when there is none yet
+func loadState(dir string) (state, error) {
+	s := state{dir: dir}
+	j, err := os.ReadFile(stateFilePath(dir))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(j, &s); err != nil {
+		return s, fmt.Errorf("%s: %w", stateFilePath(dir), err)
+	}
+	return s, nil
+}
+
+// save atomically writes the state file
+func (s state) save() error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	j, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := stateFilePath(s.dir) + ".tmp"
+	if err := os.WriteFile(tmp, append(j, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFilePath(s.dir))
+}
+
+// recordPartial records a partial download in the state of a state directory, forgetting the recorded
+// ones since renamed or removed
+func recordPartial(dir string, partial string) {
+	s, err := loadState(dir)
+	if err == nil {
+		if abs, aerr := filepath.Abs(partial); aerr == nil {
+			partial = abs
+		}
+		kept := []string{partial}
+		for _, p := range s.Partials {
+			if _, err := os.Stat(p); err == nil && p != partial {
+				kept = append(kept, p)
+			}
+		}
+		s.Partials = kept
+		err = s.save()
+	}
+	if err != nil {
+		logDebug("Unable to record the partial download: ", err)
+	}
+}
+
+// isSkipped reports whether a version was blocklisted with skip-version, ignoring the build hash
+func (s state) isSkipped(v string) bool {
+	for _, sv := range s.SkippedVersions {
+		if coreVersion(sv) == coreVersion(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// skip adds a version to the blocklist, reporting whether it was added
+func (s *state) skip(v string) bool {
+	if s.isSkipped(v) {
+		return false
+	}
+	s.SkippedVersions = append(s.SkippedVersions, coreVersion(v))
+	return true
+}
+
+// unskip removes a version from the blocklist, reporting whether it was there
+func (s *state) unskip(v string) bool {
+	kept := s.SkippedVersions[:0]
+	for _, sv := range s.SkippedVersions {
+		if coreVersion(sv) != coreVersion(v) {
+			kept = append(kept, sv)
+		}
+	}
+	removed := len(kept) != len(s.SkippedVersions)
+	s.SkippedVersions = kept
+	return removed
+}
+
+// seen records the first time a version was seen, reporting whether it was new
+func (s *state) seen(v string, now time.Time) bool {
+	if s.FirstSeen == nil {
+		s.FirstSeen = map[string]time.Time{}
+	}
+	if _, ok := s.FirstSeen[v]; ok {
+		return false
+	}
+	s.FirstSeen[v] = now.UTC()
+	return true
+}
+
+// wasNotified reports whether a new version notification was already sent for a version
+func (s state) wasNotified(v string) bool {
+	_, ok := s.Notified[v]
+	return ok
+}
+
+// markNotified records that a new version notification was sent for a version
+func (s *state) markNotified(v string, now time.Time) {
+	if s.Notified == nil {
+		s.Notified = map[string]time.Time{}
+	}
+	s.Notified[v] = now.UTC()
+}
+
+// forget drops the per-version records of versions not newer than the installed one
+func (s *state) forget(installedVersion string) {
+	for _, m := range []map[string]time.Time{s.FirstSeen, s.Notified, s.BlockNotified} {
+		for v := range m {
+			if cmp, err := compareVersions(v, installedVersion); err != nil || cmp <= 0 {
+				delete(m, v)
+			}
+		}
+	}
+}
+
+// requestApproval records that a version waits for approval, replacing a stale request for another version
+func (s *state) requestApproval(v string, now time.Time) bool {
+	if s.Approval != nil && coreVersion(s.Approval.Version) == coreVersion(v) {
+		return false
+	}
+	if s.Approval != nil {
+		logInfo("Discarding the approval of version", s.Approval.Version, "superseded by", v)
+	}
+	s.Approval = &approval{Version: v, Requested: now.UTC()}
+	return true
+}
+
+// approved reports whether a version was approved, either with the approve subcommand or by
+// touching the approval file after the approval was requested
+func (s state) approved(v string, approvalFile string) bool {
+	if s.Approval == nil || coreVersion(s.Approval.Version) != coreVersion(v) {
+		return false
+	}
+	if !s.Approval.Approved.IsZero() {
+		return true
+	}
+	if approvalFile == "" {
+		return false
+	}
+	fi, err := os.Stat(approvalFile)
+	return err == nil && !fi.ModTime().Before(s.Approval.Requested)
+}
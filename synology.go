@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/go-version"
+)
+
+// errNotInstalled is returned when the PlexMediaServer package is not installed
+var errNotInstalled = errors.New("PlexMediaServer is not installed, run plex-updater bootstrap to install it")
+
+// defaultPackageName is the name of the package published by Plex
+const defaultPackageName = "PlexMediaServer"
+
+// plexPackageRegexp matches the names of the packages that can be Plex Media Server
+var plexPackageRegexp = regexp.MustCompile(`(?i)plex`)
+
+// parsePackageList returns the package names of the output of synopkg list,
+// whose lines are the name and the version of a package followed by its description
+func parsePackageList(out []byte) []string {
+	names := []string{}
+	for _, l := range strings.Split(string(out), "\n") {
+		id, _, _ := strings.Cut(strings.TrimSpace(l), ":")
+		if id == "" {
+			continue
+		}
+		if i := strings.IndexFunc(id, unicode.IsSpace); i >= 0 {
+			id = id[:i]
+		}
+		// the version starts at the first dash followed by a digit
+		for i := 1; i < len(id)-1; i++ {
+			if id[i] == '-' && unicode.IsDigit(rune(id[i+1])) {
+				id = id[:i]
+				break
+			}
+		}
+		names = append(names, id)
+	}
+	return names
+}
+
+// detectPackageName returns the single installed package whose name looks like Plex
+func detectPackageName(cfg *Config) (string, error) {
+	out, err := cfg.synopkg("list")
+	if err != nil {
+		return "", err
+	}
+	candidates := []string{}
+	for _, name := range parsePackageList(out) {
+		if plexPackageRegexp.MatchString(name) {
+			candidates = append(candidates, name)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return "", errNotInstalled
+	case 1:
+		return candidates[0], nil
+	}
+	return "", fmt.Errorf("several packages look like Plex, set PACKAGE_NAME to one of: %s", strings.Join(candidates, ", "))
+}
+
+// packageName returns the name of the Plex package, detecting it once with synopkg list in auto mode
+func (c *Config) packageName() (string, error) {
+	if c.PackageName == "auto" {
+		c.PackageName, c.AutoPackage = defaultPackageName, true
+	}
+	if !c.AutoPackage {
+		return c.PackageName, nil
+	}
+	name, err := detectPackageName(c)
+	if err != nil {
+		return "", err
+	}
+	logInfo("Detected the Plex package: ", name)
+	c.PackageName, c.AutoPackage = name, false
+	return name, nil
+}
+
+// getInstalledVersion returns the installed version of plex, errNotInstalled when synopkg fails on a
+// package that is not installed
+func getInstalledVersion(cfg *Config) (string, error) {
+	name, err := cfg.packageName()
+	if err != nil {
+		return "", err
+	}
+	out, err := cfg.synopkg("version", name)
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()+string(out)), "not installed") {
+			return "", errNotInstalled
+		}
+		if st, serr := getPackageStatus(cfg); serr == nil && st == "not-installed" {
+			return "", errNotInstalled
+		}
+		return "", err
+	}
+	v := strings.TrimSpace(strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0])
+	if v == "" {
+		return "", fmt.Errorf("synopkg version %s printed no version", name)
+	}
+	if _, err := version.NewVersion(coreVersion(v)); err != nil {
+		return "", fmt.Errorf("synopkg version %s printed %q, not a version", name, v)
+	}
+	return v, nil
+}
+
+// packageStatus is the state of a package reported by synopkg status
+type packageStatus struct {
+	Package string `json:"package"`
+	Status  string `json:"status"`
+}
+
+// getPackageStatus returns the state of the PlexMediaServer package: running, stopped, broken or not-installed
+func getPackageStatus(cfg *Config) (string, error) {
+	name, err := cfg.packageName()
+	if errors.Is(err, errNotInstalled) {
+		return "not-installed", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// synopkg status exits non-zero when the package is not running, its output tells why
+	out, err := cfg.synopkg("status", name)
+	s := packageStatus{}
+	if jerr := json.Unmarshal(out, &s); jerr != nil {
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("decoding synopkg status: %w", jerr)
+	}
+	switch strings.ToLower(s.Status) {
+	case "running", "start", "started":
+		return "running", nil
+	case "stop", "stopped":
+		return "stopped", nil
+	case "non_installed", "not_installed", "uninstalled":
+		return "not-installed", nil
+	}
+	return "broken", nil
+}
+
+// updatePlexPackage updates the plex package. Once stopped, the service is always started again,
+// also when the install fails or the run is interrupted.
+func updatePlex(cfg *Config, f string) (err error) {
+	logInfo("Stopping", cfg.PackageName, "service")
+	cfg.packageStopped.Store(true)
+	defer cfg.packageStopped.Store(false)
+	out, err := cfg.synopkg("stop", cfg.PackageName)
+	if err != nil {
+		return errors.Join(err, startPlex(cfg))
+	}
+	logInfo(strings.Split(string(out), "\n")[0])
+
+	// once stopped, the package is started again whatever makes the update fail, a panic included
+	started := false
+	defer func() {
+		if p := recover(); p != nil {
+			logError(fmt.Sprintf("panic: %v\n%s", p, debug.Stack()))
+			err = fmt.Errorf("panic: %v", p)
+		}
+		if !started {
+			err = restartAfterFailure(cfg, err)
+		}
+	}()
+
+	if err = installPackage(cfg, f); err != nil {
+		return err
+	}
+	// the start once installed is attempted once, the deferred one only covers a failed install
+	started = true
+	if serr := startPlex(cfg); serr != nil {
+		return packageDown(cfg, nil, serr)
+	}
+
+	logInfo(cfg.PackageName, "package updated successfully")
+	return nil
+}
+
+// restartAfterFailure starts the package stopped by an update that failed, notifying what happened,
+// and returns the error of the update, joined with the one of the start when the package stays down
+func restartAfterFailure(cfg *Config, cause error) error {
+	if serr := startPlex(cfg); serr != nil {
+		return packageDown(cfg, cause, serr)
+	}
+	msg := fmt.Sprintf("Synology Plex Updater failed to update %s and started it again: %v", cfg.PackageName, cause)
+	if nerr := sendNotification(cfg, "PKGHasUpgrade", "pkg_has_update", msg); nerr != nil {
+		logWarn("Unable to send the notification: ", nerr)
+	}
+	return cause
+}
+
+// packageDown notifies that the package stopped by an update failed to start again, after the install or
+// after its failure cause, and returns the error of the start joined with cause
+func packageDown(cfg *Config, cause error, serr error) error {
+	logError(fmt.Sprintf("%s IS DOWN: starting it again failed: %v", cfg.PackageName, serr))
+	msg := fmt.Sprintf("%s IS DOWN: Synology Plex Updater updated it and failed to start it again, start it manually. Start: %v", cfg.PackageName, serr)
+	if cause != nil {
+		msg = fmt.Sprintf("%s IS DOWN: Synology Plex Updater stopped it to update it and failed to start it again, start it manually. Update: %v. Start: %v", cfg.PackageName, cause, serr)
+	}
+	if nerr := sendNotification(cfg, "PKGHasUpgrade", "pkg_has_update", msg); nerr != nil {
+		logWarn("Unable to send the notification: ", nerr)
+	}
+	return errors.Join(cause, fmt.Errorf("%s is down, starting it again: %w", cfg.PackageName, serr))
+}
+
+// installPlex installs the plex package and starts its service
+func installPlex(cfg *Config, f string) error {
+	if err := installPackage(cfg, f); err != nil {
+		return err
+	}
+	return startPlex(cfg)
+}
+
+// installPackage installs a package file with synopkg
+func installPackage(cfg *Config, f string) error {
+	logInfo("Installing", cfg.PackageName, "package")
+	out, err := cfg.synopkg("install", f)
+	if err != nil {
+		return err
+	}
+	logInfo(strings.Split(string(out), "\n")[0])
+	return nil
+}
+
+// startPlex starts the service of the plex package, even when the run was interrupted or timed out
+func startPlex(cfg *Config) error {
+	if cfg.interrupted() {
+		logNotice(fmt.Sprintf("Starting %s again before exiting: %s", cfg.PackageName, cfg.interruption()))
+	}
+	logInfo("Starting", cfg.PackageName, "service")
+	out, err := cfg.synopkgContext(context.Background(), "start", cfg.PackageName)
+	if err != nil {
+		return err
+	}
+	logInfo(strings.Split(string(out), "\n")[0])
+	return nil
+}
+
+// packageVolume returns the volume PlexMediaServer is installed on
+func (c *Config) packageVolume() (string, error) {
+	name, err := c.packageName()
+	if err != nil {
+		return "", err
+	}
+	// DSM links the target of a package to its install directory on a volume
+	target, err := filepath.EvalSymlinks(filepath.Join("/var/packages", name, "target"))
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(target, "/")
+	if len(parts) < 3 || !strings.HasPrefix(parts[1], "volume") {
+		return "", fmt.Errorf("%s is not installed on a volume: %s", name, target)
+	}
+	return "/" + parts[1], nil
+}
+
+// sendNotification sends a notification of a particular tag to the Synology Notification Center
+func sendNotification(cfg *Config, tag string, template string, msg string) error {
+	_, err := notifyDSM(cfg, tag, template, msg)
+	return err
+}
+
+// notifyDSM sends a notification with synonotify and returns its output
+func notifyDSM(cfg *Config, tag string, template string, msg string) (string, error) {
+	j, err := json.Marshal(map[string]interface{}{
+		"%" + strings.ToUpper(template) + "%": redact(msg),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	logInfo("Sending notification: ", cfg.Synonotify, tag, string(j))
+	out, err := cfg.synonotify(tag, string(j))
+	if err != nil {
+		return string(out), err
+	}
+	logInfo("Notification sent: ", strings.Split(string(out), "\n")[0])
+	return string(out), nil
+}
+
+// synopkg runs synopkg, or its stand-in in --no-synology mode, killed when the run is interrupted
+func (c *Config) synopkg(args ...string) ([]byte, error) {
+	return c.synopkgContext(c.context(), args...)
+}
+
+// synopkgContext runs synopkg, or its stand-in in --no-synology mode, killed once ctx is done
+func (c *Config) synopkgContext(ctx context.Context, args ...string) ([]byte, error) {
+	if c.NoSynology {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.stub().synopkg(args...)
+	}
+	return commandOutput(ctx, c.Synopkg, args...)
+}
+
+// synonotify runs synonotify, or its stand-in in --no-synology mode
+func (c *Config) synonotify(args ...string) ([]byte, error) {
+	if c.NoSynology {
+		logInfo("[no-synology] Would run: ", c.Synonotify, strings.Join(args, " "))
+		return []byte("notification not sent, --no-synology"), nil
+	}
+	// notifications are sent even once the run is interrupted, e.g. the one of a timeout
+	return commandOutput(context.Background(), c.Synonotify, args...)
+}
+
+// stub returns the stand-in of the Synology tools, created on first use
+func (c *Config) stub() *stubSynology {
+	if c.stubSynology == nil {
+		c.stubSynology = &stubSynology{version: "0.0.0.0-0"}
+	}
+	return c.stubSynology
+}
+
+// stubSynology stands in for synopkg off a NAS, as if an old version of the package was installed
+// and running, an install replacing it with the version of the package file
+type stubSynology struct {
+	version string
+}
+
+// synopkg returns the output synopkg would have
+func (s *stubSynology) synopkg(args ...string) ([]byte, error) {
+	logInfo("[no-synology] Would run: synopkg", strings.Join(args, " "))
+	if len(args) < 2 && (len(args) == 0 || args[0] != "list") {
+		return nil, fmt.Errorf("[no-synology] unsupported synopkg arguments: %q", args)
+	}
+	switch args[0] {
+	case "list":
+		return []byte(defaultPackageName + "-" + s.version + ": Plex Media Server\n"), nil
+	case "version":
+		return []byte(s.version + "\n"), nil
+	case "status":
+		return json.Marshal(packageStatus{Package: args[1], Status: "running"})
+	case "install":
+		v, ok := packageFileVersion(args[1])
+		if !ok {
+			return nil, fmt.Errorf("[no-synology] unable to derive the package version of %s", args[1])
+		}
+		s.version = v
+		return []byte("installed " + args[1] + "\n"), nil
+	case "start", "stop":
+		return []byte(args[0] + " " + args[1] + "\n"), nil
+	}
+	return nil, fmt.Errorf("[no-synology] unsupported synopkg command: %s", args[0])
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSynology writes synopkg and synonotify scripts recording their arguments, synopkg failing the
+// commands listed in fail and reporting $FAKE_SYNOPKG_VERSION as the installed version
+func fakeSynology(t *testing.T, cfg *Config, fail ...string) (calls func() []string, notifications func() []string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := func(name string, body string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	fails := ""
+	for _, f := range fail {
+		fails += f + ") echo " + f + " failed; exit 1 ;;\n"
+	}
+	cfg.NoSynology = false
+	cfg.Synopkg = script("synopkg", `echo "$1" >> "`+dir+`/calls"
+case "$1" in
+`+fails+`version) echo "$FAKE_SYNOPKG_VERSION"; exit 0 ;;
+esac
+echo "$1 done"
+`)
+	cfg.Synonotify = script("synonotify", `printf '%s\n' "$*" >> "`+dir+`/notifications"`+"\n")
+	lines := func(name string) func() []string {
+		return func() []string {
+			b, err := os.ReadFile(filepath.Join(dir, name))
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			return strings.Split(strings.TrimSpace(string(b)), "\n")
+		}
+	}
+	return lines("calls"), lines("notifications")
+}
+
+func TestUpdatePlexStartsOnce(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		fail         []string
+		err          string
+		notification string
+	}{
+		{"updated", nil, "", ""},
+		{"start failed", []string{"start"}, "PlexMediaServer is down, starting it again",
+			"PlexMediaServer IS DOWN: Synology Plex Updater updated it and failed to start it again"},
+		{"install failed", []string{"install"}, "exit status 1",
+			"Synology Plex Updater failed to update PlexMediaServer and started it again"},
+		{"install and start failed", []string{"install", "start"}, "PlexMediaServer is down, starting it again",
+			"PlexMediaServer IS DOWN: Synology Plex Updater stopped it to update it and failed to start it again, start it manually. Update: "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			calls, notifications := fakeSynology(t, cfg, tc.fail...)
+			err := updatePlex(cfg, filepath.Join(cfg.Dir, testPackageName))
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("got error %v, want %q", err, tc.err)
+			}
+			if got := strings.Join(calls(), " "); got != "stop install start" {
+				t.Errorf("synopkg calls %q, want a single start", got)
+			}
+			sent := notifications()
+			if tc.notification == "" {
+				if len(sent) != 0 {
+					t.Errorf("notifications %q sent for an update", sent)
+				}
+				return
+			}
+			if len(sent) != 1 || !strings.Contains(sent[0], tc.notification) {
+				t.Errorf("notifications %q, want one with %q", sent, tc.notification)
+			}
+			if cfg.packageStopped.Load() {
+				t.Error("package still marked as stopped")
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// isTerminal reports whether a file is attached to a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// tuiLogLines is the number of log lines shown at the bottom of the screen
+const tuiLogLines = 12
+
+// tui is a full screen view of an update run
+type tui struct {
+	mu       sync.Mutex
+	details  [][2]string
+	status   string
+	progress string
+	lines    []string
+	partial  string
+}
+
+// supportsTUI reports whether the terminal can display the TUI
+func supportsTUI() bool {
+	term := os.Getenv("TERM")
+	return isTerminal(os.Stdin) && isTerminal(os.Stderr) && term != "" && term != "dumb"
+}
+
+// Write keeps the tail of the log output and redraws the screen
+func (t *tui) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := strings.Split(t.partial+string(b), "\n")
+	t.partial = lines[len(lines)-1]
+	t.lines = append(t.lines, lines[:len(lines)-1]...)
+	if len(t.lines) > tuiLogLines {
+		t.lines = t.lines[len(t.lines)-tuiLogLines:]
+	}
+	t.draw()
+	return len(b), nil
+}
+
+// setStatus changes the status line and redraws the screen
+func (t *tui) setStatus(status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = status
+	t.draw()
+}
+
+// setProgress changes the download progress and redraws the screen
+func (t *tui) setProgress(progress string, done bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress = progress
+	t.draw()
+}
+
+// draw renders the screen, the caller must hold the lock
+func (t *tui) draw() {
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&b, "%s\n\n", updaterVersion())
+	for _, d := range t.details {
+		fmt.Fprintf(&b, "  %-12s %s\n", d[0], d[1])
+	}
+	fmt.Fprintf(&b, "\n  %-12s %s\n", "Status", t.status)
+	if t.progress != "" {
+		fmt.Fprintf(&b, "  %-12s %s\n", "Download", t.progress)
+	}
+	b.WriteString("\n")
+	for _, l := range t.lines {
+		fmt.Fprintf(&b, "  %s\n", l)
+	}
+	os.Stderr.WriteString(b.String())
+}
+
+// runTUI performs a single run showing its progress full screen, falling back to runOnce
+// when the terminal cannot display it
+func runTUI(o updateOptions) int {
+	if !supportsTUI() {
+		logWarn("The terminal does not support --tui, using the plain output")
+		return runOnce(o)
+	}
+
+	defer o.cfg.withRunTimeout()()
+	t := &tui{status: "Checking for a new version"}
+	log.SetOutput(t)
+	defer log.SetOutput(os.Stderr)
+	drawProgress = t.setProgress
+
+	c, err := checkForUpdate(o.cfg)
+	t.details = [][2]string{
+		{"Installed", c.installedVersion},
+		{"Latest", c.latestVersion},
+		{"Build", o.cfg.BuildType},
+	}
+	if err != nil {
+		t.setStatus("Error: " + err.Error())
+		if o.cfg.interrupted() {
+			return o.cfg.interruptedExitCode()
+		}
+		return errorExitCode(err)
+	}
+	t.details = append(t.details,
+		[2]string{"Distro", c.release.Distro},
+		[2]string{"Label", c.release.Label},
+		[2]string{"URL", c.release.URL},
+		[2]string{"Checksum", c.release.Checksum},
+	)
+
+	switch {
+	case c.available:
+		t.setStatus("New version available")
+	case c.downgrade && o.allowDowngrade:
+		t.setStatus("Latest version is older than the installed one")
+	case o.force && !c.plexPassOnly:
+		t.setStatus("Installed version is the latest, reinstall forced")
+	default:
+		t.setStatus("Up to date")
+		recordLastCheck(o.cfg, c.latestVersion)
+		return exitOK
+	}
+	if !o.dryRun && !confirm(fmt.Sprintf("Install PlexMediaServer %s?", c.latestVersion), o.assumeYes) {
+		t.setStatus("Update cancelled")
+		return exitOK
+	}
+
+	t.setStatus("Updating")
+	o.assumeYes = true
+	rep := report{BuildType: o.cfg.BuildType, Action: actionNone}
+	if err := update(o, &rep); err != nil {
+		t.setStatus("Error: " + err.Error())
+		if o.cfg.interrupted() {
+			return o.cfg.interruptedExitCode()
+		}
+		return errorExitCode(err)
+	}
+	switch rep.Action {
+	case actionInstalled:
+		t.setStatus("Installed version " + rep.InstalledVersion)
+	case actionDownloaded:
+		t.setStatus("Downloaded " + rep.File + ", install pending")
+	default:
+		t.setStatus("No changes made, see the log below")
+	}
+	return exitOK
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+)
+
+// output formats
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// updateCheck holds the result of comparing the installed and the latest versions
+type updateCheck struct {
+	installedVersion string
+	latestVersion    string
+	release          release
+	available        bool
+	downgrade        bool
+	// rebuild tells the latest version is another build of the installed version
+	rebuild bool
+	// skipped tells the latest version was skipped with skip-version
+	skipped bool
+	// blocked is the entry of the BLOCKLIST_URL blocklist the latest version matches
+	blocked string
+	// plexPassOnly tells the latest version needs Plex Pass, not installable on the public channel
+	plexPassOnly bool
+	// added and fixed are the items of the changelog of the latest version
+	added []string
+	fixed []string
+}
+
+// updateOptions holds the settings of an update run
+type updateOptions struct {
+	cfg                *Config
+	dryRun             bool
+	checkOnly          bool
+	downloadOnly       bool
+	force              bool
+	allowDowngrade     bool
+	installFile        string
+	installURL         string
+	checksum           string
+	assumeYes          bool
+	output             string
+	daemon             bool
+	interval           time.Duration
+	scheduleExpr       string
+	schedule           *cronSchedule
+	installWindow      *timeWindow
+	minReleaseAge      time.Duration
+	notifyOnly         bool
+	requireApproval    bool
+	approvalFile       string
+	targetVersion      string
+	tui                bool
+	updaterCheck       bool
+	removeAfterInstall bool
+	keepPackages       int
+	minCheckInterval   time.Duration
+	forceCheck         bool
+	installIfMissing   bool
+}
+
+var packageFileRegexp = regexp.MustCompile(`^PlexMediaServer-(\d+(?:\.\d+)+(?:-[0-9a-f]+)?)-`)
+
+// runUpdate runs the end-to-end check, download, install and notify flow
+func runUpdate(cfg *Config, args []string) {
+	o := updateOptions{cfg: cfg}
+	var installWindow string
+	fs := flag.NewFlagSet("plex-updater", flag.ExitOnError)
+	fs.Usage = usage(fs)
+	buildTypeFlag(fs, cfg)
+	dryRunFlag(fs, &o.dryRun)
+	dirFlag(fs, cfg)
+	downloadFlags(fs, cfg)
+	fs.BoolVar(&o.checkOnly, "check", false, "only check for a new version, exit 2 when one is available")
+	fs.BoolVar(&o.downloadOnly, "download-only", false, "download and verify the latest release with a manifest, without installing")
+	fs.BoolVar(&o.notifyOnly, "notify-only", getenv("MODE", "") == "notify", "only notify about new versions, never download or install (env MODE=notify)")
+	fs.BoolVar(&o.requireApproval, "require-approval", getenvBool("REQUIRE_APPROVAL", false), "only install a new version after it was approved (env REQUIRE_APPROVAL)")
+	fs.StringVar(&o.approvalFile, "approval-file", getenv("APPROVAL_FILE", ""), "file to touch to approve the pending version (env APPROVAL_FILE)")
+	targetVersionFlag(fs, &o.targetVersion)
+	fs.BoolVar(&o.force, "force", getenvBool("FORCE", false), "reinstall the installed version when it is the latest one (env FORCE)")
+	allowDowngradeFlag(fs, &o.allowDowngrade)
+	fs.BoolVar(&cfg.UpdateOnRebuild, "update-on-rebuild", cfg.UpdateOnRebuild, "install a new build of the installed version, published with another hash (env UPDATE_ON_REBUILD)")
+	packageCheckFlags(fs, cfg)
+	fs.BoolVar(&o.installIfMissing, "install-if-missing", getenvBool("INSTALL_IF_MISSING", false), "install the latest release when PlexMediaServer is not installed, as bootstrap does (env INSTALL_IF_MISSING)")
+	fs.StringVar(&o.installFile, "install-file", "", "install a local .spk file instead of downloading the latest release")
+	fs.StringVar(&o.installURL, "install-url", "", "download and install a .spk from a URL, requires --checksum")
+	fs.StringVar(&o.checksum, "checksum", "", "expected sha1 checksum of the --install-file or --install-url package")
+	assumeYesFlag(fs, &o.assumeYes)
+	removeAfterInstallFlag(fs, &o.removeAfterInstall)
+	fs.IntVar(&o.keepPackages, "keep-packages", getenvInt("KEEP_PACKAGES", 0), "after an update, keep only the packages of this many newest versions, 0 keeps them all (env KEEP_PACKAGES)")
+	fs.StringVar(&o.output, "output", outputText, "output format: text or json")
+	fs.BoolVar(&o.updaterCheck, "updater-check", getenvBool("UPDATER_CHECK", false), "log a hint when a newer updater release exists (env UPDATER_CHECK)")
+	fs.BoolVar(&o.tui, "tui", false, "show the run full screen, asking before installing")
+	fs.BoolVar(&o.daemon, "daemon", getenvBool("DAEMON", false), "keep running and check for updates every interval (env DAEMON)")
+	fs.DurationVar(&o.interval, "interval", getenvDuration("INTERVAL", 6*time.Hour), "time between checks in daemon mode (env INTERVAL)")
+	fs.StringVar(&installWindow, "install-window", getenv("INSTALL_WINDOW", ""), "only install between these local times, e.g. 02:00-05:00 (env INSTALL_WINDOW)")
+	fs.DurationVar(&o.minCheckInterval, "min-check-interval", getenvDuration("MIN_CHECK_INTERVAL", 0), "skip the runs within this long of the last successful check, 0 never skips (env MIN_CHECK_INTERVAL)")
+	fs.BoolVar(&o.forceCheck, "force-check", false, "check even within --min-check-interval of the last check")
+	fs.DurationVar(&o.minReleaseAge, "min-release-age", getenvDuration("MIN_RELEASE_AGE", 0), "only install a new version once it has been seen for this long (env MIN_RELEASE_AGE)")
+	fs.StringVar(&o.scheduleExpr, "schedule", getenv("SCHEDULE", ""), "cron expression of the checks in daemon mode, e.g. \"30 3 * * 1-5\" (env SCHEDULE)")
+	logLevelFlags(fs)
+	configFlag(fs)
+	envFileFlag(fs)
+	synologyFlags(fs, cfg)
+	showVersion := fs.Bool("version", false, "print the updater version and exit")
+	showConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	fs.Parse(args)
+
+	if *showVersion {
+		fmt.Println(updaterVersion())
+		return
+	}
+	if *showConfig {
+		printConfig(os.Stdout, cfg, fs)
+		return
+	}
+	intervalSet := getenv("INTERVAL", "") != ""
+	fs.Visit(func(f *flag.Flag) { intervalSet = intervalSet || f.Name == "interval" })
+	cfg.DryRun = o.dryRun || o.checkOnly
+	exitInvalid(errors.Join(cfg.Validate(), o.validate(installWindow, intervalSet)))
+
+	logInfo("Synology Plex Updater - PlexMediaServer for NAS (DSM 6 and 7)")
+	logInfo("Running", updaterVersion())
+	if o.dryRun {
+		logInfo("[dry-run] No changes will be made")
+	}
+	if o.updaterCheck {
+		logUpdaterHint(o.cfg)
+	}
+
+	if o.daemon {
+		os.Exit(runDaemon(o))
+	}
+	if o.tui {
+		os.Exit(runTUI(o))
+	}
+	os.Exit(runOnce(o))
+}
+
+// validate returns every invalid or conflicting option joined in a single error,
+// parsing the install window and the schedule of the daemon
+func (o *updateOptions) validate(installWindow string, intervalSet bool) error {
+	var errs []error
+	if o.output != outputText && o.output != outputJSON {
+		errs = append(errs, fmt.Errorf("invalid output format: %q", o.output))
+	}
+	if installWindow != "" {
+		w, err := parseTimeWindow(installWindow)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		o.installWindow = w
+	}
+	if o.installFile != "" && o.installURL != "" {
+		errs = append(errs, errors.New("--install-file and --install-url are mutually exclusive"))
+	}
+	if o.tui && (o.output == outputJSON || o.checkOnly || o.downloadOnly || o.installFile != "" || o.installURL != "") {
+		errs = append(errs, errors.New("--tui cannot be combined with --output json, --check, --download-only, --install-file or --install-url"))
+	}
+	if o.keepPackages < 0 {
+		errs = append(errs, fmt.Errorf("invalid number of packages to keep: %d", o.keepPackages))
+	}
+	if o.minCheckInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid minimum check interval: %s", o.minCheckInterval))
+	}
+	if !o.daemon {
+		return errors.Join(errs...)
+	}
+	if o.checkOnly || o.tui || o.downloadOnly || o.installFile != "" || o.installURL != "" {
+		errs = append(errs, errors.New("--daemon cannot be combined with --tui, --check, --download-only, --install-file or --install-url"))
+	}
+	if o.interval <= 0 {
+		errs = append(errs, fmt.Errorf("invalid interval: %s", o.interval))
+	}
+	if o.scheduleExpr != "" {
+		if intervalSet {
+			errs = append(errs, errors.New("--interval and --schedule are mutually exclusive"))
+		}
+		schedule, err := parseCron(o.scheduleExpr)
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case schedule.next(time.Now()).IsZero():
+			errs = append(errs, fmt.Errorf("cron expression %q never matches", o.scheduleExpr))
+		}
+		o.schedule = schedule
+	}
+	return errors.Join(errs...)
+}
+
+// runOnce performs a single run, prints its outcome and returns the exit code
+func runOnce(o updateOptions) int {
+	defer o.cfg.withRunTimeout()()
+	start := time.Now()
+	rep := report{BuildType: o.cfg.BuildType, Action: actionNone}
+	err := update(o, &rep)
+	rep.Duration = time.Since(start).Seconds()
+
+	code := exitOK
+	var rateLimited *rateLimitedError
+	if errors.As(err, &rateLimited) {
+		// a rate limited run is not a failure, the next one checks again
+		rep.Error = err.Error()
+		logNotice(err)
+		err = nil
+	}
+	if err != nil {
+		rep.Action = actionFailed
+		rep.Error = err.Error()
+		code = errorExitCode(err)
+		logError(err)
+		if o.cfg.interrupted() {
+			code = o.cfg.interruptedExitCode()
+		}
+	} else if o.checkOnly && rep.UpdateAvailable {
+		code = exitUpdateAvailable
+	}
+	if summary := changelogSummary(rep.ItemsAdded, rep.ItemsFixed, o.cfg.ChangelogItems); rep.UpdateAvailable && summary != "" {
+		logInfo("Changelog of", coreVersion(rep.LatestVersion)+":", summary)
+	}
+
+	switch {
+	case o.output == outputJSON:
+		if err := rep.write(os.Stdout); err != nil {
+			logError(err)
+			code = exitError
+		}
+	case o.checkOnly && err == nil && rateLimited == nil:
+		fmt.Println("installed:", rep.InstalledVersion)
+		fmt.Println("latest:", rep.LatestVersion)
+	case o.downloadOnly && rep.Action == actionDownloaded:
+		fmt.Println(rep.File)
+	}
+	return code
+}
+
+// runDaemon performs a run every interval, or at the times of a cron schedule, until terminated.
+// A signal received during a run interrupts it, PlexMediaServer is started again when it was stopped.
+func runDaemon(o updateOptions) int {
+	o.assumeYes = true
+	done := o.cfg.context().Done()
+
+	next := time.Now()
+	if o.schedule != nil {
+		logInfo("Running as a daemon, checking on schedule", o.scheduleExpr)
+		next = o.schedule.next(next)
+	} else {
+		logInfo("Running as a daemon, checking every", o.interval)
+	}
+	for {
+		if wait := time.Until(next); wait > 0 {
+			logInfo("Next check at", next.Format(time.RFC3339))
+			select {
+			case <-time.After(wait):
+			case <-done:
+				return exitOK
+			}
+		}
+
+		code := runOnce(o)
+		switch {
+		case code == exitInterrupted:
+			return code
+		case code != exitOK:
+			logWarn("Cycle failed, retrying at the next check")
+		default:
+			logInfo("Cycle complete")
+		}
+
+		if o.cfg.interrupted() {
+			return exitOK
+		}
+		if o.schedule != nil {
+			next = o.schedule.next(time.Now())
+		} else {
+			next = time.Now().Add(o.interval)
+		}
+	}
+}
+
+// update performs a run according to the options, recording its outcome in the report
+func update(o updateOptions, rep *report) (err error) {
+	inst := installOptions{
+		cfg:            o.cfg,
+		checksum:       o.checksum,
+		allowDowngrade: o.allowDowngrade,
+		dryRun:         o.dryRun,
+		assumeYes:      o.assumeYes,
+	}
+
+	if o.installFile != "" || o.installURL != "" {
+		var err error
+		if o.installURL != "" {
+			// only the packages the updater downloaded are removed, never a local --install-file
+			inst.removeAfterInstall = o.removeAfterInstall
+			err = installFromURL(o.installURL, inst, rep)
+		} else {
+			err = installPackageFile(o.installFile, inst, rep)
+		}
+		if err != nil || rep.Action != actionInstalled {
+			return err
+		}
+		return sendNotification(o.cfg, "PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater has installed PlexMediaServer version: "+rep.InstalledVersion)
+	}
+
+	if o.downloadOnly {
+		return downloadLatest(o.cfg, o.dryRun, rep)
+	}
+
+	if skip, err := o.recentlyChecked(rep); err != nil || skip {
+		return err
+	}
+	c, err := checkForUpdate(o.cfg)
+	if err == nil {
+		defer func() {
+			if err == nil {
+				recordLastCheck(o.cfg, c.latestVersion)
+			}
+		}()
+	}
+	rep.InstalledVersion = c.installedVersion
+	rep.LatestVersion = c.latestVersion
+	rep.UpdateAvailable = c.available
+	rep.ItemsAdded = c.added
+	rep.ItemsFixed = c.fixed
+	if errors.Is(err, errNotInstalled) && !o.checkOnly {
+		if !o.installIfMissing {
+			return fmt.Errorf("%w, or use --install-if-missing", err)
+		}
+		logNotice("PlexMediaServer is not installed, installing the latest release")
+		if err := freshInstall(o.cfg, o.dryRun, o.assumeYes, o.removeAfterInstall, rep); err != nil || rep.Action != actionInstalled {
+			return err
+		}
+		return sendNotification(o.cfg, "PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater has installed PlexMediaServer version: "+rep.InstalledVersion)
+	}
+	if err != nil {
+		return err
+	}
+	pinBlocked := false
+	if o.targetVersion != "" {
+		if pinBlocked, err = applyTargetVersion(&c, o.targetVersion); err != nil {
+			return err
+		}
+		rep.UpdateAvailable = c.available
+	}
+	if o.checkOnly {
+		return nil
+	}
+
+	s, err := loadState(o.cfg.StateDir)
+	if err != nil {
+		return err
+	}
+	s.forget(c.installedVersion)
+	if c.blocked != "" && !o.dryRun {
+		notifyBlocked(o.cfg, &s, c.latestVersion, c.blocked)
+	}
+
+	uv := coreVersion(c.latestVersion)
+	if pinBlocked {
+		if o.dryRun {
+			logInfo("[dry-run] Would send notification: PKGHasUpgrade")
+			return nil
+		}
+		return notifyNewVersion(o.cfg, &s, c, ", not installed because PlexMediaServer is pinned to "+o.targetVersion)
+	}
+	if o.notifyOnly {
+		if !c.available {
+			return nil
+		}
+		if o.dryRun {
+			logInfo("[dry-run] Would send notification: PKGHasUpgrade")
+			return nil
+		}
+		return notifyNewVersion(o.cfg, &s, c, "")
+	}
+
+	// a blocklisted version is never installed, not even by --force or --allow-downgrade
+	if !c.available && (o.force || c.downgrade && o.allowDowngrade) {
+		if entry := blockedBy(o.cfg, c.latestVersion); entry != "" {
+			return fmt.Errorf("version %s is blocked by the entry %q of BLOCKLIST_URL, not installing it", coreVersion(c.latestVersion), entry)
+		}
+	}
+
+	verb := "updated"
+	switch {
+	case c.available:
+	case c.downgrade && o.allowDowngrade:
+		logWarn("DOWNGRADING PlexMediaServer from", c.installedVersion, "to", c.latestVersion)
+		verb = "downgraded"
+	case o.force && !c.plexPassOnly:
+		if c.skipped {
+			return fmt.Errorf("version %s is skipped, see list-skipped, not reinstalling it", coreVersion(c.latestVersion))
+		}
+		if c.downgrade {
+			return checkDowngrade(c.installedVersion, c.latestVersion, o.allowDowngrade)
+		}
+		// --force reinstalls the installed version, never another one
+		if cmp, err := compareVersions(c.installedVersion, c.latestVersion); err != nil || cmp != 0 {
+			logNotice("Latest version", coreVersion(c.latestVersion), "is not the installed version", coreVersion(c.installedVersion)+", not reinstalling it")
+			return err
+		}
+		logInfo("Forcing reinstall of version: ", c.latestVersion)
+	default:
+		return nil
+	}
+
+	deferInstall := o.installWindow != nil && !o.installWindow.contains(time.Now())
+	if o.dryRun {
+		if deferInstall {
+			logNotice("[dry-run] Outside the install window, would defer the install until", o.installWindow)
+		}
+		return dryRunUpdate(o.cfg, o.cfg.Dir, c.release)
+	}
+
+	if c.available && o.minReleaseAge > 0 {
+		now := time.Now()
+		s.seen(c.latestVersion, now)
+		if err := s.save(); err != nil {
+			return err
+		}
+		installAt := s.FirstSeen[c.latestVersion].Add(o.minReleaseAge)
+		if now.Before(installAt) {
+			logNotice("Version", uv, "first seen", s.FirstSeen[c.latestVersion].Local().Format(time.RFC3339), "waiting until", installAt.Local().Format(time.RFC3339), "to install it")
+			return notifyNewVersion(o.cfg, &s, c, ", it will be installed after "+installAt.Local().Format(time.RFC1123))
+		}
+	}
+	if c.available && o.requireApproval {
+		if s.requestApproval(c.latestVersion, time.Now()) {
+			if err := s.save(); err != nil {
+				return err
+			}
+		}
+		if !s.approved(c.latestVersion, o.approvalFile) {
+			hint := "run 'plex-updater approve " + uv + "'"
+			if o.approvalFile != "" {
+				hint += " or touch " + o.approvalFile
+			}
+			logNotice("Waiting for approval to install version", uv+",", hint)
+			return notifyNewVersion(o.cfg, &s, c, ", "+hint+" to install it")
+		}
+		logInfo("Install of version", uv, "approved")
+	}
+	if c.available {
+		note := ""
+		if deferInstall {
+			note = ", it will be installed during the install window " + o.installWindow.String()
+		}
+		if err := notifyNewVersion(o.cfg, &s, c, note); err != nil {
+			return err
+		}
+	}
+	alreadyPending := s.PendingInstall != nil && s.PendingInstall.Version == c.latestVersion
+	fp, err := downloadWithManifest(o.cfg, o.cfg.Dir, c.latestVersion, c.release)
+	if err != nil {
+		return err
+	}
+	rep.Action = actionDownloaded
+	rep.File = fp
+	rep.Checksum = c.release.Checksum
+	rep.Size = fileSize(fp)
+
+	if deferInstall {
+		if !alreadyPending {
+			s.PendingInstall = &pendingInstall{
+				Version:  c.latestVersion,
+				File:     fp,
+				Checksum: c.release.Checksum,
+				Since:    time.Now().UTC(),
+			}
+			if err := s.save(); err != nil {
+				return err
+			}
+		}
+		logNotice("Outside the install window, install deferred until", o.installWindow)
+		return nil
+	}
+	if !confirm(fmt.Sprintf("New version %s available (installed %s). Install and restart PlexMediaServer?", uv, c.installedVersion), o.assumeYes) {
+		logNotice("Install cancelled, package left in place: ", fp)
+		return nil
+	}
+
+	updatedVersion, err := installRecorded(o.cfg, fp, c.installedVersion, c.latestVersion, c.release.Checksum, false)
+	if err != nil {
+		return err
+	}
+	rep.Action = actionInstalled
+	rep.InstalledVersion = updatedVersion
+	if o.removeAfterInstall {
+		removeInstalledPackage(fp, updatedVersion, c.latestVersion)
+	}
+	if o.keepPackages > 0 {
+		if err := prunePackages(o.cfg.Dir, o.keepPackages); err != nil {
+			logWarn("Unable to prune the old packages: ", err)
+		}
+	}
+	if s.PendingInstall != nil || s.Approval != nil {
+		s.PendingInstall = nil
+		s.Approval = nil
+		if err := s.save(); err != nil {
+			logWarn("Unable to clear the pending install: ", err)
+		}
+	}
+	switch {
+	case c.available:
+		logNotice("Updated version: ", updatedVersion)
+	case verb == "downgraded":
+		logWarn("PlexMediaServer downgraded to version: ", updatedVersion)
+	default:
+		logNotice("Forced reinstall complete, version: ", updatedVersion)
+	}
+	return sendNotification(o.cfg, "PKGHasUpgrade", "pkg_has_update", "Synology Plex Updater has "+verb+" PlexMediaServer to version: "+updatedVersion)
+}
+
+// applyTargetVersion prevents updating past a pinned target version, reporting whether a
+// newer version is available but blocked by the pin
+func applyTargetVersion(c *updateCheck, target string) (bool, error) {
+	ci, err := compareVersions(c.installedVersion, target)
+	if err != nil {
+		return false, fmt.Errorf("invalid target version %q: %w", target, err)
+	}
+	cl, err := compareVersions(c.latestVersion, target)
+	if err != nil {
+		return false, err
+	}
+
+	blocked := cl > 0 && (c.available || ci == 0)
+	switch {
+	case ci == 0:
+		logNotice("Pinned to version", coreVersion(target)+", up to date")
+	case ci > 0:
+		logNotice("Installed version is newer than the pinned version: ", coreVersion(target))
+	}
+	if blocked {
+		logNotice("Latest version", coreVersion(c.latestVersion), "is newer than the pinned version", coreVersion(target)+", not installing it")
+		c.available = false
+	}
+	return blocked, nil
+}
+
+// notifyNewVersion sends the new version notification of the latest version once, with the first
+// CHANGELOG_ITEMS items of its changelog
+func notifyNewVersion(cfg *Config, s *state, c updateCheck, note string) error {
+	v := c.latestVersion
+	if s.wasNotified(v) {
+		logInfo("Already notified about version: ", coreVersion(v))
+		return nil
+	}
+	msg := "Synology Plex Updater detected a new version: " + coreVersion(v) + note
+	if summary := changelogSummary(c.added, c.fixed, cfg.ChangelogItems); summary != "" {
+		msg += ". " + summary
+	}
+	if err := sendNotification(cfg, "PKGHasUpgrade", "pkg_has_update", msg); err != nil {
+		return err
+	}
+	s.markNotified(v, time.Now())
+	return s.save()
+}
+
+// printCheck prints the result of a version check and returns the matching exit code
+func printCheck(c updateCheck) int {
+	fmt.Println("installed:", c.installedVersion)
+	fmt.Println("latest:", c.latestVersion)
+	if c.available {
+		return exitUpdateAvailable
+	}
+	return exitOK
+}
+
+// coreVersion returns a version without its build hash suffix
+func coreVersion(v string) string {
+	return strings.Split(v, "-")[0]
+}
+
+// installedBuild returns the full version of the installed build, the one reported by synopkg with its
+// hash, falling back to the release recorded in the history when only its core version is known
+func installedBuild(dir string, installed string) string {
+	if coreVersion(installed) != installed {
+		return installed
+	}
+	return installedRelease(dir, installed)
+}
+
+// isRebuild reports whether the latest version is another build of the same core version as the one
+// installed, published with another hash. The build of an installed version reported without its hash and
+// not installed by the updater is unknown.
+func isRebuild(installed, latest string) bool {
+	if installed == "" {
+		logDebug("Build of the installed version unknown, it was not installed by the updater")
+		return false
+	}
+	return coreVersion(installed) == coreVersion(latest) && !strings.EqualFold(installed, latest)
+}
+
+// sameBuild reports whether a version is the installed one, comparing the build hash when synopkg reports
+// it and else only the core version
+func sameBuild(installed, v string) bool {
+	if coreVersion(installed) != installed {
+		return strings.EqualFold(installed, v)
+	}
+	return coreVersion(installed) == coreVersion(v)
+}
+
+// compareVersions compares the core of two versions, returning -1, 0 or 1. The suffix is not compared,
+// go-version would order it as a prerelease.
+func compareVersions(a, b string) (int, error) {
+	va, err := version.NewVersion(coreVersion(a))
+	if err != nil {
+		return 0, err
+	}
+	vb, err := version.NewVersion(coreVersion(b))
+	if err != nil {
+		return 0, err
+	}
+	return va.Compare(vb), nil
+}
+
+// packageFileVersion returns the version embedded in a package file name,
+// e.g. PlexMediaServer-1.40.0.7998-c29d4c0c8-x86_64_DSM7.spk
+func packageFileVersion(f string) (string, bool) {
+	m := packageFileRegexp.FindStringSubmatch(filepath.Base(f))
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// recentlyChecked reports whether the last successful check is more recent than --min-check-interval,
+// in which case the run is skipped unless an install is pending
+func (o *updateOptions) recentlyChecked(rep *report) (bool, error) {
+	if o.minCheckInterval <= 0 || o.forceCheck || o.daemon {
+		return false, nil
+	}
+	s, err := loadState(o.cfg.StateDir)
+	if err != nil {
+		return false, err
+	}
+	if s.LastCheck == nil || s.PendingInstall != nil {
+		return false, nil
+	}
+	ago := time.Since(s.LastCheck.Time)
+	if ago >= o.minCheckInterval {
+		return false, nil
+	}
+	rep.LatestVersion = s.LastCheck.LatestVersion
+	logNotice(fmt.Sprintf("Checked %s ago, skipping, see --min-check-interval or use --force-check", ago.Round(time.Second)))
+	return true, nil
+}
+
+// recordLastCheck records the latest version seen by a run finishing without error, failed runs are
+// retried within MIN_CHECK_INTERVAL
+func recordLastCheck(cfg *Config, latest string) {
+	s, err := loadState(cfg.StateDir)
+	if err == nil {
+		s.LastCheck = &lastCheck{LatestVersion: latest, Time: time.Now().UTC()}
+		err = s.save()
+	}
+	if err != nil {
+		logDebug("Unable to record the last check: ", err)
+	}
+}
+
+// checkForUpdate compares the installed version against the latest release for the build type
+func checkForUpdate(cfg *Config) (updateCheck, error) {
+	c := updateCheck{}
+
+	v, err := getInstalledVersion(cfg)
+	if err != nil {
+		return c, err
+	}
+	c.installedVersion = v
+	logInfo("Installed version: ", c.installedVersion)
+	checkIdentity(cfg, c.installedVersion, false)
+
+	p, err := getPlexInfo(cfg)
+	if err != nil {
+		return c, err
+	}
+	c.latestVersion = p.platform.Version
+	c.added = changelogItems(p.platform.ItemsAdded)
+	c.fixed = changelogItems(p.platform.ItemsFixed)
+	logInfo("Latest version: ", c.latestVersion)
+	c.release, err = selectRelease(p, cfg.BuildType, cfg.Distro)
+	if errors.Is(err, errPlexPassOnly) {
+		// the public build lags behind, there is no update the NAS can install
+		logNotice("No new version available, latest version needs Plex Pass: ", coreVersion(c.latestVersion))
+		c.plexPassOnly = true
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+
+	cmp, err := compareVersions(c.installedVersion, c.latestVersion)
+	if err != nil {
+		return c, err
+	}
+	c.available = cmp < 0
+	c.downgrade = cmp > 0
+	if cmp == 0 && cfg.UpdateOnRebuild {
+		c.rebuild = isRebuild(installedBuild(cfg.StateDir, c.installedVersion), c.latestVersion)
+		c.available = c.rebuild
+	}
+
+	s, err := loadState(cfg.StateDir)
+	if err != nil {
+		return c, err
+	}
+	c.skipped = s.isSkipped(c.latestVersion)
+	if c.available && c.skipped {
+		logNotice("Latest version is skipped, see list-skipped: ", coreVersion(c.latestVersion))
+		c.available = false
+	}
+	if c.available {
+		if entry := blockedBy(cfg, c.latestVersion); entry != "" {
+			logNotice(fmt.Sprintf("Latest version %s is blocked by the entry %q of BLOCKLIST_URL, not installing it", coreVersion(c.latestVersion), entry))
+			c.available = false
+			c.blocked = entry
+		}
+	}
+
+	switch {
+	case c.rebuild && c.available:
+		logNotice("New build of the installed version available: ", c.latestVersion)
+	case c.available:
+		logNotice("New version available: ", coreVersion(c.latestVersion))
+	case c.downgrade:
+		logNotice("Latest version is older than the installed one: ", coreVersion(c.latestVersion))
+	default:
+		logNotice("No new version available")
+	}
+
+	return c, nil
+}
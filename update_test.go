@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoreVersion(t *testing.T) {
+	for v, want := range map[string]string{
+		"1.40.0.7998-c29d4c0c8":       "1.40.0.7998",
+		"1.40.0.7998":                 "1.40.0.7998",
+		"1.40.0.7998-c29d4c0c8-extra": "1.40.0.7998",
+		"":                            "",
+	} {
+		if got := coreVersion(v); got != want {
+			t.Errorf("coreVersion(%q) = %q, want %q", v, got, want)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.40.0.7998-c29d4c0c8", "1.41.0.8992-8463ad060", -1},
+		{"1.41.0.8992-8463ad060", "1.40.0.7998-c29d4c0c8", 1},
+		{"1.9.0.1000-aaaaaaaaa", "1.10.0.1000-aaaaaaaaa", -1},
+		{"1.40.0.7998", "1.40.0.8000", -1},
+		// the suffix is a hash, not a prerelease: another build of a version is neither older nor newer
+		{"1.40.0.7998-c29d4c0c8", "1.40.0.7998-0a1b2c3d4", 0},
+		{"1.40.0.7998-ffffffff0", "1.40.0.7998-000000001", 0},
+		{"1.40.0.7998", "1.40.0.7998-c29d4c0c8", 0},
+		{"1.40.0.7998-zzzzzzzzz", "1.40.0.7999-000000000", -1},
+		{"0.0.0.0-0", "1.40.0.7998-c29d4c0c8", -1},
+	} {
+		got, err := compareVersions(tc.a, tc.b)
+		if err != nil {
+			t.Errorf("compareVersions(%s, %s): %v", tc.a, tc.b, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("compareVersions(%s, %s) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+	for _, v := range []string{"", "latest", "v1.x"} {
+		if _, err := compareVersions(v, "1.40.0.7998-c29d4c0c8"); err == nil {
+			t.Errorf("compareVersions(%q) compared", v)
+		}
+	}
+}
+
+func TestIsRebuild(t *testing.T) {
+	for _, tc := range []struct {
+		installed, latest string
+		want              bool
+	}{
+		{"1.40.0.7998-c29d4c0c8", "1.40.0.7998-0a1b2c3d4", true},
+		{"1.40.0.7998-c29d4c0c8", "1.40.0.7998-C29D4C0C8", false},
+		{"1.40.0.7998-c29d4c0c8", "1.40.0.7998-c29d4c0c8", false},
+		{"1.40.0.7998-c29d4c0c8", "1.41.0.8992-8463ad060", false},
+		{"", "1.40.0.7998-c29d4c0c8", false},
+	} {
+		if got := isRebuild(tc.installed, tc.latest); got != tc.want {
+			t.Errorf("isRebuild(%q, %q) = %v, want %v", tc.installed, tc.latest, got, tc.want)
+		}
+	}
+}
+
+func TestInstalledBuild(t *testing.T) {
+	dir := t.TempDir()
+	// the build reported by synopkg is used as is, whatever the history
+	if got := installedBuild(dir, "1.40.0.7998-c29d4c0c8"); got != "1.40.0.7998-c29d4c0c8" {
+		t.Errorf("reported build: got %q", got)
+	}
+	if got := installedBuild(dir, "1.40.0.7998"); got != "" {
+		t.Errorf("no history: got %q, want an unknown build", got)
+	}
+
+	for _, r := range []historyRecord{
+		{ToVersion: "1.40.0.7998", Release: "1.40.0.7998-c29d4c0c8", Result: resultSuccess},
+		{ToVersion: "1.40.0.7998", Release: "1.40.0.7998-0a1b2c3d4", Result: resultFailed},
+	} {
+		r.Time = time.Now().UTC()
+		if err := appendHistory(dir, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := installedBuild(dir, "1.40.0.7998"); got != "1.40.0.7998-c29d4c0c8" {
+		t.Errorf("history: got %q, want the release of the last successful install", got)
+	}
+	if got := installedBuild(dir, "1.40.0.7998-c29d4c0c8"); got != "1.40.0.7998-c29d4c0c8" {
+		t.Errorf("reported build with a history: got %q", got)
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		o    updateOptions
+		want string
+	}{
+		{"run", updateOptions{}, ""},
+		{"daemon", updateOptions{daemon: true, interval: time.Hour}, ""},
+		{"keep packages of a run", updateOptions{keepPackages: -1}, "invalid number of packages to keep: -1"},
+		{"keep packages of the daemon", updateOptions{daemon: true, interval: time.Hour, keepPackages: -1}, "invalid number of packages to keep: -1"},
+		{"min check interval of a run", updateOptions{minCheckInterval: -time.Minute}, "invalid minimum check interval: -1m0s"},
+		{"min check interval of the daemon", updateOptions{daemon: true, interval: time.Hour, minCheckInterval: -time.Minute}, "invalid minimum check interval: -1m0s"},
+		{"daemon interval", updateOptions{daemon: true}, "invalid interval: 0s"},
+	} {
+		tc.o.output = outputText
+		err := tc.o.validate("", false)
+		if tc.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestApplyTargetVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		installed, latest  string
+		target             string
+		available, blocked bool
+		wantAvailable, err bool
+	}{
+		{"newer than the pin", "1.39.0.7000-a1b2c3d4e", "1.41.0.8992-8463ad060", "1.40.0.7998", true, true, false, false},
+		{"pinned and up to date", "1.40.0.7998-c29d4c0c8", "1.41.0.8992-8463ad060", "1.40.0.7998", false, true, false, false},
+		{"up to the pin", "1.39.0.7000-a1b2c3d4e", "1.40.0.7998-c29d4c0c8", "1.40.0.7998", true, false, true, false},
+		{"pin of a newer version", "1.39.0.7000-a1b2c3d4e", "1.40.0.7998-c29d4c0c8", "1.41.0", true, false, true, false},
+		{"invalid pin", "1.39.0.7000-a1b2c3d4e", "1.40.0.7998-c29d4c0c8", "latest", true, false, true, true},
+	} {
+		c := updateCheck{installedVersion: tc.installed, latestVersion: tc.latest, available: tc.available}
+		blocked, err := applyTargetVersion(&c, tc.target)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v", tc.name, err)
+			continue
+		}
+		if blocked != tc.blocked || c.available != tc.wantAvailable {
+			t.Errorf("%s: blocked %v available %v, want %v %v", tc.name, blocked, c.available, tc.blocked, tc.wantAvailable)
+		}
+		// check exits 2 only for an update the pin allows
+		want := exitOK
+		if tc.wantAvailable {
+			want = exitUpdateAvailable
+		}
+		if code := printCheck(c); code != want {
+			t.Errorf("%s: exit code %d, want %d", tc.name, code, want)
+		}
+	}
+}
+
+// testUpdate runs an update against a downloads JSON serving the test package as the latest version, with
+// synopkg reporting installed, and returns the synopkg calls
+func testUpdate(t *testing.T, installed string, latest string, setup func(*updateOptions)) ([]string, error) {
+	t.Helper()
+	pkg := testPackage(t, testPackageInfo, []byte("payload"))
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/5.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testDownloadsJSON(t, latest, release{
+			Build:    "linux-x86_64",
+			Distro:   defaultDistro,
+			URL:      srv.URL + "/" + testPackageName,
+			Checksum: fmt.Sprintf("%x", sha1.Sum(pkg)),
+		}))
+	})
+	mux.Handle("/"+testPackageName, servePackage(pkg))
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	cfg := testConfig(t)
+	cfg.DownloadsURL = srv.URL + "/5.json"
+	calls, _ := fakeSynology(t, cfg)
+	t.Setenv("FAKE_SYNOPKG_VERSION", installed)
+	o := updateOptions{cfg: cfg, assumeYes: true, output: outputText}
+	if setup != nil {
+		setup(&o)
+	}
+	err := update(o, &report{})
+	return calls(), err
+}
+
+// installs reports whether a package was installed by the synopkg calls
+func installs(calls []string) bool {
+	for _, c := range calls {
+		if c == "install" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestForceReinstall(t *testing.T) {
+	force := func(o *updateOptions) { o.force = true }
+	calls, err := testUpdate(t, "1.40.0.7998-c29d4c0c8", "1.40.0.7998-c29d4c0c8", force)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !installs(calls) {
+		t.Errorf("installed version not reinstalled: %q", calls)
+	}
+
+	// an older latest version is a downgrade, not a reinstall
+	calls, err = testUpdate(t, "1.41.0.8992-8463ad060", "1.40.0.7998-c29d4c0c8", force)
+	if installs(calls) {
+		t.Errorf("older version installed by --force: %q", calls)
+	}
+	if err == nil || !strings.Contains(err.Error(), "refusing to downgrade from 1.41.0.8992-8463ad060 to 1.40.0.7998-c29d4c0c8, use --allow-downgrade") {
+		t.Errorf("got error %v, want a refused downgrade", err)
+	}
+	calls, _ = testUpdate(t, "1.41.0.8992-8463ad060", "1.40.0.7998-c29d4c0c8", func(o *updateOptions) {
+		o.force, o.allowDowngrade = true, true
+	})
+	if !installs(calls) {
+		t.Errorf("allowed downgrade not installed: %q", calls)
+	}
+}
+
+func TestForceSkipped(t *testing.T) {
+	calls, err := testUpdate(t, "1.40.0.7998-c29d4c0c8", "1.40.0.7998-c29d4c0c8", func(o *updateOptions) {
+		o.force = true
+		s, err := loadState(o.cfg.StateDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.skip("1.40.0.7998")
+		if err := s.save(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if installs(calls) {
+		t.Errorf("skipped version reinstalled by --force: %q", calls)
+	}
+	if err == nil || !strings.Contains(err.Error(), "version 1.40.0.7998 is skipped") {
+		t.Errorf("got error %v, want a skipped version", err)
+	}
+}
+
+func TestLastCheckAfterSuccess(t *testing.T) {
+	var stateDir string
+	record := func(o *updateOptions) {
+		stateDir = o.cfg.StateDir
+		o.minCheckInterval = time.Hour
+	}
+	lastCheck := func() *lastCheck {
+		s, err := loadState(stateDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.LastCheck
+	}
+
+	// the install of the new version fails, synopkg reporting the older version after it
+	if _, err := testUpdate(t, "1.39.0.7000-a1b2c3d4e", "1.40.0.7998-c29d4c0c8", record); err == nil {
+		t.Fatal("install succeeded")
+	}
+	if c := lastCheck(); c != nil {
+		t.Errorf("failed run recorded as the last check: %+v", c)
+	}
+
+	if _, err := testUpdate(t, "1.40.0.7998-c29d4c0c8", "1.40.0.7998-c29d4c0c8", record); err != nil {
+		t.Fatal(err)
+	}
+	if c := lastCheck(); c == nil || c.LatestVersion != "1.40.0.7998-c29d4c0c8" {
+		t.Errorf("last check %+v, want the latest version of the run", c)
+	}
+}
+
+func TestForceBlocked(t *testing.T) {
+	blocklist := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`["1.40.0.7998"]`))
+	}))
+	defer blocklist.Close()
+
+	for _, tc := range []struct {
+		name              string
+		installed, latest string
+		allowDowngrade    bool
+	}{
+		{"reinstall", "1.40.0.7998-c29d4c0c8", "1.40.0.7998-c29d4c0c8", false},
+		{"rebuild", "1.40.0.7998-0a1b2c3d4", "1.40.0.7998-c29d4c0c8", false},
+		{"newer version", "1.39.0.7000-a1b2c3d4e", "1.40.0.7998-c29d4c0c8", false},
+		{"downgrade", "1.41.0.8992-8463ad060", "1.40.0.7998-c29d4c0c8", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls, err := testUpdate(t, tc.installed, tc.latest, func(o *updateOptions) {
+				o.force, o.allowDowngrade = true, tc.allowDowngrade
+				o.cfg.BlocklistURL = blocklist.URL
+				o.cfg.UpdateOnRebuild = true
+			})
+			if installs(calls) {
+				t.Errorf("blocklisted version installed: %q", calls)
+			}
+			if err == nil || !strings.Contains(err.Error(), `version 1.40.0.7998 is blocked by the entry "1.40.0.7998" of BLOCKLIST_URL`) {
+				t.Errorf("got error %v, want a blocked version", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeWindow is a daily time of day range, it may cross midnight
+type timeWindow struct {
+	start, end int // minutes since midnight
+	expr       string
+}
+
+// parseTimeWindow parses a HH:MM-HH:MM time window
+func parseTimeWindow(s string) (*timeWindow, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid time window %q: expected HH:MM-HH:MM", s)
+	}
+	w := &timeWindow{expr: s}
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window %q: %w", s, err)
+		}
+		m := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			w.start = m
+		} else {
+			w.end = m
+		}
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid time window %q: empty range", s)
+	}
+	return w, nil
+}
+
+// contains reports whether the local time of day of t is inside the window
+func (w *timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	// crosses midnight
+	return m >= w.start || m < w.end
+}
+
+func (w *timeWindow) String() string {
+	return w.expr
+}